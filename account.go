@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	usernameMinLength = 3
+	usernameMaxLength = 32
+	passwordMinLength = 8
+	// bcrypt молча обрезает всё длиннее 72 байт
+	passwordMaxBytes = 72
+
+	MsgTypeRoomClosed = "room_closed"
+)
+
+// commonPasswords — passwords rejected regardless of length
+var commonPasswords = map[string]bool{
+	"password":   true,
+	"password1":  true,
+	"12345678":   true,
+	"123456789":  true,
+	"1234567890": true,
+	"qwertyuiop": true,
+	"qwerty123":  true,
+	"iloveyou":   true,
+	"11111111":   true,
+	"00000000":   true,
+	"abcd1234":   true,
+	"йцукенгшщз": true,
+}
+
+// FieldError — validation error for a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse — structured API error
+type ErrorResponse struct {
+	Error   string       `json:"error"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// writeValidationErrors — write 422 with field errors
+func writeValidationErrors(w http.ResponseWriter, fields []FieldError) {
+	writeJSON(
+		w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error:   "validation_failed",
+			Message: "Request validation failed",
+			Fields:  fields,
+		},
+	)
+}
+
+// validateUsername — check username policy
+func validateUsername(username string) []FieldError {
+	length := utf8.RuneCountInString(username)
+	switch {
+	case strings.TrimSpace(username) == "":
+		return []FieldError{{Field: "username", Code: "required", Message: "Username is required"}}
+	case length < usernameMinLength:
+		return []FieldError{{Field: "username", Code: "too_short", Message: "Username must be at least 3 characters"}}
+	case length > usernameMaxLength:
+		return []FieldError{{Field: "username", Code: "too_long", Message: "Username must be at most 32 characters"}}
+	}
+	for _, ch := range username {
+		isAllowed := ch >= 'a' && ch <= 'z' ||
+			ch >= 'A' && ch <= 'Z' ||
+			ch >= '0' && ch <= '9' ||
+			ch == '.' || ch == '_' || ch == '-'
+		if !isAllowed {
+			return []FieldError{
+				{
+					Field:   "username",
+					Code:    "invalid_characters",
+					Message: "Username may contain only latin letters, digits, '.', '_' and '-'",
+				},
+			}
+		}
+	}
+	return nil
+}
+
+// validatePassword — check password policy
+func validatePassword(password, username string) []FieldError {
+	switch {
+	case password == "":
+		return []FieldError{{Field: "password", Code: "required", Message: "Password is required"}}
+	case utf8.RuneCountInString(password) < passwordMinLength:
+		return []FieldError{{Field: "password", Code: "too_short", Message: "Password must be at least 8 characters"}}
+	case len(password) > passwordMaxBytes:
+		return []FieldError{{Field: "password", Code: "too_long", Message: "Password must be at most 72 bytes"}}
+	case strings.EqualFold(password, username):
+		return []FieldError{{Field: "password", Code: "same_as_username", Message: "Password must differ from username"}}
+	case commonPasswords[strings.ToLower(password)]:
+		return []FieldError{{Field: "password", Code: "too_common", Message: "Password is too common"}}
+	}
+	return nil
+}
+
+// getMe — current user profile via REST
+func getMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	type identity struct {
+		Issuer string `db:"issuer" json:"issuer"`
+		Email  string `db:"email" json:"email"`
+	}
+	identities := make([]identity, 0)
+	if err := db.Select(&identities, "SELECT issuer, email FROM user_identities WHERE user_id=$1", user.ID); err != nil {
+		slog.Error("load identities", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	ownedRooms := make([]string, 0)
+	if err := db.Select(&ownedRooms, "SELECT id FROM rooms WHERE owner_id=$1 ORDER BY id", user.ID); err != nil {
+		slog.Error("load owned rooms", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(
+		w, http.StatusOK, map[string]interface{}{
+			"id":             user.ID,
+			"username":       user.Username,
+			"displayName":    user.Name(),
+			"avatarUrl":      avatarURL(user.Avatar),
+			"avatarThumbUrl": avatarThumbURL(user.Avatar),
+			"hasPassword":    user.Password != "",
+			"totpEnabled":    user.TOTPEnabled,
+			"identities":     identities,
+			"ownedRooms":     ownedRooms,
+		},
+	)
+}
+
+// changePassword — change password and revoke other sessions via REST
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	// У SSO-пользователей пароля нет — задают первый без текущего
+	if user.Password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+			slog.Warn("Invalid current password on change", "userID", user.ID)
+			writeValidationErrors(
+				w, []FieldError{{Field: "currentPassword", Code: "invalid", Message: "Current password is incorrect"}},
+			)
+			return
+		}
+	}
+
+	if fields := validatePassword(req.NewPassword, user.Username); len(fields) > 0 {
+		for i := range fields {
+			fields[i].Field = "newPassword"
+		}
+		writeValidationErrors(w, fields)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET password=$1 WHERE id=$2", hashedPassword, user.ID); err != nil {
+		slog.Error("update password", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	sessionID, _ := r.Context().Value(sessionIdContextKey).(string)
+	if err := revokeUserSessions(user.ID, sessionID); err != nil {
+		slog.Error("revoke other sessions", "userID", user.ID, "error", err)
+	}
+
+	slog.Info("Password changed", "userID", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAccount — delete current user with owned rooms via REST
+func (s *Server) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if user.Password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+			writeValidationErrors(
+				w, []FieldError{{Field: "password", Code: "invalid", Message: "Password is incorrect"}},
+			)
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownedRooms []string
+	if err := tx.Select(&ownedRooms, "SELECT id FROM rooms WHERE owner_id=$1", user.ID); err != nil {
+		slog.Error("load owned rooms", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM rooms WHERE owner_id=$1", user.ID); err != nil {
+		slog.Error("delete owned rooms", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// Запоминаем сессии заранее: после каскадного удаления их уже не найти
+	var sessionIDs []string
+	if err := tx.Select(&sessionIDs, "SELECT id FROM sessions WHERE user_id=$1", user.ID); err != nil {
+		slog.Error("load sessions", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// sessions, user_identities, totp_recovery_codes удаляются по ON DELETE CASCADE
+	if _, err := tx.Exec("DELETE FROM users WHERE id=$1", user.ID); err != nil {
+		slog.Error("delete user", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("commit account deletion", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, sessionID := range sessionIDs {
+		sessions.Revoke(sessionID)
+	}
+	for _, roomID := range ownedRooms {
+		s.closeRoom(roomID)
+	}
+	removeAvatarFiles(user.Avatar)
+
+	slog.Info("Account deleted", "userID", user.ID, "username", user.Username, "rooms", len(ownedRooms))
+	clearAuthCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// closeRoom — drop in-memory room and notify its participants
+func (s *Server) closeRoom(roomID string) {
+	s.RoomsMu.Lock()
+	room, ok := s.Rooms[roomID]
+	delete(s.Rooms, roomID)
+	s.RoomsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.endBreakouts(room)
+	for _, client := range room.waitingClients() {
+		client.setWaiting(nil)
+		if err := client.Send(WebSocketMessageDTO{Type: MsgTypeRoomClosed, RoomID: roomID}); err != nil {
+			slog.Error("notify room closed", "clientID", client.ID, "error", err)
+		}
+	}
+	for _, client := range room.GetClients() {
+		if err := client.Send(WebSocketMessageDTO{Type: MsgTypeRoomClosed, RoomID: roomID}); err != nil {
+			slog.Error("notify room closed", "clientID", client.ID, "error", err)
+		}
+		// Иначе клиент остаётся в удалённой комнате: треки продолжают идти,
+		// а сигналинг пишет в комнату, которой уже нет в s.Rooms
+		s.exitRoom(client, room)
+		client.setRoom(nil)
+		if pc := client.peer(); pc != nil {
+			pc.Close()
+		}
+	}
+	slog.Info("Room closed", "roomID", roomID)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsClient — client on a live WebSocket; the other end reads what the server sends it
+func wsClient(t *testing.T, id string, room *Room, userID int) (*Client, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					t.Errorf("upgrade: %v", err)
+					return
+				}
+				conns <- conn
+			},
+		),
+	)
+	t.Cleanup(srv.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn := <-conns
+	t.Cleanup(
+		func() {
+			peer.Close()
+			conn.Close()
+		},
+	)
+	return NewClient(id, room, conn, userID), peer
+}
+
+// readMessage — next message the server sent to the client
+func readMessage(t *testing.T, peer *websocket.Conn) WebSocketMessageDTO {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var msg WebSocketMessageDTO
+	if err := peer.ReadJSON(&msg); err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	return msg
+}
+
+// errorCode — code of the single validation error, "" when there is none
+func errorCode(t *testing.T, errs []FieldError) string {
+	t.Helper()
+	switch len(errs) {
+	case 0:
+		return ""
+	case 1:
+		return errs[0].Code
+	}
+	t.Fatalf("got %d errors, want at most one: %+v", len(errs), errs)
+	return ""
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		code     string
+	}{
+		{"alice", ""},
+		{"a.b_c-9", ""},
+		{"abc", ""},
+		{strings.Repeat("a", usernameMaxLength), ""},
+		{"", "required"},
+		{"   ", "required"},
+		{"ab", "too_short"},
+		{strings.Repeat("a", usernameMaxLength+1), "too_long"},
+		{"alice smith", "invalid_characters"},
+		{"алиса", "invalid_characters"},
+		{"alice@example", "invalid_characters"},
+		{"abé", "invalid_characters"},
+	}
+	for _, tt := range tests {
+		if code := errorCode(t, validateUsername(tt.username)); code != tt.code {
+			t.Errorf("validateUsername(%q) = %q, want %q", tt.username, code, tt.code)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password string
+		username string
+		code     string
+	}{
+		{"correct horse", "alice", ""},
+		{"пароль12", "alice", ""},
+		{strings.Repeat("a", passwordMaxBytes), "alice", ""},
+		{"", "alice", "required"},
+		{"short", "alice", "too_short"},
+		// 8 символов кириллицы — 16 байт, но это не слишком коротко
+		{"длинный!", "alice", ""},
+		{strings.Repeat("a", passwordMaxBytes+1), "alice", "too_long"},
+		// bcrypt смотрит только на первые 72 байта
+		{strings.Repeat("я", passwordMaxBytes/2+1), "alice", "too_long"},
+		{"AliceSmith", "alicesmith", "same_as_username"},
+		{"Password1", "alice", "too_common"},
+		{"ЙЦУКЕНГШЩЗ", "alice", "too_common"},
+	}
+	for _, tt := range tests {
+		if code := errorCode(t, validatePassword(tt.password, tt.username)); code != tt.code {
+			t.Errorf("validatePassword(%q, %q) = %q, want %q", tt.password, tt.username, code, tt.code)
+		}
+	}
+}
+
+func TestCloseRoom(t *testing.T) {
+	s := NewServer()
+	room := NewRoom("room")
+	s.Rooms[room.ID] = room
+	var clients []*Client
+	var peers []*websocket.Conn
+	for i, id := range []string{"a", "b"} {
+		client, peer := wsClient(t, id, room, i+1)
+		room.AddClient(client)
+		clients = append(clients, client)
+		peers = append(peers, peer)
+	}
+
+	s.closeRoom("room")
+
+	if _, ok := s.Rooms["room"]; ok {
+		t.Error("room is still live after closing")
+	}
+	if n := len(room.GetClients()); n != 0 {
+		t.Errorf("%d clients left in the closed room", n)
+	}
+	for _, client := range clients {
+		if client.CurrentRoom() != nil {
+			t.Errorf("client %s still points at the closed room", client.ID)
+		}
+	}
+	for _, peer := range peers {
+		// Уход остальных из закрываемой комнаты приходит раньше своего room_closed
+		msg := readMessage(t, peer)
+		for msg.Type == MsgTypeParticipantLeft {
+			msg = readMessage(t, peer)
+		}
+		if msg.Type != MsgTypeRoomClosed || msg.RoomID != "room" {
+			t.Errorf("client got %q for room %q, want %q", msg.Type, msg.RoomID, MsgTypeRoomClosed)
+		}
+	}
+}
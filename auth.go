@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	accessCookieName  = "token"
+	refreshCookieName = "refresh_token"
+
+	// CloseSessionRevoked — WebSocket close code for revoked sessions
+	CloseSessionRevoked = 4001
+)
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionRevoked  = errors.New("session revoked")
+	errSessionExpired  = errors.New("session expired")
+	errRefreshReused   = errors.New("refresh token reused")
+	errRefreshInvalid  = errors.New("invalid refresh token")
+)
+
+// Session — authenticated login session backing a refresh token
+type Session struct {
+	ID           string         `db:"id"`
+	UserID       int            `db:"user_id"`
+	RefreshHash  string         `db:"refresh_hash"`
+	PreviousHash sql.NullString `db:"previous_hash"` // прошлый refresh: только его повтор значит кражу
+	ExpiresAt    time.Time      `db:"expires_at"`
+	RevokedAt    sql.NullTime   `db:"revoked_at"`
+	CreatedAt    time.Time      `db:"created_at"`
+}
+
+// SessionRegistry — revocation list and live WebSocket connections per session
+type SessionRegistry struct {
+	mu sync.Mutex
+	// revoked — sessionID -> момент, после которого все access-токены сессии истекли сами
+	revoked map[string]time.Time
+	conns   map[string]map[*websocket.Conn]struct{}
+}
+
+var sessions = NewSessionRegistry()
+
+// NewSessionRegistry — create a new session registry
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		revoked: make(map[string]time.Time),
+		conns:   make(map[string]map[*websocket.Conn]struct{}),
+	}
+}
+
+// IsRevoked — check if a session is in the revocation list
+func (s *SessionRegistry) IsRevoked(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.revoked[sessionID]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(s.revoked, sessionID)
+		return false
+	}
+	return true
+}
+
+// Revoke — add session to the revocation list and drop its WebSockets
+func (s *SessionRegistry) Revoke(sessionID string) {
+	s.mu.Lock()
+	s.revoked[sessionID] = time.Now().Add(cfg.AccessTokenTTL)
+	conns := s.conns[sessionID]
+	delete(s.conns, sessionID)
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for conn := range conns {
+		// WriteControl и Close безопасно вызывать конкурентно с чтением/записью
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseSessionRevoked, "session revoked"),
+			deadline,
+		)
+		conn.Close()
+	}
+	if len(conns) > 0 {
+		slog.Info("WebSockets closed for revoked session", "sessionID", sessionID, "count", len(conns))
+	}
+}
+
+// Track — register a live WebSocket for the session
+func (s *SessionRegistry) Track(sessionID string, conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[sessionID] == nil {
+		s.conns[sessionID] = make(map[*websocket.Conn]struct{})
+	}
+	s.conns[sessionID][conn] = struct{}{}
+}
+
+// Untrack — forget a closed WebSocket
+func (s *SessionRegistry) Untrack(sessionID string, conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns[sessionID], conn)
+	if len(s.conns[sessionID]) == 0 {
+		delete(s.conns, sessionID)
+	}
+}
+
+// loadRevokedSessions — restore revocation list for sessions whose access tokens may still be alive
+func loadRevokedSessions() error {
+	var revoked []Session
+	if err := db.Select(&revoked, "SELECT * FROM sessions WHERE revoked_at IS NOT NULL"); err != nil {
+		return err
+	}
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	now := time.Now()
+	for _, sess := range revoked {
+		until := sess.RevokedAt.Time.Add(cfg.AccessTokenTTL)
+		if until.After(now) {
+			sessions.revoked[sess.ID] = until
+		}
+	}
+	slog.Info("Revoked sessions loaded", "count", len(sessions.revoked))
+	return nil
+}
+
+// generateJWT — generate short-lived access token bound to a session
+func generateJWT(userID int, sessionID string) (string, error) {
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, jwt.MapClaims{
+			"user_id": userID,
+			"sid":     sessionID,
+			"exp":     time.Now().Add(cfg.AccessTokenTTL).Unix(),
+		},
+	)
+	return token.SignedString(jwtSecret)
+}
+
+// validateJWT — validate JWT token, returns user and session IDs
+func validateJWT(tokenString string) (int, string, error) {
+	token, err := jwt.Parse(
+		tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return jwtSecret, nil
+		},
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		userIDFloat, ok := claims["user_id"].(float64)
+		if !ok {
+			return 0, "", jwt.ErrTokenInvalidClaims
+		}
+		sessionID, ok := claims["sid"].(string)
+		if !ok || sessionID == "" {
+			return 0, "", jwt.ErrTokenInvalidClaims
+		}
+		return int(userIDFloat), sessionID, nil
+	}
+
+	return 0, "", jwt.ErrTokenInvalidClaims
+}
+
+// currentUserID — authenticated user ID put into context by authMiddleware
+func currentUserID(r *http.Request) (int, bool) {
+	userID, ok := r.Context().Value(userIdContextKey).(int)
+	return userID, ok
+}
+
+// randomToken — generate URL-safe random token
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken — hash high-entropy token for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitRefreshToken — split refresh token into session ID and secret
+func splitRefreshToken(token string) (string, string, bool) {
+	sessionID, secret, ok := strings.Cut(token, ".")
+	if !ok || sessionID == "" || secret == "" {
+		return "", "", false
+	}
+	return sessionID, secret, true
+}
+
+// createSession — create a new session and return access and refresh tokens
+func createSession(userID int) (string, string, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO sessions (id, user_id, refresh_hash, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)",
+		sessionID,
+		userID,
+		hashToken(secret),
+		time.Now().UTC().Add(cfg.RefreshTokenTTL),
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	access, err := generateJWT(userID, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	slog.Info("Session created", "userID", userID, "sessionID", sessionID)
+	return access, sessionID + "." + secret, nil
+}
+
+// lookupRefreshSession — find active session matching the refresh token
+func lookupRefreshSession(refreshToken string) (Session, error) {
+	sessionID, secret, ok := splitRefreshToken(refreshToken)
+	if !ok {
+		return Session{}, errSessionNotFound
+	}
+
+	var sess Session
+	if err := db.Get(&sess, "SELECT * FROM sessions WHERE id=$1", sessionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Session{}, errSessionNotFound
+		}
+		return Session{}, err
+	}
+	if sess.RevokedAt.Valid {
+		return Session{}, errSessionRevoked
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		return Session{}, errSessionExpired
+	}
+	hash := []byte(hashToken(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(sess.RefreshHash)) == 1 {
+		return sess, nil
+	}
+	if sess.PreviousHash.Valid && subtle.ConstantTimeCompare(hash, []byte(sess.PreviousHash.String)) == 1 {
+		return sess, errRefreshReused
+	}
+	// Знать ID сессии мало: без настоящего секрета её нельзя ни продлить, ни отозвать
+	return Session{}, errRefreshInvalid
+}
+
+// rotateSession — exchange a refresh token for a new access/refresh pair
+func rotateSession(refreshToken string) (string, string, error) {
+	sess, err := lookupRefreshSession(refreshToken)
+	if errors.Is(err, errRefreshReused) {
+		// Старый refresh-токен предъявлен повторно — считаем его украденным
+		if err := revokeSession(sess.ID); err != nil {
+			slog.Error("revoke session after refresh reuse", "sessionID", sess.ID, "error", err)
+		}
+		return "", "", err
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	newSecret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := db.Exec(
+		`UPDATE sessions SET refresh_hash=$1, previous_hash=refresh_hash, expires_at=$2
+		WHERE id=$3 AND refresh_hash=$4 AND revoked_at IS NULL`,
+		hashToken(newSecret),
+		time.Now().UTC().Add(cfg.RefreshTokenTTL),
+		sess.ID,
+		sess.RefreshHash,
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		// Параллельный refresh уже забрал этот токен
+		return "", "", errRefreshReused
+	}
+
+	access, err := generateJWT(sess.UserID, sess.ID)
+	if err != nil {
+		return "", "", err
+	}
+	return access, sess.ID + "." + newSecret, nil
+}
+
+// revokeSession — revoke session in DB and in the in-memory revocation list
+func revokeSession(sessionID string) error {
+	_, err := db.Exec(
+		"UPDATE sessions SET revoked_at=$1 WHERE id=$2 AND revoked_at IS NULL",
+		time.Now().UTC(),
+		sessionID,
+	)
+	if err != nil {
+		return err
+	}
+	sessions.Revoke(sessionID)
+	slog.Info("Session revoked", "sessionID", sessionID)
+	return nil
+}
+
+// revokeUserSessions — revoke all user sessions except the given one
+func revokeUserSessions(userID int, exceptSessionID string) error {
+	var sessionIDs []string
+	if err := db.Select(
+		&sessionIDs,
+		"SELECT id FROM sessions WHERE user_id=$1 AND id<>$2 AND revoked_at IS NULL",
+		userID,
+		exceptSessionID,
+	); err != nil {
+		return err
+	}
+	for _, sessionID := range sessionIDs {
+		if err := revokeSession(sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAuthCookies — set access and refresh token cookies
+func setAuthCookies(w http.ResponseWriter, access, refresh string) {
+	http.SetCookie(
+		w, &http.Cookie{
+			Name:     accessCookieName,
+			Value:    access,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   false, // Только HTTPS (отключите для localhost)
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   int(cfg.AccessTokenTTL.Seconds()),
+		},
+	)
+	http.SetCookie(
+		w, &http.Cookie{
+			Name:     refreshCookieName,
+			Value:    refresh,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   false, // Только HTTPS (отключите для localhost)
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   int(cfg.RefreshTokenTTL.Seconds()),
+		},
+	)
+}
+
+// clearAuthCookies — remove access and refresh token cookies
+func clearAuthCookies(w http.ResponseWriter) {
+	for _, name := range []string{accessCookieName, refreshCookieName} {
+		http.SetCookie(
+			w, &http.Cookie{
+				Name:     name,
+				Value:    "",
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+				MaxAge:   -1,
+			},
+		)
+	}
+}
+
+// startSession — create session for user and set auth cookies
+func startSession(w http.ResponseWriter, userID int) error {
+	access, refresh, err := createSession(userID)
+	if err != nil {
+		return err
+	}
+	setAuthCookies(w, access, refresh)
+	return nil
+}
+
+// refreshTokens — rotate refresh token via REST
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(refreshCookieName)
+	if err != nil || cookie.Value == "" {
+		http.Error(w, "Refresh token not found", http.StatusUnauthorized)
+		return
+	}
+
+	access, refresh, err := rotateSession(cookie.Value)
+	switch {
+	case err == nil:
+	case errors.Is(err, errSessionNotFound),
+		errors.Is(err, errSessionRevoked),
+		errors.Is(err, errSessionExpired),
+		errors.Is(err, errRefreshReused),
+		errors.Is(err, errRefreshInvalid):
+		slog.Warn("Refresh rejected", "error", err)
+		clearAuthCookies(w)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	default:
+		slog.Error("rotate session", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	setAuthCookies(w, access, refresh)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logoutUser — revoke current session via REST
+func logoutUser(w http.ResponseWriter, r *http.Request) {
+	var sessionID string
+	if cookie, err := r.Cookie(accessCookieName); err == nil {
+		_, sessionID, _ = validateJWT(cookie.Value)
+	}
+	if sessionID == "" {
+		// Access-токен мог уже истечь — тогда выходим по refresh-токену
+		if cookie, err := r.Cookie(refreshCookieName); err == nil {
+			if sess, err := lookupRefreshSession(cookie.Value); err == nil {
+				sessionID = sess.ID
+			}
+		}
+	}
+
+	if sessionID != "" {
+		if err := revokeSession(sessionID); err != nil {
+			slog.Error("revoke session", "sessionID", sessionID, "error", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	clearAuthCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
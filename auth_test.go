@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSession — user with a fresh session in the test database, returns its refresh token
+func testSession(t *testing.T) string {
+	t.Helper()
+	openTestDB(t)
+	prev := cfg
+	cfg.AccessTokenTTL = time.Minute
+	cfg.RefreshTokenTTL = time.Hour
+	t.Cleanup(func() { cfg = prev })
+	if _, err := db.Exec("INSERT INTO users (username, password) VALUES ($1, $2)", "alice", "hash"); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	_, refresh, err := createSession(1)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	return refresh
+}
+
+func TestRotateSession(t *testing.T) {
+	refresh := testSession(t)
+	sessionID, _, _ := strings.Cut(refresh, ".")
+
+	_, rotated, err := rotateSession(refresh)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if rotated == refresh || !strings.HasPrefix(rotated, sessionID+".") {
+		t.Fatalf("rotated token %q should keep session %q with a new secret", rotated, sessionID)
+	}
+
+	// Чужой секрет при известном ID не должен ни пройти, ни отозвать сессию
+	if _, _, err := rotateSession(sessionID + ".forged"); !errors.Is(err, errRefreshInvalid) {
+		t.Fatalf("forged secret: err = %v, want %v", err, errRefreshInvalid)
+	}
+	if _, err := lookupRefreshSession(rotated); err != nil {
+		t.Fatalf("session after forged refresh: %v", err)
+	}
+
+	// Повтор уже обменянного токена — кража: отзываем сессию
+	if _, _, err := rotateSession(refresh); !errors.Is(err, errRefreshReused) {
+		t.Fatalf("reused token: err = %v, want %v", err, errRefreshReused)
+	}
+	if _, err := lookupRefreshSession(rotated); !errors.Is(err, errSessionRevoked) {
+		t.Fatalf("session after reuse: err = %v, want %v", err, errSessionRevoked)
+	}
+}
+
+func TestSplitRefreshToken(t *testing.T) {
+	tests := []struct {
+		token  string
+		id     string
+		secret string
+		ok     bool
+	}{
+		{"sid.secret", "sid", "secret", true},
+		{"sid.sec.ret", "sid", "sec.ret", true},
+		{"sid.", "", "", false},
+		{".secret", "", "", false},
+		{"nodot", "", "", false},
+	}
+	for _, tt := range tests {
+		id, secret, ok := splitRefreshToken(tt.token)
+		if id != tt.id || secret != tt.secret || ok != tt.ok {
+			t.Errorf("splitRefreshToken(%q) = %q, %q, %v", tt.token, id, secret, ok)
+		}
+	}
+}
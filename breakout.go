@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	MsgTypeBreakoutStart  = "breakout_start"
+	MsgTypeBreakoutAssign = "breakout_assign"
+	MsgTypeBreakoutEnd    = "breakout_end"
+	MsgTypeBreakouts      = "breakouts"
+	MsgTypeBreakoutMoved  = "breakout_moved"
+	MsgTypeBreakoutTimer  = "breakout_timer"
+	MsgTypeBreakoutEnded  = "breakout_ended"
+
+	maxBreakouts        = 20
+	maxBreakoutDuration = 24 * time.Hour
+	// breakoutWarning — за сколько до конца напомнить, что скоро всех вернут
+	breakoutWarning = time.Minute
+)
+
+// Коды ошибок breakout-комнат
+const (
+	BreakoutErrActive     = "breakout_active"
+	BreakoutErrNotActive  = "breakout_not_active"
+	BreakoutErrInvalid    = "invalid_breakout"
+	BreakoutErrInBreakout = "in_breakout"
+)
+
+// breakoutSession — child rooms of a parent room, guarded by the parent Mu
+type breakoutSession struct {
+	Rooms  []*Room
+	EndsAt time.Time // нулевое — без таймера
+	timers []*time.Timer
+}
+
+// BreakoutDTO — breakout room and its participants
+type BreakoutDTO struct {
+	RoomID       string           `json:"roomId"`
+	Participants []ParticipantDTO `json:"participants"`
+}
+
+// root — parent room for a breakout room, the room itself otherwise
+func (r *Room) root() *Room {
+	if r.Parent != nil {
+		return r.Parent
+	}
+	return r
+}
+
+// breakout — current breakout session of the room, nil if none
+func (r *Room) breakout() *breakoutSession {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.Breakout
+}
+
+// family — the room followed by its breakout rooms
+func (r *Room) family() []*Room {
+	rooms := []*Room{r}
+	if session := r.breakout(); session != nil {
+		rooms = append(rooms, session.Rooms...)
+	}
+	return rooms
+}
+
+// familyClientsOfUser — user connections in the room and its breakouts
+func (r *Room) familyClientsOfUser(userID int) []*Client {
+	var clients []*Client
+	for _, room := range r.family() {
+		clients = append(clients, room.clientsOfUser(userID)...)
+	}
+	return clients
+}
+
+// headcount — participants of the room including those sent to breakouts, caller holds Mu
+func (r *Room) headcount() int {
+	count := len(r.Clients)
+	if r.Breakout == nil {
+		return count
+	}
+	for _, child := range r.Breakout.Rooms {
+		child.Mu.Lock()
+		count += len(child.Clients)
+		child.Mu.Unlock()
+	}
+	return count
+}
+
+// moveClient — move a connected client between rooms keeping its PeerConnection
+func (s *Server) moveClient(client *Client, from, to *Room) {
+	s.exitRoom(client, from)
+	client.resetTalking()
+	to.AddClient(client)
+	s.enterRoom(client, to)
+	if err := client.Send(
+		WebSocketMessageDTO{Type: MsgTypeBreakoutMoved, RoomID: to.ID, Participants: to.Participants()},
+	); err != nil {
+		slog.Error("notify moved client", "clientID", client.ID, "error", err)
+	}
+}
+
+// broadcastBreakouts — send breakout layout to everyone in the parent and its breakouts
+func (s *Server) broadcastBreakouts(parent *Room) {
+	session := parent.breakout()
+	if session == nil {
+		return
+	}
+	msg := WebSocketMessageDTO{
+		Type:      MsgTypeBreakouts,
+		RoomID:    parent.ID,
+		Breakouts: make([]BreakoutDTO, 0, len(session.Rooms)),
+	}
+	for _, child := range session.Rooms {
+		msg.Breakouts = append(msg.Breakouts, BreakoutDTO{RoomID: child.ID, Participants: child.Participants()})
+	}
+	if !session.EndsAt.IsZero() {
+		msg.EndsAt = ptr(session.EndsAt)
+	}
+	for _, room := range parent.family() {
+		room.Broadcast(msg, "")
+	}
+}
+
+// broadcastBreakoutTimer — tell everyone how much breakout time is left
+func (s *Server) broadcastBreakoutTimer(parent *Room, session *breakoutSession) {
+	remaining := time.Until(session.EndsAt).Round(time.Second)
+	msg := WebSocketMessageDTO{
+		Type:            MsgTypeBreakoutTimer,
+		RoomID:          parent.ID,
+		DurationSeconds: int(remaining.Seconds()),
+		EndsAt:          ptr(session.EndsAt),
+	}
+	for _, room := range parent.family() {
+		room.Broadcast(msg, "")
+	}
+}
+
+// scheduleBreakoutEnd — warn before the deadline and recall everyone when it passes
+func (s *Server) scheduleBreakoutEnd(parent *Room, session *breakoutSession, duration time.Duration) {
+	// Таймеры сверяют сессию: после breakout_end и нового старта старый таймер ничего не делает
+	active := func() bool { return parent.breakout() == session }
+	if duration > breakoutWarning {
+		session.timers = append(
+			session.timers, time.AfterFunc(
+				duration-breakoutWarning, func() {
+					if active() {
+						s.broadcastBreakoutTimer(parent, session)
+					}
+				},
+			),
+		)
+	}
+	session.timers = append(
+		session.timers, time.AfterFunc(
+			duration, func() {
+				if active() {
+					slog.Info("Breakout time is up", "roomID", parent.ID)
+					s.endBreakouts(parent)
+				}
+			},
+		),
+	)
+}
+
+// endBreakouts — bring everyone back to the parent room and drop the breakout rooms
+func (s *Server) endBreakouts(parent *Room) {
+	parent.Mu.Lock()
+	session := parent.Breakout
+	parent.Breakout = nil
+	parent.Mu.Unlock()
+	if session == nil {
+		return
+	}
+	for _, timer := range session.timers {
+		timer.Stop()
+	}
+	for _, child := range session.Rooms {
+		for _, client := range child.GetClients() {
+			s.moveClient(client, child, parent)
+		}
+	}
+	parent.Broadcast(WebSocketMessageDTO{Type: MsgTypeBreakoutEnded, RoomID: parent.ID}, "")
+	slog.Info("Breakouts ended", "roomID", parent.ID)
+}
+
+// findInFamily — client and its room among the parent and its breakouts
+func findInFamily(parent *Room, clientID string) (*Client, *Room, bool) {
+	for _, room := range parent.family() {
+		if client, ok := room.GetClients()[clientID]; ok {
+			return client, room, true
+		}
+	}
+	return nil, nil, false
+}
+
+// validateAssignments — check breakout numbers, 0 keeps the participant in the parent room
+func validateAssignments(parent *Room, assignments map[string]int, count int) *WebSocketMessageDTO {
+	for clientID, number := range assignments {
+		if number < 0 || number > count {
+			return &WebSocketMessageDTO{
+				Type:    MsgTypeError,
+				Code:    BreakoutErrInvalid,
+				Message: fmt.Sprintf("Breakout number must be between 0 and %d", count),
+			}
+		}
+		if _, _, ok := findInFamily(parent, clientID); !ok {
+			return ptr(moderationError(ModErrTargetNotFound, "Participant not found: "+clientID))
+		}
+	}
+	return nil
+}
+
+// applyAssignments — move participants to the numbered breakouts
+func (s *Server) applyAssignments(parent *Room, session *breakoutSession, assignments map[string]int) {
+	for clientID, number := range assignments {
+		client, from, ok := findInFamily(parent, clientID)
+		if !ok {
+			continue
+		}
+		to := parent
+		if number > 0 {
+			to = session.Rooms[number-1]
+		}
+		if from != to {
+			s.moveClient(client, from, to)
+		}
+	}
+}
+
+// handleBreakout — start, rearrange and end breakout rooms
+func (s *Server) handleBreakout(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	parent := client.CurrentRoom().root()
+	rec, _, errMsg := requireModerator(client, parent)
+	if errMsg != nil {
+		return *errMsg
+	}
+
+	switch msg.Type {
+	case MsgTypeBreakoutStart:
+		if client.CurrentRoom() != parent {
+			return WebSocketMessageDTO{
+				Type:    MsgTypeError,
+				Code:    BreakoutErrInBreakout,
+				Message: "Start breakouts from the main room",
+			}
+		}
+		if parent.breakout() != nil {
+			return WebSocketMessageDTO{
+				Type:    MsgTypeError,
+				Code:    BreakoutErrActive,
+				Message: "Breakouts are already running",
+			}
+		}
+		if msg.Count < 1 || msg.Count > maxBreakouts {
+			return WebSocketMessageDTO{
+				Type:    MsgTypeError,
+				Code:    BreakoutErrInvalid,
+				Message: fmt.Sprintf("count must be between 1 and %d", maxBreakouts),
+			}
+		}
+		duration := time.Duration(msg.DurationSeconds) * time.Second
+		if duration < 0 || duration > maxBreakoutDuration {
+			return moderationError(ModErrInvalidDuration, "durationSeconds must be between 0 and 86400")
+		}
+		if errMsg := validateAssignments(parent, msg.Assignments, msg.Count); errMsg != nil {
+			return *errMsg
+		}
+
+		session := &breakoutSession{}
+		for i := 1; i <= msg.Count; i++ {
+			child := NewRoom(fmt.Sprintf("%s:%d", parent.ID, i))
+			child.Parent = parent
+			child.configure(rec)
+			session.Rooms = append(session.Rooms, child)
+		}
+		assignments := make(map[string]int, len(msg.Assignments))
+		for clientID, number := range msg.Assignments {
+			assignments[clientID] = number
+		}
+		if msg.Randomize {
+			// Модераторы остаются в основной комнате, если их не распределили явно
+			var pool []string
+			for id, participant := range parent.GetClients() {
+				_, assigned := assignments[id]
+				if !assigned && roleRank[participant.RoomRole()] < roleRank[RoomRoleModerator] {
+					pool = append(pool, id)
+				}
+			}
+			rand.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+			for i, id := range pool {
+				assignments[id] = i%msg.Count + 1
+			}
+		}
+
+		parent.Mu.Lock()
+		parent.Breakout = session
+		if duration > 0 {
+			session.EndsAt = time.Now().Add(duration).UTC()
+			s.scheduleBreakoutEnd(parent, session, duration)
+		}
+		parent.Mu.Unlock()
+
+		s.applyAssignments(parent, session, assignments)
+		s.broadcastBreakouts(parent)
+		if duration > 0 {
+			s.broadcastBreakoutTimer(parent, session)
+		}
+		slog.Info("Breakouts started", "roomID", parent.ID, "count", msg.Count, "duration", duration)
+
+	case MsgTypeBreakoutAssign:
+		session := parent.breakout()
+		if session == nil {
+			return WebSocketMessageDTO{Type: MsgTypeError, Code: BreakoutErrNotActive, Message: "Breakouts are not running"}
+		}
+		if errMsg := validateAssignments(parent, msg.Assignments, len(session.Rooms)); errMsg != nil {
+			return *errMsg
+		}
+		s.applyAssignments(parent, session, msg.Assignments)
+		s.broadcastBreakouts(parent)
+
+	case MsgTypeBreakoutEnd:
+		if parent.breakout() == nil {
+			return WebSocketMessageDTO{Type: MsgTypeError, Code: BreakoutErrNotActive, Message: "Breakouts are not running"}
+		}
+		s.endBreakouts(parent)
+	}
+
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", RoomID: parent.ID}
+}
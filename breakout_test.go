@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBreakoutStartAndEnd(t *testing.T) {
+	s, room, clients := moderatedRoom(t)
+	moderator := clients[2]
+
+	resp := s.handleBreakout(
+		moderator, WebSocketMessageDTO{
+			Type:        MsgTypeBreakoutStart,
+			Count:       2,
+			Assignments: map[string]int{"speaker": 1, "listener": 2, "owner": 0},
+		},
+	)
+	if resp.Type != MsgTypeBreakoutStart+"_ack" {
+		t.Fatalf("start: %s %q %q", resp.Type, resp.Code, resp.Message)
+	}
+	session := room.breakout()
+	if session == nil || len(session.Rooms) != 2 {
+		t.Fatalf("breakout session %+v", session)
+	}
+	for i, want := range []string{"open:1", "open:2"} {
+		child := session.Rooms[i]
+		if child.ID != want || child.Parent != room || child.root() != room {
+			t.Errorf("breakout %d: %q with parent %v, want %q", i+1, child.ID, child.Parent, want)
+		}
+	}
+	tests := []struct {
+		userID int
+		roomID string
+	}{
+		{1, "open"},
+		{2, "open"},
+		{3, "open:1"},
+		{4, "open:2"},
+	}
+	for _, tt := range tests {
+		if got := clients[tt.userID].CurrentRoom(); got == nil || got.ID != tt.roomID {
+			t.Errorf("user %d in %v, want %q", tt.userID, got, tt.roomID)
+		}
+	}
+	room.Mu.Lock()
+	headcount := room.headcount()
+	room.Mu.Unlock()
+	if headcount != 4 {
+		t.Errorf("headcount %d, want 4", headcount)
+	}
+
+	// Повторный старт и старт из breakout запрещены
+	if resp := s.handleBreakout(moderator, WebSocketMessageDTO{Type: MsgTypeBreakoutStart, Count: 1}); resp.Code != BreakoutErrActive {
+		t.Errorf("second start: %s %q", resp.Type, resp.Code)
+	}
+	if resp := s.handleBreakout(clients[3], WebSocketMessageDTO{Type: MsgTypeBreakoutEnd}); resp.Code != ModErrForbidden {
+		t.Errorf("speaker ends breakouts: %s %q", resp.Type, resp.Code)
+	}
+
+	if resp := s.handleBreakout(moderator, WebSocketMessageDTO{Type: MsgTypeBreakoutEnd}); resp.Type != MsgTypeBreakoutEnd+"_ack" {
+		t.Fatalf("end: %s %q", resp.Type, resp.Code)
+	}
+	if room.breakout() != nil {
+		t.Error("breakout session kept after end")
+	}
+	for userID, client := range clients {
+		if client.CurrentRoom() != room {
+			t.Errorf("user %d not returned to the parent room", userID)
+		}
+	}
+	for _, child := range session.Rooms {
+		if n := len(child.GetClients()); n != 0 {
+			t.Errorf("%d clients left in %s", n, child.ID)
+		}
+	}
+	if n := len(room.GetClients()); n != 4 {
+		t.Errorf("%d clients in the parent room, want 4", n)
+	}
+}
+
+func TestBreakoutValidation(t *testing.T) {
+	s, room, clients := moderatedRoom(t)
+	tests := []struct {
+		name string
+		msg  WebSocketMessageDTO
+		code string
+	}{
+		{"no breakouts", WebSocketMessageDTO{Type: MsgTypeBreakoutStart}, BreakoutErrInvalid},
+		{"too many", WebSocketMessageDTO{Type: MsgTypeBreakoutStart, Count: maxBreakouts + 1}, BreakoutErrInvalid},
+		{
+			"number out of range",
+			WebSocketMessageDTO{Type: MsgTypeBreakoutStart, Count: 2, Assignments: map[string]int{"speaker": 3}},
+			BreakoutErrInvalid,
+		},
+		{
+			"unknown participant",
+			WebSocketMessageDTO{Type: MsgTypeBreakoutStart, Count: 2, Assignments: map[string]int{"nobody": 1}},
+			ModErrTargetNotFound,
+		},
+		{"negative duration", WebSocketMessageDTO{Type: MsgTypeBreakoutStart, Count: 1, DurationSeconds: -1}, ModErrInvalidDuration},
+		{"end without breakouts", WebSocketMessageDTO{Type: MsgTypeBreakoutEnd}, BreakoutErrNotActive},
+		{"assign without breakouts", WebSocketMessageDTO{Type: MsgTypeBreakoutAssign}, BreakoutErrNotActive},
+	}
+	for _, tt := range tests {
+		if resp := s.handleBreakout(clients[2], tt.msg); resp.Type != MsgTypeError || resp.Code != tt.code {
+			t.Errorf("%s: %s %q, want error %q", tt.name, resp.Type, resp.Code, tt.code)
+		}
+	}
+	if room.breakout() != nil {
+		t.Error("invalid start left a breakout session")
+	}
+}
+
+func TestBreakoutRandomizeKeepsModerators(t *testing.T) {
+	s, room, clients := moderatedRoom(t)
+	resp := s.handleBreakout(clients[2], WebSocketMessageDTO{Type: MsgTypeBreakoutStart, Count: 2, Randomize: true})
+	if resp.Type != MsgTypeBreakoutStart+"_ack" {
+		t.Fatalf("start: %s %q", resp.Type, resp.Code)
+	}
+	for userID, client := range clients {
+		inParent := client.CurrentRoom() == room
+		if moderator := userID <= 2; inParent != moderator {
+			t.Errorf("user %d in parent room %v, want %v", userID, inParent, moderator)
+		}
+	}
+}
+
+func TestBreakoutReturnRestoresStageRole(t *testing.T) {
+	s, room, clients := stageRoom(t)
+	// На сцене основной комнаты user 4, user 3 в зале
+	s.moveStage(room, 4, RoomRoleSpeaker)
+
+	resp := s.handleBreakout(
+		clients[2], WebSocketMessageDTO{
+			Type:        MsgTypeBreakoutStart,
+			Count:       1,
+			Assignments: map[string]int{"speaker": 1, "listener": 1},
+		},
+	)
+	if resp.Type != MsgTypeBreakoutStart+"_ack" {
+		t.Fatalf("start: %s %q", resp.Type, resp.Code)
+	}
+	// В breakout своя сцена: выводим на неё user 3
+	s.moveStage(room.breakout().Rooms[0], 3, RoomRoleSpeaker)
+
+	s.endBreakouts(room)
+	for userID, role := range map[int]string{3: RoomRoleListener, 4: RoomRoleSpeaker} {
+		if got := clients[userID].RoomRole(); got != role {
+			t.Errorf("user %d back in the parent room as %q, want %q", userID, got, role)
+		}
+	}
+}
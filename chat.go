@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// chatChannelLabel — data channel, который клиент открывает для чата
+	chatChannelLabel     = "chat"
+	chatMessageMaxLength = 2000
+	chatRate             = 1.0 // сообщений в секунду
+	chatBurst            = 5
+	defaultHistoryLimit  = 50
+	maxHistoryLimit      = 200
+
+	ChatErrInvalid     = "chat_invalid"
+	ChatErrRateLimited = "chat_rate_limited"
+)
+
+var chatLimiter = NewRateLimiter("chat", chatRate, chatBurst)
+
+// ChatMessageDTO — chat message relayed over data channels and returned in history
+type ChatMessageDTO struct {
+	ID          int64     `json:"id,omitempty" db:"id"`
+	RoomID      string    `json:"roomId" db:"room_id"`
+	ClientID    string    `json:"clientId,omitempty" db:"-"`
+	UserID      *int      `json:"userId" db:"user_id"` // nil — автор удалил аккаунт
+	DisplayName string    `json:"displayName" db:"display_name"`
+	Text        string    `json:"text" db:"body"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+// chatChannel — open chat data channel of the client, nil if none
+func (c *Client) chatChannel() *webrtc.DataChannel {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if c.Chat == nil || c.Chat.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	return c.Chat
+}
+
+// acceptDataChannel — take the chat data channel opened by the client
+func (s *Server) acceptDataChannel(client *Client, dc *webrtc.DataChannel) {
+	if dc.Label() != chatChannelLabel {
+		slog.Warn("Unknown data channel", "clientID", client.ID, "label", dc.Label())
+		return
+	}
+	client.Mu.Lock()
+	client.Chat = dc
+	client.Mu.Unlock()
+	dc.OnMessage(
+		func(msg webrtc.DataChannelMessage) {
+			s.handleChat(client, msg.Data)
+		},
+	)
+	slog.Info("Chat channel opened", "clientID", client.ID)
+}
+
+// handleChat — validate, persist and relay a chat message to the room
+func (s *Server) handleChat(client *Client, data []byte) {
+	room := client.CurrentRoom()
+	if room == nil {
+		return
+	}
+	var in struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		client.Send(WebSocketMessageDTO{Type: MsgTypeError, Code: ChatErrInvalid, Message: "Invalid chat message"})
+		return
+	}
+	text := strings.TrimSpace(in.Text)
+	if text == "" || utf8.RuneCountInString(text) > chatMessageMaxLength {
+		client.Send(
+			WebSocketMessageDTO{
+				Type:    MsgTypeError,
+				Code:    ChatErrInvalid,
+				Message: "Chat message must be between 1 and 2000 characters",
+			},
+		)
+		return
+	}
+	if ok, _ := chatLimiter.Allow(strconv.Itoa(client.UserID)); !ok {
+		client.Send(WebSocketMessageDTO{Type: MsgTypeError, Code: ChatErrRateLimited, Message: "Too many messages"})
+		return
+	}
+
+	participant := client.Participant()
+	msg := ChatMessageDTO{
+		RoomID:      room.ID,
+		ClientID:    client.ID,
+		UserID:      &participant.UserID,
+		DisplayName: participant.DisplayName,
+		Text:        text,
+		CreatedAt:   time.Now().UTC(),
+	}
+	// Ad-hoc и breakout-комнат нет в БД — их чат не сохраняем
+	if room.isPersistent() {
+		if err := db.QueryRow(
+			"INSERT INTO messages (room_id, user_id, body, created_at) VALUES ($1, $2, $3, $4) RETURNING id",
+			room.ID,
+			client.UserID,
+			text,
+			msg.CreatedAt,
+		).Scan(&msg.ID); err != nil {
+			slog.Error("save chat message", "roomID", room.ID, "userID", client.UserID, "error", err)
+		}
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("encode chat message", "error", err)
+		return
+	}
+	// Отправителю тоже: так он узнаёт id и время сервера
+	for id, other := range room.GetClients() {
+		dc := other.chatChannel()
+		if dc == nil {
+			continue
+		}
+		if err := dc.SendText(string(payload)); err != nil {
+			slog.Error("relay chat message", "clientID", id, "error", err)
+		}
+	}
+}
+
+// isPersistent — check if the room has a DB record to keep chat history in
+func (r *Room) isPersistent() bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return !r.AdHoc && r.Parent == nil
+}
+
+// canReadHistory — owner, member, anyone in an open public room or currently connected
+func (s *Server) canReadHistory(rec RoomRecord, userID int) (bool, error) {
+	if rec.IsOwner(userID) {
+		return true, nil
+	}
+	if _, banned, err := activeBan(rec.ID, userID); err != nil || banned {
+		return false, err
+	}
+	member, err := isRoomMember(rec.ID, userID)
+	if err != nil || member {
+		return member, err
+	}
+	if rec.Visibility == RoomVisibilityPublic && rec.PasswordHash == "" {
+		return true, nil
+	}
+	// Вошедшие по паролю участниками не становятся, но историю видеть должны
+	if room, ok := s.liveRoom(rec.ID); ok {
+		return len(room.familyClientsOfUser(userID)) > 0, nil
+	}
+	return false, nil
+}
+
+// roomMessages — paged chat history, newest page first, messages inside a page in order
+func (s *Server) roomMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "User ID not found", http.StatusUnauthorized)
+		return
+	}
+	rec, err := loadRoomRecord(r.PathValue("id"))
+	if errors.Is(err, errRoomNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("load room", "roomID", r.PathValue("id"), "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	allowed, err := s.canReadHistory(rec, userID)
+	if err != nil {
+		slog.Error("check history access", "roomID", rec.ID, "userID", userID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Access to room history denied", http.StatusForbidden)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	// before — курсор: id самого старого сообщения с прошлой страницы
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "before must be a message id", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	query := `SELECT m.id, m.room_id, m.user_id, COALESCE(NULLIF(u.display_name, ''), u.username, '') AS display_name,
+		m.body, m.created_at
+		FROM messages m LEFT JOIN users u ON u.id = m.user_id
+		WHERE m.room_id=$1 AND ($2 = 0 OR m.id < $2)
+		ORDER BY m.id DESC LIMIT $3`
+	messages := []ChatMessageDTO{}
+	if err := db.Select(&messages, query, rec.ID, before, limit); err != nil {
+		slog.Error("load chat history", "roomID", rec.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	resp := map[string]interface{}{"messages": messages}
+	if len(messages) == limit {
+		resp["nextBefore"] = messages[0].ID
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyRequest — GET /rooms/{id}/messages as the user
+func historyRequest(s *Server, userID int, roomID, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/rooms/"+roomID+"/messages"+query, nil)
+	r.SetPathValue("id", roomID)
+	r = r.WithContext(context.WithValue(r.Context(), userIdContextKey, userID))
+	w := httptest.NewRecorder()
+	s.roomMessages(w, r)
+	return w
+}
+
+// configuredRoom — live room configured from its persisted record
+func configuredRoom(t *testing.T, s *Server, roomID string) *Room {
+	t.Helper()
+	rec, err := loadRoomRecord(roomID)
+	if err != nil {
+		t.Fatalf("load room: %v", err)
+	}
+	room := s.getOrCreateRoom(roomID)
+	room.configure(rec)
+	return room
+}
+
+func TestHandleChat(t *testing.T) {
+	s := seedRooms(t)
+	prev := chatLimiter
+	chatLimiter = NewRateLimiter("chat_test", chatRate, chatBurst)
+	t.Cleanup(func() { chatLimiter = prev })
+
+	room := configuredRoom(t, s, "open")
+	client, peer := wsClient(t, "guest", room, 3)
+	room.AddClient(client)
+
+	tests := []struct {
+		name string
+		data string
+		code string // пусто — сообщение принято
+	}{
+		{"not JSON", "hello", ChatErrInvalid},
+		{"empty", `{"text": "   "}`, ChatErrInvalid},
+		{"too long", fmt.Sprintf(`{"text": %q}`, strings.Repeat("я", chatMessageMaxLength+1)), ChatErrInvalid},
+		{"longest", fmt.Sprintf(`{"text": %q}`, strings.Repeat("я", chatMessageMaxLength)), ""},
+		{"trimmed", `{"text": "  hello  "}`, ""},
+		{"third", `{"text": "3"}`, ""},
+		{"fourth", `{"text": "4"}`, ""},
+		{"fifth", `{"text": "5"}`, ""},
+		{"over the burst", `{"text": "6"}`, ChatErrRateLimited},
+	}
+	for _, tt := range tests {
+		s.handleChat(client, []byte(tt.data))
+		if tt.code == "" {
+			continue
+		}
+		if msg := readMessage(t, peer); msg.Type != MsgTypeError || msg.Code != tt.code {
+			t.Errorf("%s: %s %q, want error %q", tt.name, msg.Type, msg.Code, tt.code)
+		}
+	}
+
+	var bodies []string
+	if err := db.Select(&bodies, "SELECT body FROM messages WHERE room_id=$1 ORDER BY id", "open"); err != nil {
+		t.Fatalf("load messages: %v", err)
+	}
+	if len(bodies) != 5 || bodies[1] != "hello" {
+		t.Errorf("saved %d messages, second %q", len(bodies), bodies[1])
+	}
+
+	// Чат ad-hoc и breakout-комнат не сохраняется
+	adHoc := s.getOrCreateRoom("adhoc")
+	adHoc.configure(RoomRecord{ID: "adhoc", AdHoc: true})
+	breakout := NewRoom("open:1")
+	breakout.Parent = room
+	for i, other := range []*Room{adHoc, breakout} {
+		sender, _ := wsClient(t, fmt.Sprintf("sender%d", i), other, 4)
+		other.AddClient(sender)
+		s.handleChat(sender, []byte(`{"text": "not kept"}`))
+	}
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM messages"); err != nil {
+		t.Fatalf("count messages: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("%d messages saved, want 5", count)
+	}
+}
+
+func TestRoomMessagesPaging(t *testing.T) {
+	s := seedRooms(t)
+	for i := 1; i <= 7; i++ {
+		if _, err := db.Exec(
+			"INSERT INTO messages (room_id, user_id, body, created_at) VALUES ($1, $2, $3, $4)",
+			"open", 3, fmt.Sprint(i), time.Now().UTC(),
+		); err != nil {
+			t.Fatalf("insert message: %v", err)
+		}
+	}
+	// Сообщения других комнат в историю не попадают
+	if _, err := db.Exec(
+		"INSERT INTO messages (room_id, user_id, body, created_at) VALUES ($1, $2, $3, $4)",
+		"private", 1, "secret", time.Now().UTC(),
+	); err != nil {
+		t.Fatalf("insert message: %v", err)
+	}
+
+	tests := []struct {
+		query      string
+		bodies     string
+		nextBefore int64 // 0 — последняя страница
+	}{
+		{"?limit=3", "5,6,7", 5},
+		{"?limit=3&before=5", "2,3,4", 2},
+		{"?limit=3&before=2", "1", 0},
+		{"", "1,2,3,4,5,6,7", 0},
+		{"?limit=7", "1,2,3,4,5,6,7", 1},
+	}
+	for _, tt := range tests {
+		w := historyRequest(s, 3, "open", tt.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", tt.query, w.Code)
+			continue
+		}
+		var resp struct {
+			Messages   []ChatMessageDTO `json:"messages"`
+			NextBefore int64            `json:"nextBefore"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: decode: %v", tt.query, err)
+		}
+		var bodies []string
+		for _, msg := range resp.Messages {
+			bodies = append(bodies, msg.Text)
+			if msg.DisplayName != "guest" || msg.UserID == nil || *msg.UserID != 3 {
+				t.Errorf("%s: author %v %q", tt.query, msg.UserID, msg.DisplayName)
+			}
+		}
+		if got := strings.Join(bodies, ","); got != tt.bodies || resp.NextBefore != tt.nextBefore {
+			t.Errorf("%s: %s next %d, want %s next %d", tt.query, got, resp.NextBefore, tt.bodies, tt.nextBefore)
+		}
+	}
+
+	for _, tt := range []struct {
+		roomID string
+		query  string
+		status int
+	}{
+		{"open", "?limit=0", http.StatusBadRequest},
+		{"open", "?limit=201", http.StatusBadRequest},
+		{"open", "?limit=x", http.StatusBadRequest},
+		{"open", "?before=0", http.StatusBadRequest},
+		{"missing", "", http.StatusNotFound},
+		{"private", "", http.StatusForbidden},
+	} {
+		if w := historyRequest(s, 3, tt.roomID, tt.query); w.Code != tt.status {
+			t.Errorf("%s%s: status %d, want %d", tt.roomID, tt.query, w.Code, tt.status)
+		}
+	}
+}
+
+func TestCanReadHistory(t *testing.T) {
+	s := seedRooms(t)
+	if _, err := db.Exec(
+		"INSERT INTO room_bans (room_id, user_id, expires_at) VALUES ($1, $2, $3)",
+		"open", 4, time.Now().Add(time.Hour).UTC(),
+	); err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+	// Вошедший по паролю user 4 сидит в breakout запертой комнаты
+	locked := configuredRoom(t, s, "locked")
+	breakout := NewRoom("locked:1")
+	breakout.Parent = locked
+	locked.Breakout = &breakoutSession{Rooms: []*Room{breakout}}
+	client, _ := wsClient(t, "guest", breakout, 4)
+	breakout.AddClient(client)
+
+	tests := []struct {
+		name   string
+		userID int
+		roomID string
+		want   bool
+	}{
+		{"owner of private room", 1, "private", true},
+		{"member of private room", 2, "private", true},
+		{"stranger in private room", 3, "private", false},
+		{"stranger in public room", 3, "open", true},
+		{"banned in public room", 4, "open", false},
+		{"password room not joined", 3, "locked", false},
+		{"password room joined", 4, "locked", true},
+	}
+	for _, tt := range tests {
+		rec, err := loadRoomRecord(tt.roomID)
+		if err != nil {
+			t.Fatalf("load room: %v", err)
+		}
+		got, err := s.canReadHistory(rec, tt.userID)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
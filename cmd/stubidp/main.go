@@ -0,0 +1,47 @@
+// stubidp — минимальный OpenID Connect провайдер для локальной проверки SSO.
+//
+// Поддерживает discovery, JWKS, authorization code + PKCE (S256) и всегда
+// «логинит» одного и того же пользователя без формы входа:
+//
+//	go run ./cmd/stubidp -addr :9000
+//	GROK_OIDC_ISSUER=http://localhost:9000 GROK_OIDC_CLIENT_ID=grok go run .
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"grok_voice/internal/stubidp"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, must match GROK_OIDC_ISSUER")
+	clientID := flag.String("client-id", "grok", "accepted client_id")
+	secret := flag.String("client-secret", "", "accepted client_secret (empty — public client)")
+	subject := flag.String("sub", "stub-user-1", "subject of the logged in user")
+	username := flag.String("username", "stub.user", "preferred_username claim")
+	email := flag.String("email", "stub.user@example.com", "email claim")
+	flag.Parse()
+
+	idp, err := stubidp.New(
+		*issuer, *clientID, *secret, map[string]interface{}{
+			"sub":                *subject,
+			"preferred_username": *username,
+			"email":              *email,
+			"email_verified":     true,
+			"name":               *username,
+		},
+	)
+	if err != nil {
+		slog.Error("generate RSA key", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("Stub IdP started", "addr", *addr, "issuer", *issuer, "clientID", *clientID)
+	if err := http.ListenAndServe(*addr, idp.Handler()); err != nil {
+		slog.Error("Server error", "error", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	AudioProfileVoice = "voice" // моно, DTX и FEC — речь на плохих сетях
+	AudioProfileMusic = "music" // стерео и высокий битрейт — музыка без артефактов
+
+	// mimeTypeRED — RFC 2198: с каждым кадром Opus едут копии прошлых, потерю закрывает следующий пакет
+	mimeTypeRED = "audio/red"
+
+	minAudioBitrate = 6000
+	maxAudioBitrate = 510000
+	// Потолки по умолчанию, если у комнаты свой не задан
+	voiceAudioBitrate = 32000
+	musicAudioBitrate = 128000
+)
+
+// redCodec — RED around Opus at 111, the payload type Chrome uses too
+var redCodec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType: mimeTypeRED, ClockRate: 48000, Channels: 2, SDPFmtpLine: "111/111",
+	},
+	PayloadType: 63,
+}
+
+// videoCodecs — video the SFU can parse for keyframes; RTX is left out, publishers
+// resend on the main SSRC and we answer NACK from our own cache
+var videoCodecs = []webrtc.RTPCodecParameters{
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0",
+		},
+		PayloadType: 98,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+		},
+		PayloadType: 102,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		},
+		PayloadType: 106,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f",
+		},
+		PayloadType: 127,
+	},
+}
+
+// opusFmtp — Opus parameters we ask publishers for, by room audio profile and bitrate cap (0 — profile default)
+func opusFmtp(profile string, bitrate int) string {
+	if profile == AudioProfileMusic {
+		if bitrate == 0 {
+			bitrate = musicAudioBitrate
+		}
+		// DTX режет тихие ноты, FEC отнимает битрейт у основного потока
+		return fmt.Sprintf("minptime=10;stereo=1;sprop-stereo=1;useinbandfec=0;usedtx=0;maxaveragebitrate=%d", bitrate)
+	}
+	if bitrate == 0 {
+		bitrate = voiceAudioBitrate
+	}
+	return fmt.Sprintf("minptime=10;useinbandfec=1;usedtx=1;maxaveragebitrate=%d", bitrate)
+}
+
+// opusFmtp — Opus parameters for connections to the room
+func (r *Room) opusFmtp() string {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return opusFmtp(r.AudioProfile, r.MaxAudioBitrate)
+}
+
+// registerCodecs — only Opus and RED over it for audio, videoCodecs for video
+func registerCodecs(m *webrtc.MediaEngine) error {
+	// Параметры Opus комнаты пишем в SDP сами (withAudioParams); здесь — те, что шлют браузеры:
+	// иначе pion сочтёт Opus совпавшим лишь частично и оставит в ответе один RED
+	opus := webrtc.RTPCodecParameters{RTPCodecCapability: opusCodec, PayloadType: 111}
+	for _, codec := range []webrtc.RTPCodecParameters{opus, redCodec} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}}
+	for _, codec := range videoCodecs {
+		codec.RTCPFeedback = feedback
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withAudioParams — put our Opus parameters into a description sent to the client and put RED
+// first: pion copies the fmtp of the remote side and refuses an edited local SDP, while the browser
+// encodes by what we declare and sends the first codec of the list
+func withAudioParams(desc webrtc.SessionDescription, fmtp string) webrtc.SessionDescription {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		slog.Error("parse local description", "error", err)
+		return desc
+	}
+	for _, m := range parsed.MediaDescriptions {
+		if m.MediaName.Media != "audio" {
+			continue
+		}
+		for _, pt := range payloadTypes(m, "opus") {
+			if fmtp != "" {
+				setFmtp(m, pt, fmtp)
+			}
+		}
+		if red := payloadTypes(m, "red"); len(red) > 0 {
+			formats := slices.DeleteFunc(slices.Clone(m.MediaName.Formats), func(f string) bool { return f == red[0] })
+			m.MediaName.Formats = append([]string{red[0]}, formats...)
+		}
+	}
+	raw, err := parsed.Marshal()
+	if err != nil {
+		slog.Error("marshal local description", "error", err)
+		return desc
+	}
+	desc.SDP = string(raw)
+	return desc
+}
+
+// payloadTypes — payload types of the codec in the media section, by rtpmap
+func payloadTypes(m *sdp.MediaDescription, codec string) []string {
+	var pts []string
+	for _, attr := range m.Attributes {
+		// a=rtpmap:111 opus/48000/2
+		pt, encoding, ok := strings.Cut(attr.Value, " ")
+		if attr.Key == "rtpmap" && ok && strings.HasPrefix(strings.ToLower(encoding), codec+"/") {
+			pts = append(pts, pt)
+		}
+	}
+	return pts
+}
+
+// fmtpOf — fmtp parameters of the payload type, "" if there are none
+func fmtpOf(m *sdp.MediaDescription, pt string) string {
+	for _, attr := range m.Attributes {
+		if value, ok := strings.CutPrefix(attr.Value, pt+" "); attr.Key == "fmtp" && ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// setFmtp — replace or add the fmtp attribute of the payload type
+func setFmtp(m *sdp.MediaDescription, pt, fmtp string) {
+	value := pt + " " + fmtp
+	for i, attr := range m.Attributes {
+		if attr.Key == "fmtp" && strings.HasPrefix(attr.Value, pt+" ") {
+			m.Attributes[i].Value = value
+			return
+		}
+	}
+	m.WithValueAttribute("fmtp", value)
+}
+
+// redFmtp — RED parameters the client can receive, from its description; "" if it can't
+func (c *Client) redFmtp() string {
+	pc := c.peer()
+	if pc == nil || pc.RemoteDescription() == nil {
+		return ""
+	}
+	parsed, err := pc.RemoteDescription().Unmarshal()
+	if err != nil {
+		return ""
+	}
+	for _, m := range parsed.MediaDescriptions {
+		if m.MediaName.Media != "audio" {
+			continue
+		}
+		if red := payloadTypes(m, "red"); len(red) > 0 {
+			return fmtpOf(m, red[0])
+		}
+	}
+	return ""
+}
+
+// sameREDBlocks — check if RED of the publisher and of the subscriber wrap Opus of the same payload type
+func sameREDBlocks(publisher, subscriber string) bool {
+	// Номер Opus записан в заголовках блоков, а переписывать их на лету мы не станем
+	pub, _, _ := strings.Cut(publisher, "/")
+	sub, _, _ := strings.Cut(subscriber, "/")
+	return pub != "" && pub == sub
+}
+
+// isOpus — check if the codec is Opus, plain or wrapped in RED
+func isOpus(mimeType string) bool {
+	return mimeType == webrtc.MimeTypeOpus || mimeType == mimeTypeRED
+}
+
+// redPrimary — primary Opus frame of a RED payload: it comes after the headers and the redundant blocks
+func redPrimary(payload []byte) ([]byte, bool) {
+	redundant := 0
+	for {
+		if len(payload) == 0 {
+			return nil, false
+		}
+		// Последний заголовок — 1 байт с F=0, остальные — 4 байта с длиной блока в младших 10 битах
+		if payload[0]&0x80 == 0 {
+			payload = payload[1:]
+			break
+		}
+		if len(payload) < 4 {
+			return nil, false
+		}
+		redundant += int(payload[2]&0x03)<<8 | int(payload[3])
+		payload = payload[4:]
+	}
+	if redundant > len(payload) {
+		return nil, false
+	}
+	return payload[redundant:], true
+}
+
+// validateAudioProfile — check room audio profile
+func validateAudioProfile(profile string) []FieldError {
+	if profile != AudioProfileVoice && profile != AudioProfileMusic {
+		return []FieldError{
+			{Field: "audioProfile", Code: "invalid", Message: "audioProfile must be 'voice' or 'music'"},
+		}
+	}
+	return nil
+}
+
+// validateMaxAudioBitrate — check Opus bitrate cap, 0 means profile default
+func validateMaxAudioBitrate(bitrate int) []FieldError {
+	if bitrate != 0 && (bitrate < minAudioBitrate || bitrate > maxAudioBitrate) {
+		return []FieldError{
+			{
+				Field:   "maxAudioBitrate",
+				Code:    "out_of_range",
+				Message: fmt.Sprintf("maxAudioBitrate must be 0 or between %d and %d", minAudioBitrate, maxAudioBitrate),
+			},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// chromeOffer — offer of Chrome publishing a microphone with RED and a VP8/H264 camera in simulcast
+const chromeOffer = `v=0
+o=- 4611731400430051336 %VERSION% IN IP4 127.0.0.1
+s=-
+t=0 0
+a=group:BUNDLE 0 1
+a=extmap-allow-mixed
+a=msid-semantic: WMS stream
+m=audio 9 UDP/TLS/RTP/SAVPF 63 111 9 0 8 13 110 126
+c=IN IP4 0.0.0.0
+a=rtcp:9 IN IP4 0.0.0.0
+a=ice-ufrag:Jx4v
+a=ice-pwd:Fv3Lq2d8AbN0mYtP7sWc9ZkR
+a=ice-options:trickle
+a=fingerprint:sha-256 6E:B0:78:1A:F3:24:97:93:95:7F:68:F3:CF:0D:A2:7E:C3:EA:AF:B5:0E:E8:D3:F9:D2:9F:EC:0E:FE:63:78:71
+a=setup:actpass
+a=mid:0
+a=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level
+a=extmap:2 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time
+a=extmap:3 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01
+a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid
+a=sendrecv
+a=msid:stream mic
+a=rtcp-mux
+a=rtpmap:63 red/48000/2
+a=fmtp:63 111/111
+a=rtpmap:111 opus/48000/2
+a=rtcp-fb:111 transport-cc
+a=fmtp:111 minptime=10;useinbandfec=1
+a=rtpmap:9 G722/8000
+a=rtpmap:0 PCMU/8000
+a=rtpmap:8 PCMA/8000
+a=rtpmap:13 CN/8000
+a=rtpmap:110 telephone-event/48000
+a=rtpmap:126 telephone-event/8000
+a=ssrc:1001 cname:Wq5kZ3pL
+a=ssrc:1001 msid:stream mic
+m=video 9 UDP/TLS/RTP/SAVPF 96 97 102 103
+c=IN IP4 0.0.0.0
+a=rtcp:9 IN IP4 0.0.0.0
+a=ice-ufrag:Jx4v
+a=ice-pwd:Fv3Lq2d8AbN0mYtP7sWc9ZkR
+a=ice-options:trickle
+a=fingerprint:sha-256 6E:B0:78:1A:F3:24:97:93:95:7F:68:F3:CF:0D:A2:7E:C3:EA:AF:B5:0E:E8:D3:F9:D2:9F:EC:0E:FE:63:78:71
+a=setup:actpass
+a=mid:1
+a=extmap:2 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time
+a=extmap:3 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01
+a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid
+a=extmap:10 urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id
+a=extmap:11 urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id
+a=sendrecv
+a=msid:stream camera
+a=rtcp-mux
+a=rtcp-rsize
+a=rtpmap:96 VP8/90000
+a=rtcp-fb:96 goog-remb
+a=rtcp-fb:96 transport-cc
+a=rtcp-fb:96 ccm fir
+a=rtcp-fb:96 nack
+a=rtcp-fb:96 nack pli
+a=rtpmap:97 rtx/90000
+a=fmtp:97 apt=96
+a=rtpmap:102 H264/90000
+a=rtcp-fb:102 goog-remb
+a=rtcp-fb:102 transport-cc
+a=rtcp-fb:102 ccm fir
+a=rtcp-fb:102 nack
+a=rtcp-fb:102 nack pli
+a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f
+a=rtpmap:103 rtx/90000
+a=fmtp:103 apt=102
+a=rid:q send
+a=rid:h send
+a=rid:f send
+a=simulcast:send q;h;f
+`
+
+// chromeOfferVersion — the offer with the session version Chrome bumps on every renegotiation
+func chromeOfferVersion(version string) webrtc.SessionDescription {
+	raw := strings.ReplaceAll(strings.ReplaceAll(chromeOffer, "%VERSION%", version), "\n", "\r\n")
+	return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: raw}
+}
+
+// section — media section of the kind in the description
+func section(t *testing.T, desc webrtc.SessionDescription, kind string) *sdp.MediaDescription {
+	t.Helper()
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		t.Fatalf("parse description: %v", err)
+	}
+	for _, m := range parsed.MediaDescriptions {
+		if m.MediaName.Media == kind {
+			return m
+		}
+	}
+	t.Fatalf("no %s section in:\n%s", kind, desc.SDP)
+	return nil
+}
+
+// checkAudio — Opus with the room parameters and RED over it, RED first
+func checkAudio(t *testing.T, step string, desc webrtc.SessionDescription, fmtp string) {
+	t.Helper()
+	audio := section(t, desc, "audio")
+	opus, red := payloadTypes(audio, "opus"), payloadTypes(audio, "red")
+	if !slices.Equal(opus, []string{"111"}) || !slices.Equal(red, []string{"63"}) {
+		t.Fatalf("%s: audio payload types opus %v, red %v; want [111], [63]", step, opus, red)
+	}
+	if got := audio.MediaName.Formats; len(got) < 2 || got[0] != "63" || !slices.Contains(got, "111") {
+		t.Errorf("%s: audio formats %v, want RED first and Opus present", step, got)
+	}
+	if got := fmtpOf(audio, "111"); got != fmtp {
+		t.Errorf("%s: Opus fmtp %q, want %q", step, got, fmtp)
+	}
+	if got := fmtpOf(audio, "63"); got != "111/111" {
+		t.Errorf("%s: RED fmtp %q, want 111/111", step, got)
+	}
+}
+
+func TestChromeOfferRoundTrip(t *testing.T) {
+	api, err := newWebRTCAPI(nil)
+	if err != nil {
+		t.Fatalf("create API: %v", err)
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("create PeerConnection: %v", err)
+	}
+	defer pc.Close()
+	fmtp := opusFmtp(AudioProfileVoice, 0)
+
+	answer, err := handleOffer(pc, chromeOfferVersion("2"), fmtp)
+	if err != nil {
+		t.Fatalf("first offer: %v", err)
+	}
+	checkAudio(t, "answer", answer, fmtp)
+	video := section(t, answer, "video")
+	if vp8, h264 := payloadTypes(video, "vp8"), payloadTypes(video, "h264"); !slices.Equal(vp8, []string{"96"}) ||
+		!slices.Equal(h264, []string{"102"}) {
+		t.Errorf("answer: video payload types vp8 %v, h264 %v; want [96], [102]", vp8, h264)
+	}
+	if _, ok := video.Attribute("simulcast"); !ok {
+		t.Error("answer: simulcast is not accepted")
+	}
+	// pion держит у себя свой answer без правок, иначе следующий SetLocalDescription упадёт
+	if local := pc.LocalDescription(); local == nil || fmtpOf(section(t, *local, "audio"), "111") == fmtp {
+		t.Error("edited answer became the local description")
+	}
+
+	// Chrome пересогласует, например после смены устройства: тот же состав, новая версия
+	answer, err = handleOffer(pc, chromeOfferVersion("3"), fmtp)
+	if err != nil {
+		t.Fatalf("renegotiation offer: %v", err)
+	}
+	checkAudio(t, "renegotiation answer", answer, fmtp)
+
+	// И сервер сам предлагает новый offer, когда добавляет дорожки подписчику
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("server offer: %v", err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("set server offer: %v", err)
+	}
+	checkAudio(t, "server offer", withAudioParams(offer, fmtp), fmtp)
+}
+
+func TestRedPrimary(t *testing.T) {
+	long := make([]byte, 258)
+	tests := []struct {
+		name    string
+		payload []byte
+		primary string
+		ok      bool
+	}{
+		{"primary only", []byte{0x6f, 'p', 'p'}, "pp", true},
+		{"one redundant block", []byte{0xef, 0x03, 0xc0, 0x02, 0x6f, 'r', 'r', 'p', 'p'}, "pp", true},
+		{"two redundant blocks", []byte{0xef, 0x07, 0x80, 0x01, 0xef, 0x03, 0xc0, 0x02, 0x6f, 'a', 'b', 'b', 'p'}, "p", true},
+		{"block length over 8 bits", append(append([]byte{0xef, 0x03, 0xc1, 0x02, 0x6f}, long...), 'p'), "p", true},
+		// Основного кадра может не быть — например, DTX
+		{"empty primary", []byte{0xef, 0x03, 0xc0, 0x01, 0x6f, 'r'}, "", true},
+		{"empty", nil, "", false},
+		{"truncated block header", []byte{0xef, 0x03}, "", false},
+		{"no primary header", []byte{0xef, 0x03, 0xc0, 0x00}, "", false},
+		{"block longer than payload", []byte{0xef, 0x03, 0xc0, 0x05, 0x6f, 'r'}, "", false},
+	}
+	for _, tt := range tests {
+		primary, ok := redPrimary(tt.payload)
+		if ok != tt.ok || string(primary) != tt.primary {
+			t.Errorf("%s: redPrimary = %q, %v; want %q, %v", tt.name, primary, ok, tt.primary, tt.ok)
+		}
+	}
+}
+
+func TestSameREDBlocks(t *testing.T) {
+	tests := []struct {
+		publisher  string
+		subscriber string
+		want       bool
+	}{
+		{"111/111", "111/111", true},
+		{"111/111/111", "111/111", true},
+		{"111", "111/111", true},
+		{"111/111", "109/109", false},
+		{"", "111/111", false},
+		{"111/111", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := sameREDBlocks(tt.publisher, tt.subscriber); got != tt.want {
+			t.Errorf("sameREDBlocks(%q, %q) = %v, want %v", tt.publisher, tt.subscriber, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// packetCacheSize — сколько последних пакетов видео держим для повторной отправки по NACK
+	packetCacheSize = 1024
+	// receiverReportInterval — как часто шлём издателю receiver report
+	receiverReportInterval = time.Second
+)
+
+// packetCache — ring buffer of recent packets of a layer by sequence number
+type packetCache struct {
+	packets [packetCacheSize]*rtp.Packet
+}
+
+// push — remember a packet, overwriting the one packetCacheSize numbers back
+func (c *packetCache) push(pkt *rtp.Packet) {
+	c.packets[pkt.SequenceNumber%packetCacheSize] = pkt
+}
+
+// get — cached packet with the sequence number, nil if already overwritten
+func (c *packetCache) get(seq uint16) *rtp.Packet {
+	pkt := c.packets[seq%packetCacheSize]
+	if pkt == nil || pkt.SequenceNumber != seq {
+		return nil
+	}
+	return pkt
+}
+
+// receptionStats — what the SFU receives from the publisher, RFC 3550 appendix A
+type receptionStats struct {
+	started       bool
+	baseSeq       uint32
+	maxSeq        uint16
+	cycles        uint32
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	transit       float64
+	jitter        float64
+	lastSR        uint32 // средние 32 бита NTP последнего sender report
+	lastSRAt      time.Time
+	last          rtcp.ReceptionReport // последний отчёт до поправки на подписчиков
+}
+
+// update — account an arrived packet
+func (s *receptionStats) update(pkt *rtp.Packet, clockRate uint32, arrival time.Time) {
+	if !s.started {
+		s.started = true
+		s.baseSeq = uint32(pkt.SequenceNumber)
+		s.maxSeq = pkt.SequenceNumber
+	} else if delta := pkt.SequenceNumber - s.maxSeq; delta > 0 && delta < 1<<15 {
+		if pkt.SequenceNumber < s.maxSeq {
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = pkt.SequenceNumber
+	}
+	s.received++
+
+	// Джиттер — сглаженное расхождение интервалов прихода и RTP-времени
+	transit := float64(arrival.UnixNano())*float64(clockRate)/1e9 - float64(pkt.Timestamp)
+	if s.received > 1 {
+		s.jitter += (math.Abs(transit-s.transit) - s.jitter) / 16
+	}
+	s.transit = transit
+}
+
+// report — reception report for the interval since the previous one
+func (s *receptionStats) report(ssrc uint32) rtcp.ReceptionReport {
+	extended := s.cycles + uint32(s.maxSeq)
+	expected := extended - s.baseSeq + 1
+	lost := int64(expected) - int64(s.received)
+	lost = max(min(lost, 1<<23-1), 0)
+
+	expectedInterval := expected - s.expectedPrior
+	receivedInterval := s.received - s.receivedPrior
+	s.expectedPrior = expected
+	s.receivedPrior = s.received
+	var fraction uint8
+	if expectedInterval > 0 && receivedInterval < expectedInterval {
+		fraction = uint8((expectedInterval - receivedInterval) << 8 / expectedInterval)
+	}
+
+	rr := rtcp.ReceptionReport{
+		SSRC:               ssrc,
+		FractionLost:       fraction,
+		TotalLost:          uint32(lost),
+		LastSequenceNumber: extended,
+		Jitter:             uint32(s.jitter),
+		LastSenderReport:   s.lastSR,
+	}
+	if !s.lastSRAt.IsZero() {
+		// DLSR в единицах 1/65536 секунды
+		rr.Delay = uint32(time.Since(s.lastSRAt).Seconds() * 65536)
+	}
+	s.last = rr
+	return rr
+}
+
+// retransmit — resend packets the subscriber reported lost, if still in the cache
+func (s *Subscription) retransmit(p *Publication, nack *rtcp.TransportLayerNack) {
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			s.mu.Lock()
+			original, ok := s.rewriter.original(seq)
+			var pkt *rtp.Packet
+			if ok {
+				pkt = p.cached(s.rewriter.source, original)
+			}
+			if pkt == nil {
+				s.mu.Unlock()
+				continue
+			}
+			out := s.rewriter.outgoing(pkt)
+			err := s.Local.WriteRTP(&out)
+			s.mu.Unlock()
+			if err != nil {
+				slog.Error("retransmit RTP", "to", s.Subscriber.ID, "seq", seq, "error", err)
+				return
+			}
+		}
+	}
+}
+
+// setReport — remember the last reception report of the subscriber about its copy
+func (s *Subscription) setReport(rr *rtcp.ReceiverReport) {
+	if report, ok := matchReport(rr, senderSSRC(s.Sender), time.Now()); ok {
+		s.mu.Lock()
+		s.report = report
+		s.mu.Unlock()
+	}
+}
+
+// cached — packet of the layer from the NACK cache
+func (p *Publication) cached(rid string, seq uint16) *rtp.Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, layer := range p.layers {
+		if layer.RID == rid && layer.cache != nil {
+			return layer.cache.get(seq)
+		}
+	}
+	return nil
+}
+
+// readSenderReports — track publisher sender reports of the layer for LSR/DLSR in our receiver reports
+func (p *Publication) readSenderReports(layer *simulcastLayer, receiver *webrtc.RTPReceiver) {
+	for {
+		var pkts []rtcp.Packet
+		var err error
+		if layer.RID == "" {
+			pkts, _, err = receiver.ReadRTCP()
+		} else {
+			pkts, _, err = receiver.ReadSimulcastRTCP(layer.RID)
+		}
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			if sr, ok := pkt.(*rtcp.SenderReport); ok && sr.SSRC == uint32(layer.Track.SSRC()) {
+				p.mu.Lock()
+				layer.stats.lastSR = uint32(sr.NTPTime >> 16)
+				layer.stats.lastSRAt = time.Now()
+				p.mu.Unlock()
+			}
+		}
+	}
+}
+
+// sendReceiverReports — report reception to the publisher until the publication ends
+func (p *Publication) sendReceiverReports() {
+	ticker := time.NewTicker(receiverReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		pc := p.Publisher.peer()
+		if pc == nil {
+			continue
+		}
+		if err := pc.WriteRTCP([]rtcp.Packet{p.receiverReport()}); err != nil {
+			slog.Debug("send receiver report", "clientID", p.Publisher.ID, "trackID", p.ID, "error", err)
+		}
+	}
+}
+
+// receiverReport — reception of every layer, worsened by what its subscribers report
+func (p *Publication) receiverReport() *rtcp.ReceiverReport {
+	// Издатель должен знать и о потерях после SFU: берём худшего подписчика слоя
+	worst := make(map[string]rtcp.ReceptionReport)
+	for _, sub := range p.subscriptions() {
+		sub.mu.Lock()
+		if sub.rewriter.started {
+			w := worst[sub.rewriter.source]
+			w.FractionLost = max(w.FractionLost, sub.report.FractionLost)
+			w.Jitter = max(w.Jitter, sub.report.Jitter)
+			worst[sub.rewriter.source] = w
+		}
+		sub.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rr := &rtcp.ReceiverReport{SSRC: p.reportSSRC}
+	for _, layer := range p.layers {
+		if !layer.stats.started {
+			continue
+		}
+		report := layer.stats.report(uint32(layer.Track.SSRC()))
+		report.FractionLost = max(report.FractionLost, worst[layer.RID].FractionLost)
+		report.Jitter = max(report.Jitter, worst[layer.RID].Jitter)
+		rr.Reports = append(rr.Reports, report)
+	}
+	return rr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// receive — feed packets with the sequence numbers, 20 ms apart at 48 kHz
+func receive(stats *receptionStats, seqs ...uint16) {
+	start := time.Unix(1_700_000_000, 0)
+	for _, seq := range seqs {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 960}}
+		stats.update(pkt, 48000, start.Add(time.Duration(seq)*20*time.Millisecond))
+	}
+}
+
+func TestReceptionStatsReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		seqs     []uint16
+		fraction uint8
+		lost     uint32
+		lastSeq  uint32
+	}{
+		{"in order", []uint16{10, 11, 12, 13}, 0, 0, 13},
+		{"one lost of five", []uint16{10, 11, 13, 14}, 256 / 5, 1, 14},
+		{"reordered", []uint16{10, 12, 11, 13}, 0, 0, 13},
+		{"late packet does not move max back", []uint16{10, 11, 12, 5}, 0, 0, 12},
+		{"duplicates do not make loss negative", []uint16{10, 11, 11, 12}, 0, 0, 12},
+		{"sequence wraparound", []uint16{65534, 65535, 0, 1}, 0, 0, 1<<16 + 1},
+		{"loss across wraparound", []uint16{65534, 0, 1}, 256 / 4, 1, 1<<16 + 1},
+	}
+	for _, tt := range tests {
+		var stats receptionStats
+		receive(&stats, tt.seqs...)
+		rr := stats.report(42)
+		if rr.SSRC != 42 || rr.FractionLost != tt.fraction || rr.TotalLost != tt.lost || rr.LastSequenceNumber != tt.lastSeq {
+			t.Errorf(
+				"%s: report = ssrc %d, fraction %d, lost %d, last %d; want fraction %d, lost %d, last %d",
+				tt.name, rr.SSRC, rr.FractionLost, rr.TotalLost, rr.LastSequenceNumber, tt.fraction, tt.lost, tt.lastSeq,
+			)
+		}
+		if rr.Jitter != 0 {
+			t.Errorf("%s: jitter = %d for evenly spaced packets", tt.name, rr.Jitter)
+		}
+	}
+}
+
+func TestReceptionStatsInterval(t *testing.T) {
+	var stats receptionStats
+	receive(&stats, 0, 1, 2, 3, 5, 6, 7, 8, 9)
+	if rr := stats.report(1); rr.FractionLost != 256/10 || rr.TotalLost != 1 {
+		t.Fatalf("first report: fraction %d, lost %d", rr.FractionLost, rr.TotalLost)
+	}
+	// Доля потерь — только за интервал, общий счёт копится
+	receive(&stats, 10, 11, 12, 13, 14)
+	if rr := stats.report(1); rr.FractionLost != 0 || rr.TotalLost != 1 {
+		t.Fatalf("second report: fraction %d, lost %d", rr.FractionLost, rr.TotalLost)
+	}
+	if rr := stats.report(1); rr.FractionLost != 0 {
+		t.Fatalf("empty interval: fraction %d", rr.FractionLost)
+	}
+}
+
+func TestPacketCacheWraparound(t *testing.T) {
+	var cache packetCache
+	push := func(from uint16, n int) {
+		for i := range n {
+			seq := from + uint16(i)
+			cache.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+		}
+	}
+	push(65000, 636) // 65000..65535 и 0..99
+
+	tests := []struct {
+		seq  uint16
+		want bool
+	}{
+		{65000, true},
+		{65535, true},
+		{0, true},
+		{99, true},
+		{100, false},
+		{64999, false},
+	}
+	for _, tt := range tests {
+		if pkt := cache.get(tt.seq); (pkt != nil) != tt.want {
+			t.Errorf("get(%d) found = %v, want %v", tt.seq, pkt != nil, tt.want)
+		}
+	}
+
+	// Через packetCacheSize номеров старый пакет вытеснен
+	push(100, packetCacheSize-636+1)
+	if cache.get(65000) != nil {
+		t.Error("get(65000) returned a packet overwritten by a newer one")
+	}
+	if cache.get(65001) == nil {
+		t.Error("get(65001) lost a packet still in the window")
+	}
+}
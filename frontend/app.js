@@ -25,13 +25,61 @@ function app() {
         // Данные для работы с комнатами
         rooms: [],
         selectedRoom: null,
-        participants: [],      // массив строк с идентификаторами участников
+        participants: [],      // массив участников: { clientId, userId, displayName, avatarUrl }
         roomInfo: {},          // объект с информацией о комнате (например, { id, creator })
+        lobbyPosition: 0,      // место в очереди лобби, 0 — не ждём
+        lobby: [],             // ожидающие входа (видят только модераторы)
+        whisperers: [],        // clientId тех, кто сейчас шепчет нам
+        lastNSpeakers: [],     // clientId тех, кого сейчас слышно в слотах Last-N
+        breakouts: [],         // breakout-комнаты: [{ roomId, participants }]
+        breakoutRoomId: "",    // в какой breakout-комнате мы сейчас, "" — в основной
+        breakoutEndsAt: null,  // когда всех вернут в основную комнату
+
+        // Чат комнаты
+        messages: [],          // [{ id, clientId, displayName, text, createdAt }]
+        chatText: "",
+        historyBefore: null,   // курсор для подгрузки более старых сообщений
+
+        // Дорожки комнаты: [{ sid, clientId, trackId, streamId, kind, source }]
+        tracks: [],
+        hiddenVideos: [],      // sid видео, которые мы не хотим получать
+        audioMixed: false,     // сервер сводит всех в одну дорожку — для слабых устройств
+        qualityIcons: {excellent: "🟢", good: "🟢", poor: "🟡", bad: "🔴"},
+        cameraTrack: null,
+        screenTrack: null,
 
         // WebSocket и WebRTC
         ws: null,
         localStream: null,
         peerConnection: null,
+        chatChannel: null,
+
+        /**
+         * Alpine вызывает init() при старте. После SSO-редиректа cookie уже
+         * выставлены — проверяем сессию и сразу открываем основной вид.
+         * Если у аккаунта включена 2FA, сервер вместо cookie кладёт
+         * MFA-токен во фрагмент (#mfa=...) — сначала проходим второй шаг.
+         */
+        async init() {
+            const mfa = new URLSearchParams(location.hash.slice(1)).get("mfa");
+            if (mfa) {
+                history.replaceState(null, "", location.pathname + location.search);
+                const response = await this.loginTotp(mfa).catch(() => null);
+                if (!response || !response.ok) {
+                    alert("Ошибка входа. Проверьте код двухфакторной аутентификации.");
+                    return;
+                }
+            }
+            this.authFetch("/rooms", {method: "GET"})
+                .then(response => {
+                    if (response.ok) {
+                        this.view = "main";
+                        this.initWs();
+                        this.fetchRooms();
+                    }
+                })
+                .catch(() => {});
+        },
 
         /**
          * Логин пользователя через REST (POST /login).
@@ -43,7 +91,12 @@ function app() {
                 headers: {"Content-Type": "application/json"},
                 body: JSON.stringify({username: this.username, password: this.password})
             })
-                .then(response => {
+                .then(async response => {
+                    // 202 — пароль верный, но включена двухфакторная аутентификация
+                    if (response.status === 202) {
+                        const data = await response.json();
+                        response = await this.loginTotp(data.mfaToken);
+                    }
                     if (response.ok) {
                         this.view = "main";
                         this.initWs();
@@ -58,6 +111,22 @@ function app() {
                 });
         },
 
+        /**
+         * Второй шаг входа (POST /login/totp): код из приложения-аутентификатора
+         * или одноразовый код восстановления (формат XXXX-XXXX-XXXX-XXXX).
+         */
+        loginTotp(mfaToken) {
+            const code = (prompt("Код двухфакторной аутентификации или код восстановления") || "").trim();
+            const body = code.includes("-")
+                ? {mfaToken: mfaToken, recoveryCode: code}
+                : {mfaToken: mfaToken, code: code};
+            return fetch("/login/totp", {
+                method: "POST",
+                headers: {"Content-Type": "application/json"},
+                body: JSON.stringify(body)
+            });
+        },
+
         /**
          * Регистрация пользователя через REST (POST /register).
          * При успехе переключаем вид на "main" и инициализируем WebSocket.
@@ -83,11 +152,59 @@ function app() {
                 });
         },
 
+        /**
+         * fetch с авторизацией: при 401 пробуем обновить токены (POST /token/refresh)
+         * и повторяем запрос один раз. Если refresh не удался — возвращаемся к входу.
+         */
+        async authFetch(url, options = {}) {
+            let response = await fetch(url, options);
+            if (response.status !== 401) {
+                return response;
+            }
+            const refreshed = await fetch("/token/refresh", {method: "POST"});
+            if (!refreshed.ok) {
+                this.resetSession();
+                return response;
+            }
+            return fetch(url, options);
+        },
+
+        /**
+         * Выход (POST /logout): сервер отзывает сессию и закрывает WebSocket.
+         */
+        logout() {
+            fetch("/logout", {method: "POST"})
+                .catch(err => console.error(err))
+                .finally(() => this.resetSession());
+        },
+
+        /**
+         * Сброс локального состояния после выхода или отзыва сессии.
+         */
+        resetSession() {
+            if (this.peerConnection) {
+                this.peerConnection.close();
+                this.peerConnection = null;
+            }
+            if (this.localStream) {
+                this.localStream.getTracks().forEach(track => track.stop());
+                this.localStream = null;
+            }
+            if (this.ws) {
+                this.ws.close();
+                this.ws = null;
+            }
+            this.rooms = [];
+            this.selectedRoom = null;
+            this.participants = [];
+            this.view = "auth";
+        },
+
         /**
          * Получение списка комнат с бэкенда (GET /rooms).
          */
         fetchRooms() {
-            fetch("/rooms", {method: "GET"})
+            this.authFetch("/rooms", {method: "GET"})
                 .then(response => response.json())
                 .then(data => {
                     // Ожидается, что data — массив объектов комнаты,
@@ -108,27 +225,113 @@ function app() {
             this.ws = new WebSocket(`ws://${window.location.host}/ws`);
             this.ws.onopen = () => {
                 console.log("WebSocket: соединение установлено");
+                // Ссылка-приглашение вида /?room=<id>&invite=<token>
+                const params = new URLSearchParams(window.location.search);
+                if (params.get("room")) {
+                    this.selectRoom({id: params.get("room")}, {inviteToken: params.get("invite") || ""});
+                }
             };
             this.ws.onmessage = (event) => {
                 const msg = JSON.parse(event.data);
                 // Обработка сигналов от сервера
                 if (msg.type === "answer" && msg.sdp) {
                     this.handleAnswer(msg.sdp);
+                } else if (msg.type === "offer" && msg.sdp) {
+                    this.handleOffer(msg.sdp);
+                } else if (msg.type === "tracks") {
+                    this.tracks = msg.tracks || [];
+                } else if (msg.type === "track_published") {
+                    this.tracks = this.tracks.filter(t => t.sid !== msg.tracks[0].sid).concat(msg.tracks);
+                } else if (msg.type === "track_unpublished") {
+                    this.tracks = this.tracks.filter(t => t.sid !== msg.tracks[0].sid);
+                    const video = document.getElementById("video-" + msg.tracks[0].streamId);
+                    if (video) {
+                        video.remove();
+                    }
+                } else if (msg.type === "breakout_moved") {
+                    // Соединение то же — сервер сам переключил, кого мы слышим
+                    this.breakoutRoomId = msg.roomId === this.selectedRoom.id ? "" : msg.roomId;
+                    this.participants = msg.participants || [];
+                } else if (msg.type === "breakouts") {
+                    this.breakouts = msg.breakouts || [];
+                    this.breakoutEndsAt = msg.endsAt ? new Date(msg.endsAt) : null;
+                } else if (msg.type === "breakout_timer") {
+                    this.breakoutEndsAt = new Date(msg.endsAt);
+                    if (msg.durationSeconds <= 60) {
+                        alert("Через минуту все вернутся в основную комнату");
+                    }
+                } else if (msg.type === "breakout_ended") {
+                    this.breakouts = [];
+                    this.breakoutRoomId = "";
+                    this.breakoutEndsAt = null;
+                } else if (msg.type === "last_n_speakers") {
+                    this.lastNSpeakers = (msg.tracks || []).filter(t => t.clientId).map(t => t.clientId);
+                } else if (msg.type === "whisper_started") {
+                    this.whisperers = this.whisperers.filter(id => id !== msg.clientId).concat([msg.clientId]);
+                } else if (msg.type === "whisper_ended") {
+                    this.whisperers = this.whisperers.filter(id => id !== msg.clientId);
                 } else if (msg.type === "candidate" && msg.candidate) {
                     this.handleCandidate(msg.candidate);
+                } else if (msg.type === "lobby_waiting") {
+                    this.lobbyPosition = msg.position;
+                } else if (msg.type === "lobby_denied") {
+                    alert("Модератор не впустил вас в комнату");
+                    this.lobbyPosition = 0;
+                    this.selectedRoom = null;
+                } else if (msg.type === "lobby") {
+                    this.lobby = msg.participants || [];
+                } else if (msg.type === "speak_invite") {
+                    const accepted = confirm("Модератор приглашает вас выступить. Выйти на сцену?");
+                    this.sendWsMessage({type: accepted ? "accept_speak" : "decline_speak"});
                 } else if (msg.type === "participants" && msg.participants) {
+                    this.lobbyPosition = 0;
                     // Обновляем список участников для выбранной комнаты
                     this.participants = msg.participants;
                     // Можно обновить также roomInfo, если сервер передает доп. данные
                     if (msg.roomInfo) {
                         this.roomInfo = msg.roomInfo;
                     }
+                } else if (msg.type === "participant_joined" && msg.participant) {
+                    this.participants = this.participants
+                        .filter(p => p.clientId !== msg.participant.clientId)
+                        .concat([msg.participant]);
+                } else if (msg.type === "participant_left" && msg.participant) {
+                    this.participants = this.participants.filter(p => p.clientId !== msg.participant.clientId);
+                } else if (msg.type === "participant_updated" && msg.participant) {
+                    this.participants = this.participants.map(
+                        p => p.clientId === msg.participant.clientId ? msg.participant : p
+                    );
+                } else if (msg.type === "connection_quality") {
+                    this.participants = this.participants.map(
+                        p => p.clientId === msg.clientId ? {...p, quality: msg.quality} : p
+                    );
+                } else if (msg.type === "kicked" || msg.type === "room_closed") {
+                    // Сервер уже закрыл наш PeerConnection
+                    alert(msg.type === "kicked" ? msg.message : "Комната закрыта владельцем.");
+                    if (msg.type === "room_closed") {
+                        this.fetchRooms();
+                    }
+                    this.selectedRoom = null;
+                    this.participants = [];
+                    if (this.peerConnection) {
+                        this.peerConnection.close();
+                        this.peerConnection = null;
+                    }
+                } else if (msg.type === "error" && (msg.code === "password_required" || msg.code === "password_invalid")) {
+                    const password = prompt("Пароль комнаты:");
+                    if (password && this.selectedRoom) {
+                        this.sendJoin(this.selectedRoom.id, {password});
+                    }
                 } else if (msg.type === "error") {
                     alert("Ошибка: " + msg.message);
                 }
             };
-            this.ws.onclose = () => {
+            this.ws.onclose = (event) => {
                 console.log("WebSocket: соединение закрыто");
+                // 4001 — сессия отозвана на сервере (logout на другом устройстве, кража токена)
+                if (event.code === 4001) {
+                    this.resetSession();
+                }
             };
             this.ws.onerror = (err) => {
                 console.error("WebSocket ошибка:", err);
@@ -152,22 +355,207 @@ function app() {
          * - Отправляем на сервер сообщение join (с указанием roomId и clientId)
          * - Запускаем голосовое соединение (WebRTC)
          */
-        selectRoom(room) {
+        selectRoom(room, credentials = {}) {
             this.selectedRoom = room;
             // Очистка предыдущего списка участников
             this.participants = [];
             // Отправляем join-сообщение
-            this.sendWsMessage({
-                type: "join",
-                roomId: room.id,
-                clientId: this.clientId
-            });
+            this.sendJoin(room.id, credentials);
             // Сохраняем инфо о комнате для правой колонки
             this.roomInfo = {id: room.id, creator: room.creator};
+            this.messages = [];
+            this.historyBefore = null;
+            this.loadHistory();
             // Запускаем голосовое соединение
             this.startVoiceCall();
         },
 
+        /**
+         * Подгрузка истории чата (GET /rooms/{id}/messages), каждая следующая — старее.
+         */
+        loadHistory() {
+            const params = new URLSearchParams({limit: "50"});
+            if (this.historyBefore) {
+                params.set("before", this.historyBefore);
+            }
+            this.authFetch(`/rooms/${encodeURIComponent(this.selectedRoom.id)}/messages?${params}`, {method: "GET"})
+                .then(response => response.ok ? response.json() : {messages: []})
+                .then(data => {
+                    this.messages = data.messages.concat(this.messages);
+                    this.historyBefore = data.nextBefore || null;
+                })
+                .catch(err => console.error(err));
+        },
+
+        /**
+         * Отправка сообщения в чат через data channel.
+         */
+        sendChat() {
+            const text = this.chatText.trim();
+            if (!text || !this.chatChannel || this.chatChannel.readyState !== "open") {
+                return;
+            }
+            this.chatChannel.send(JSON.stringify({text}));
+            this.chatText = "";
+        },
+
+        /**
+         * Включить или выключить камеру.
+         */
+        async toggleCamera() {
+            if (this.cameraTrack) {
+                this.unpublish(this.cameraTrack);
+                this.cameraTrack = null;
+                return;
+            }
+            const stream = await navigator.mediaDevices.getUserMedia({video: true});
+            this.cameraTrack = stream.getVideoTracks()[0];
+            this.publish(this.cameraTrack, stream, "camera");
+        },
+
+        /**
+         * Начать или остановить демонстрацию экрана.
+         */
+        async toggleScreen() {
+            if (this.screenTrack) {
+                this.unpublish(this.screenTrack);
+                this.screenTrack = null;
+                return;
+            }
+            const stream = await navigator.mediaDevices.getDisplayMedia({video: true});
+            this.screenTrack = stream.getVideoTracks()[0];
+            // Пользователь может остановить показ кнопкой браузера
+            this.screenTrack.onended = () => {
+                if (this.screenTrack) {
+                    this.toggleScreen();
+                }
+            };
+            this.publish(this.screenTrack, stream, "screen");
+        },
+
+        /**
+         * Добавить дорожку: сначала сообщаем серверу её источник, потом пересогласуем.
+         */
+        publish(track, stream, source) {
+            this.sendWsMessage({type: "track_info", tracks: [{trackId: track.id, source}]});
+            if (source === "camera") {
+                // Три слоя simulcast: сервер сам выберет, какой слать каждому
+                this.peerConnection.addTransceiver(track, {
+                    direction: "sendonly",
+                    streams: [stream],
+                    sendEncodings: [
+                        {rid: "q", scaleResolutionDownBy: 4, maxBitrate: 150000},
+                        {rid: "h", scaleResolutionDownBy: 2, maxBitrate: 500000},
+                        {rid: "f", maxBitrate: 1500000},
+                    ],
+                });
+            } else {
+                this.peerConnection.addTrack(track, stream);
+            }
+            this.renegotiate();
+        },
+
+        /**
+         * Ограничить качество видео с simulcast.
+         */
+        setVideoQuality(sid, quality) {
+            this.sendWsMessage({type: "set_video_quality", trackSids: [sid], quality});
+        },
+
+        /**
+         * Переключить сведение звука на сервере: одна дорожка вместо дорожки на каждого.
+         */
+        toggleAudioMix() {
+            this.audioMixed = !this.audioMixed;
+            this.sendWsMessage({type: "set_audio_mode", audioMode: this.audioMixed ? "mixed" : "forward"});
+        },
+
+        /**
+         * Убрать дорожку и пересогласовать соединение.
+         */
+        unpublish(track) {
+            const sender = this.peerConnection.getSenders().find(s => s.track === track);
+            if (sender) {
+                this.peerConnection.removeTrack(sender);
+            }
+            track.stop();
+            this.renegotiate();
+        },
+
+        /**
+         * Новый offer от клиента после изменения своих дорожек.
+         */
+        async renegotiate() {
+            const offer = await this.peerConnection.createOffer();
+            await this.peerConnection.setLocalDescription(offer);
+            this.sendWsMessage({type: "offer", sdp: offer});
+        },
+
+        /**
+         * Показать или скрыть чужое видео; скрытое сервер перестаёт присылать.
+         */
+        toggleVideo(sid) {
+            this.hiddenVideos = this.hiddenVideos.includes(sid)
+                ? this.hiddenVideos.filter(id => id !== sid)
+                : this.hiddenVideos.concat([sid]);
+            const trackSids = this.tracks
+                .filter(t => t.kind === "video" && !this.hiddenVideos.includes(t.sid))
+                .map(t => t.sid);
+            this.sendWsMessage({type: "select_video", trackSids});
+        },
+
+        /**
+         * Своя запись в списке участников — по ней видно роль и поднятую руку.
+         */
+        me() {
+            return this.participants.find(p => p.clientId === this.clientId) || {};
+        },
+
+        /**
+         * Поднять или опустить руку на сцене.
+         */
+        toggleHand() {
+            this.sendWsMessage({type: this.me().handRaised ? "lower_hand" : "raise_hand"});
+        },
+
+        /**
+         * Проверка, что мы модератор или владелец комнаты.
+         */
+        isModerator() {
+            return ["moderator", "owner"].includes(this.me().role);
+        },
+
+        /**
+         * Случайно разбить комнату на группы (для модераторов).
+         */
+        startBreakouts() {
+            const count = parseInt(prompt("Сколько групп?", "2"), 10);
+            if (!count) {
+                return;
+            }
+            const minutes = parseInt(prompt("Длительность в минутах (0 — без таймера)", "10"), 10) || 0;
+            this.sendWsMessage({type: "breakout_start", count, randomize: true, durationSeconds: minutes * 60});
+        },
+
+        /**
+         * Впустить или не впустить ожидающего в лобби (для модераторов).
+         */
+        moderateLobby(type, clientId) {
+            this.sendWsMessage({type, targetClientId: clientId});
+        },
+
+        /**
+         * Отправка join; credentials — { password } или { inviteToken }.
+         */
+        sendJoin(roomId, credentials = {}) {
+            this.sendWsMessage({
+                type: "join",
+                roomId: roomId,
+                clientId: this.clientId,
+                ...credentials
+            });
+        },
+
         /**
          * Начало голосового вызова.
          * Запрашиваем аудио, создаем RTCPeerConnection, добавляем дорожки и отправляем SDP offer.
@@ -184,6 +572,12 @@ function app() {
                     this.peerConnection.addTrack(track, stream);
                 });
 
+                // Чат идёт через тот же PeerConnection; сервер присылает и наши сообщения
+                this.chatChannel = this.peerConnection.createDataChannel("chat");
+                this.chatChannel.onmessage = (event) => {
+                    this.messages.push(JSON.parse(event.data));
+                };
+
                 // Обработка ICE-кандидатов
                 this.peerConnection.onicecandidate = (event) => {
                     if (event.candidate) {
@@ -196,10 +590,44 @@ function app() {
                     }
                 };
 
-                // При получении аудио устанавливаем поток в audio-элемент
+                // Каждый участник приходит отдельным потоком — заводим на него свой audio-элемент
                 this.peerConnection.ontrack = (event) => {
-                    const remoteAudio = document.getElementById("remoteAudio");
-                    remoteAudio.srcObject = event.streams[0];
+                    const stream = event.streams[0];
+                    if (event.track.kind === "video") {
+                        let video = document.getElementById("video-" + stream.id);
+                        if (!video) {
+                            video = document.createElement("video");
+                            video.id = "video-" + stream.id;
+                            video.autoplay = true;
+                            video.playsInline = true;
+                            video.muted = true;
+                            document.getElementById("videos").appendChild(video);
+                        }
+                        video.srcObject = stream;
+                        return;
+                    }
+                    // Слоты Last-N приходят одним потоком, но каждому нужен свой элемент
+                    const id = stream.id === "lastn" ? "lastn-" + event.track.id : stream.id;
+                    let audio = document.getElementById("audio-" + id);
+                    if (!audio) {
+                        audio = document.createElement("audio");
+                        audio.id = "audio-" + id;
+                        audio.autoplay = true;
+                        document.body.appendChild(audio);
+                    }
+                    audio.srcObject = stream.id === "lastn" ? new MediaStream([event.track]) : stream;
+                    if (stream.id === "lastn") {
+                        event.track.onended = () => audio.remove();
+                        stream.onremovetrack = (e) => {
+                            document.getElementById("audio-lastn-" + e.track.id)?.remove();
+                        };
+                        return;
+                    }
+                    stream.onremovetrack = () => {
+                        if (stream.getTracks().length === 0) {
+                            audio.remove();
+                        }
+                    };
                 };
 
                 // Создаем SDP предложение
@@ -236,6 +664,25 @@ function app() {
             }
         },
 
+        /**
+         * Обработка SDP offer от сервера: он пересогласует соединение,
+         * когда в комнате появляются или пропадают дорожки.
+         */
+        async handleOffer(sdp) {
+            if (!this.peerConnection) {
+                console.error("RTCPeerConnection не создан");
+                return;
+            }
+            try {
+                await this.peerConnection.setRemoteDescription(new RTCSessionDescription(sdp));
+                const answer = await this.peerConnection.createAnswer();
+                await this.peerConnection.setLocalDescription(answer);
+                this.sendWsMessage({type: "answer", sdp: answer});
+            } catch (e) {
+                console.error("Ошибка обработки offer от сервера", e);
+            }
+        },
+
         /**
          * Обработка ICE-кандидата, полученного от сервера.
          */
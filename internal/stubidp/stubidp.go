@@ -0,0 +1,240 @@
+// Package stubidp — минимальный OpenID Connect провайдер для локальной проверки SSO и тестов.
+//
+// Поддерживает discovery, JWKS, authorization code + PKCE (S256) и всегда
+// «логинит» одного и того же пользователя без формы входа; login_hint подменяет sub.
+package stubidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "stub-key"
+
+// authCode — issued authorization code waiting for the token request
+type authCode struct {
+	ClientID      string
+	RedirectURI   string
+	CodeChallenge string
+	Nonce         string
+	Subject       string
+	ExpiresAt     time.Time
+}
+
+// StubIdP — in-memory OpenID Connect provider
+type StubIdP struct {
+	issuer   string
+	clientID string
+	secret   string
+	key      *rsa.PrivateKey
+	user     map[string]interface{}
+
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+// New — create provider signing ID tokens for the client with the user claims
+func New(issuer, clientID, secret string, user map[string]interface{}) (*StubIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &StubIdP{
+		issuer:   issuer,
+		clientID: clientID,
+		secret:   secret,
+		key:      key,
+		user:     user,
+		codes:    make(map[string]authCode),
+	}, nil
+}
+
+// Handler — HTTP handler serving discovery, JWKS, authorize and token endpoints
+func (p *StubIdP) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("GET /jwks", p.handleJWKS)
+	mux.HandleFunc("GET /authorize", p.handleAuthorize)
+	mux.HandleFunc("POST /token", p.handleToken)
+	return mux
+}
+
+// handleDiscovery — serve OpenID provider metadata
+func (p *StubIdP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(
+		w, http.StatusOK, map[string]interface{}{
+			"issuer":                                p.issuer,
+			"authorization_endpoint":                p.issuer + "/authorize",
+			"token_endpoint":                        p.issuer + "/token",
+			"jwks_uri":                              p.issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"scopes_supported":                      []string{"openid", "profile", "email"},
+		},
+	)
+}
+
+// handleJWKS — serve public signing key
+func (p *StubIdP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(
+		w, http.StatusOK, map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"use": "sig",
+					"alg": "RS256",
+					"kid": keyID,
+					"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+				},
+			},
+		},
+	)
+}
+
+// handleAuthorize — approve request immediately and redirect back with a code
+func (p *StubIdP) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" {
+		http.Error(w, "unsupported response_type", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE S256 required", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirectURI.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	subject, _ := p.user["sub"].(string)
+	if hint := q.Get("login_hint"); hint != "" {
+		subject = hint
+	}
+
+	p.mu.Lock()
+	p.codes[code] = authCode{
+		ClientID:      p.clientID,
+		RedirectURI:   redirectURI.String(),
+		CodeChallenge: q.Get("code_challenge"),
+		Nonce:         q.Get("nonce"),
+		Subject:       subject,
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// handleToken — exchange code for ID token after PKCE verification
+func (p *StubIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || secret != p.secret {
+		tokenError(w, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	p.mu.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if !ok || time.Now().After(code.ExpiresAt) || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != code.CodeChallenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": p.issuer,
+		"aud": p.clientID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range p.user {
+		claims[k] = v
+	}
+	claims["sub"] = code.Subject
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		slog.Error("sign ID token", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("ID token issued", "sub", code.Subject)
+	writeJSON(
+		w, http.StatusOK, map[string]interface{}{
+			"access_token": randomString(),
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     idToken,
+		},
+	)
+}
+
+// tokenError — write OAuth2 error response
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+// writeJSON — write JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// randomString — random URL-safe string
+func randomString() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
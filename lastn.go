@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	MsgTypeLastNSpeakers = "last_n_speakers"
+
+	maxLastN = 16
+	// speakerSelectInterval — как часто пересматриваем, кого слышно в слотах Last-N
+	speakerSelectInterval = 250 * time.Millisecond
+	// speakerHold — столько после последнего голоса спикер ещё считается говорящим
+	speakerHold = 2 * time.Second
+	// lastNStreamID — MediaStream, в котором подписчику приходят слоты
+	lastNStreamID = "lastn"
+)
+
+// opusCodec — Opus as browsers offer it: registered in pion, used by tracks the server fills itself
+// (Last-N slots, the mix) and by copies of RED cut down for subscribers without it
+var opusCodec = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   48000,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+}
+
+// audioSlot — fixed audio track of a subscriber that is re-pointed between publications
+type audioSlot struct {
+	Sub *Subscription
+	Pub *Publication // чей звук сейчас в слоте, nil — слот свободен
+}
+
+// lastN — how many loudest speakers each listener gets, 0 forwards everyone
+func (r *Room) lastN() int {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.LastN
+}
+
+// slots — snapshot of Last-N slots of the client
+func (c *Client) slots() []*audioSlot {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return slices.Clone(c.AudioSlots)
+}
+
+// trackLevel — update smoothed loudness of an audio publication from RFC 6464 levels
+func (p *Publication) trackLevel(pkt *rtp.Packet) {
+	// Без расширения уровня громкость неизвестна: считаем средней, пока идут пакеты
+	loudness := 64.0
+	if payload := pkt.GetExtension(p.levelExtID); p.levelExtID != 0 && payload != nil {
+		var level rtp.AudioLevelExtension
+		if err := level.Unmarshal(payload); err == nil {
+			loudness = float64(127 - level.Level)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loudness += (loudness - p.loudness) / 5
+	if hasVoice(pkt, p.levelExtID) {
+		p.lastVoice = time.Now()
+	}
+}
+
+// speakerScore — how loud the publication currently is, 0 if silent for a while
+func (p *Publication) speakerScore(now time.Time) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.lastVoice) > speakerHold {
+		return 0
+	}
+	return p.loudness
+}
+
+// attachSlot — start forwarding the publication into the slot
+func (p *Publication) attachSlot(sub *Subscription) {
+	sub.mu.Lock()
+	sub.rewriter.stale = true
+	sub.target = ""
+	sub.mu.Unlock()
+	p.mu.Lock()
+	p.subs[sub.Subscriber.ID] = sub
+	p.mu.Unlock()
+}
+
+// detachSlot — stop forwarding the publication into the slot, keeping the track
+func (p *Publication) detachSlot(sub *Subscription) {
+	p.mu.Lock()
+	if p.subs[sub.Subscriber.ID] == sub {
+		delete(p.subs, sub.Subscriber.ID)
+	}
+	p.mu.Unlock()
+	sub.mu.Lock()
+	sub.rewriter.stale = true
+	sub.mu.Unlock()
+}
+
+// createSlots — add Last-N audio tracks to the client PeerConnection
+func createSlots(client *Client, n int) {
+	pc := client.peer()
+	// Со сведением на сервере слоты не нужны: клиент и так слышит всех одной дорожкой
+	if pc == nil || pc.ConnectionState() == webrtc.PeerConnectionStateClosed || len(client.slots()) > 0 ||
+		client.audioMode() == AudioModeMixed || client.Ingest {
+		return
+	}
+	var slots []*audioSlot
+	for i := range n {
+		local, err := webrtc.NewTrackLocalStaticRTP(opusCodec, fmt.Sprintf("lastn-%d", i), lastNStreamID)
+		if err != nil {
+			slog.Error("create slot track", "error", err)
+			break
+		}
+		sender, err := pc.AddTrack(local)
+		if err != nil {
+			slog.Error("add slot track", "clientID", client.ID, "error", err)
+			break
+		}
+		sub := &Subscription{Subscriber: client, Local: local, Sender: sender, slot: true}
+		go drainRTCP(sender, sub.setReport)
+		slots = append(slots, &audioSlot{Sub: sub})
+	}
+	client.Mu.Lock()
+	client.AudioSlots = slots
+	client.Mu.Unlock()
+	slog.Info("Last-N slots created", "clientID", client.ID, "count", len(slots))
+	client.renegotiate()
+}
+
+// dropSlots — remove Last-N audio tracks of the client
+func dropSlots(client *Client) {
+	client.Mu.Lock()
+	slots := client.AudioSlots
+	client.AudioSlots = nil
+	client.Mu.Unlock()
+	if len(slots) == 0 {
+		return
+	}
+	pc := client.peer()
+	for _, slot := range slots {
+		if slot.Pub != nil {
+			slot.Pub.detachSlot(slot.Sub)
+		}
+		if pc != nil && pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			if err := pc.RemoveTrack(slot.Sub.Sender); err != nil {
+				slog.Error("remove slot track", "clientID", client.ID, "error", err)
+			}
+		}
+	}
+	client.renegotiate()
+}
+
+// drainRTCP — read feedback of a track the server fills itself, keeping only receiver reports;
+// audio needs no keyframes or NACK
+func drainRTCP(sender *webrtc.RTPSender, setReport func(*rtcp.ReceiverReport)) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			if rr, ok := pkt.(*rtcp.ReceiverReport); ok {
+				setReport(rr)
+			}
+		}
+	}
+}
+
+// maybeSelectSpeakers — reselect speakers of a Last-N room at most once per interval
+func (r *Room) maybeSelectSpeakers() {
+	r.Mu.Lock()
+	due := r.LastN > 0 && time.Since(r.speakersAt) >= speakerSelectInterval
+	if due {
+		r.speakersAt = time.Now()
+	}
+	r.Mu.Unlock()
+	// Пока прошлый выбор не закончился, новый не начинаем
+	if due && r.speakersMu.TryLock() {
+		defer r.speakersMu.Unlock()
+		r.selectSpeakers()
+	}
+}
+
+// selectSpeakers — point every listener's slots at the loudest speakers it may hear, caller holds speakersMu
+func (r *Room) selectSpeakers() {
+	now := time.Now()
+	clients := r.GetClients()
+	scores := make(map[*Publication]float64)
+	var pubs []*Publication
+	for _, client := range clients {
+		for _, pub := range client.publications() {
+			if pub.Track.Kind() == webrtc.RTPCodecTypeAudio {
+				pubs = append(pubs, pub)
+				scores[pub] = pub.speakerScore(now)
+			}
+		}
+	}
+	slices.SortFunc(
+		pubs, func(a, b *Publication) int {
+			switch {
+			case scores[a] > scores[b]:
+				return -1
+			case scores[a] < scores[b]:
+				return 1
+			}
+			return 0
+		},
+	)
+
+	for _, subscriber := range clients {
+		slots := subscriber.slots()
+		if len(slots) == 0 {
+			continue
+		}
+		// Себя, заглушённых подписчиком и не шепчущих ему в слоты не ставим
+		audible := make(map[*Publication]float64)
+		var loudest []*Publication
+		for _, pub := range pubs {
+			if pub.Publisher == subscriber || subscriber.IsMuted(pub.Publisher.ID) ||
+				!pub.Publisher.whispersTo(subscriber.ID) {
+				continue
+			}
+			audible[pub] = scores[pub]
+			if scores[pub] > 0 && len(loudest) < len(slots) {
+				loudest = append(loudest, pub)
+			}
+		}
+		if assignSlots(slots, loudest, audible) {
+			announceSpeakers(subscriber, slots)
+		}
+	}
+}
+
+// assignSlots — keep current speakers in place, newcomers take the slots of the quietest; audible holds scores
+func assignSlots(slots []*audioSlot, loudest []*Publication, audible map[*Publication]float64) bool {
+	changed := false
+	assigned := make(map[*Publication]bool)
+	for _, slot := range slots {
+		// Ушедший, заглушённый или закончивший публикацию освобождает слот сразу
+		if _, ok := audible[slot.Pub]; slot.Pub != nil && (!ok || !slot.Pub.Publisher.hasPublication(slot.Pub)) {
+			slot.Pub.detachSlot(slot.Sub)
+			slot.Pub = nil
+			changed = true
+		}
+		if slot.Pub != nil {
+			assigned[slot.Pub] = true
+		}
+	}
+	for _, pub := range loudest {
+		if assigned[pub] {
+			continue
+		}
+		// Свободный слот, иначе вытесняем самого тихого из не входящих в Last-N
+		var target *audioSlot
+		for _, slot := range slots {
+			if slot.Pub == nil {
+				target = slot
+				break
+			}
+			if !slices.Contains(loudest, slot.Pub) && (target == nil || audible[slot.Pub] < audible[target.Pub]) {
+				target = slot
+			}
+		}
+		if target == nil {
+			break
+		}
+		if target.Pub != nil {
+			target.Pub.detachSlot(target.Sub)
+		}
+		target.Pub = pub
+		pub.attachSlot(target.Sub)
+		assigned[pub] = true
+		changed = true
+	}
+	return changed
+}
+
+// hasPublication — check if the publication is still live
+func (c *Client) hasPublication(pub *Publication) bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Publications[pub.ID] == pub
+}
+
+// announceSpeakers — tell the listener whose voice each slot carries
+func announceSpeakers(client *Client, slots []*audioSlot) {
+	tracks := make([]TrackDTO, 0, len(slots))
+	for _, slot := range slots {
+		dto := TrackDTO{TrackID: slot.Sub.Local.ID(), StreamID: lastNStreamID, Kind: "audio"}
+		if slot.Pub != nil {
+			dto.Sid = slot.Pub.Sid()
+			dto.ClientID = slot.Pub.Publisher.ID
+			dto.Source = slot.Pub.Source
+		}
+		tracks = append(tracks, dto)
+	}
+	if err := client.Send(WebSocketMessageDTO{Type: MsgTypeLastNSpeakers, Tracks: tracks}); err != nil {
+		slog.Error("send last-n speakers", "clientID", client.ID, "error", err)
+	}
+}
+
+// resetAudio — rebuild audio subscriptions of the room after Last-N was switched on, off or resized
+func (s *Server) resetAudio(room *Room) {
+	n := room.lastN()
+	for _, client := range room.GetClients() {
+		// Сводимых на сервере Last-N не касается
+		if len(client.slots()) == n && n > 0 || client.audioMode() == AudioModeMixed {
+			continue
+		}
+		s.resetClientAudio(client, room)
+	}
+}
+
+// resetClientAudio — drop every way audio reaches the client and subscribe it again
+func (s *Server) resetClientAudio(client *Client, room *Room) {
+	room.speakersMu.Lock()
+	dropSlots(client)
+	room.speakersMu.Unlock()
+	for _, other := range room.GetClients() {
+		for _, pub := range other.publications() {
+			if pub.Track.Kind() == webrtc.RTPCodecTypeAudio {
+				pub.unsubscribe(client.ID)
+			}
+		}
+	}
+	stopMixer(client)
+	s.attachMedia(client, room)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssignSlots(t *testing.T) {
+	tests := []struct {
+		name    string
+		slots   string             // кто сейчас в слотах, "-" — свободен
+		ended   string             // чьи публикации уже закончились
+		audible map[string]float64 // кого слышно и насколько громко
+		loudest string             // Last-N по громкости
+		want    string
+		changed bool
+	}{
+		{"free slots filled", "--", "", map[string]float64{"a": .9, "b": .8}, "ab", "ab", true},
+		{"same speakers", "ab", "", map[string]float64{"a": .9, "b": .8}, "ab", "ab", false},
+		{"speaker keeps the slot when order changes", "ab", "", map[string]float64{"a": .8, "b": .9}, "ba", "ab", false},
+		{"newcomer replaces the one out of Last-N", "ab", "", map[string]float64{"a": .3, "b": .8, "c": .9}, "cb", "cb", true},
+		{"quietest of those out of Last-N is replaced", "abc", "", map[string]float64{"a": .5, "b": .2, "c": .4, "d": .9}, "da", "adc", true},
+		{"muted speaker frees the slot", "ab", "", map[string]float64{"b": .8}, "b", "-b", true},
+		{"ended publication frees the slot", "ab", "a", map[string]float64{"a": .9, "b": .8}, "b", "-b", true},
+		{"free slot taken before evicting", "a-", "", map[string]float64{"a": .1, "b": .9}, "b", "ab", true},
+		{"more speakers than slots", "--", "", map[string]float64{"a": .9, "b": .8, "c": .7}, "abc", "ab", true},
+	}
+	for _, tt := range tests {
+		listener := NewClient("listener", nil, nil, 0)
+		pubs := make(map[string]*Publication)
+		pub := func(name string) *Publication {
+			if p, ok := pubs[name]; ok {
+				return p
+			}
+			publisher := NewClient(name, nil, nil, 0)
+			p := &Publication{ID: "audio", Publisher: publisher, subs: make(map[string]*Subscription)}
+			publisher.Publications[p.ID] = p
+			pubs[name] = p
+			return p
+		}
+
+		var slots []*audioSlot
+		for _, name := range tt.slots {
+			slot := &audioSlot{Sub: &Subscription{Subscriber: listener, slot: true}}
+			if name != '-' {
+				slot.Pub = pub(string(name))
+				slot.Pub.attachSlot(slot.Sub)
+			}
+			slots = append(slots, slot)
+		}
+		for _, name := range tt.ended {
+			p := pub(string(name))
+			delete(p.Publisher.Publications, p.ID)
+		}
+		audible := make(map[*Publication]float64)
+		for name, level := range tt.audible {
+			audible[pub(name)] = level
+		}
+		var loudest []*Publication
+		for _, name := range tt.loudest {
+			loudest = append(loudest, pub(string(name)))
+		}
+
+		changed := assignSlots(slots, loudest, audible)
+
+		var got strings.Builder
+		for _, slot := range slots {
+			if slot.Pub == nil {
+				got.WriteByte('-')
+				continue
+			}
+			got.WriteString(slot.Pub.Publisher.ID)
+			// Пересылка должна идти ровно в тот слот, где издатель числится
+			if slot.Pub.subs[listener.ID] != slot.Sub {
+				t.Errorf("%s: %s is not forwarded into its slot", tt.name, slot.Pub.Publisher.ID)
+			}
+		}
+		if got.String() != tt.want || changed != tt.changed {
+			t.Errorf("%s: slots %q, changed %v; want %q, %v", tt.name, got.String(), changed, tt.want, tt.changed)
+		}
+		for name, p := range pubs {
+			if !strings.Contains(got.String(), name) && p.subs[listener.ID] != nil {
+				t.Errorf("%s: %s is still forwarded without a slot", tt.name, name)
+			}
+		}
+	}
+}
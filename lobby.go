@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+const (
+	MsgTypeLobbyWaiting = "lobby_waiting"
+	MsgTypeLobbyDenied  = "lobby_denied"
+	MsgTypeLobby        = "lobby"
+	MsgTypeAdmit        = "admit"
+	MsgTypeDeny         = "deny"
+
+	// Почему клиент ждёт — в поле code сообщения lobby_waiting
+	LobbyReasonRoomFull         = "room_full"
+	LobbyReasonApprovalRequired = "approval_required"
+)
+
+// lobbyEntry — client waiting to enter the room
+type lobbyEntry struct {
+	client *Client
+	// approved — модератор впустил или лобби выключено, ждём только свободного места
+	approved bool
+}
+
+// Capacity — effective participant limit of the room
+func (rec RoomRecord) Capacity() int {
+	if rec.MaxParticipants > 0 && rec.MaxParticipants < cfg.MaxRoomParticipants {
+		return rec.MaxParticipants
+	}
+	return cfg.MaxRoomParticipants
+}
+
+// validateMaxParticipants — check room participant limit, 0 means server default
+func validateMaxParticipants(maxParticipants int) []FieldError {
+	if maxParticipants < 0 || maxParticipants > cfg.MaxRoomParticipants {
+		return []FieldError{
+			{
+				Field:   "maxParticipants",
+				Code:    "out_of_range",
+				Message: fmt.Sprintf("maxParticipants must be between 0 and %d", cfg.MaxRoomParticipants),
+			},
+		}
+	}
+	return nil
+}
+
+// validateLastN — check Last-N speaker count, 0 disables it
+func validateLastN(lastN int) []FieldError {
+	if lastN < 0 || lastN > maxLastN {
+		return []FieldError{
+			{
+				Field:   "lastN",
+				Code:    "out_of_range",
+				Message: fmt.Sprintf("lastN must be between 0 and %d", maxLastN),
+			},
+		}
+	}
+	return nil
+}
+
+// waitingRoom — room whose lobby the client is waiting in
+func (c *Client) waitingRoom() *Room {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Waiting
+}
+
+// setWaiting — remember lobby the client is waiting in
+func (c *Client) setWaiting(room *Room) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.Waiting = room
+}
+
+// configure — apply persisted capacity and lobby settings to the live room
+func (r *Room) configure(rec RoomRecord) {
+	r.Mu.Lock()
+	r.MaxParticipants = rec.Capacity()
+	r.LobbyEnabled = rec.LobbyEnabled
+	r.StageMode = rec.StageMode
+	r.PushToTalk = rec.PushToTalk
+	r.LastN = rec.LastN
+	r.AudioProfile = rec.AudioProfile
+	r.MaxAudioBitrate = rec.MaxAudioBitrate
+	r.AdHoc = rec.AdHoc
+	if !r.StageMode {
+		clear(r.StageRoles)
+	}
+	if !r.LobbyEnabled {
+		for _, entry := range r.Lobby {
+			entry.approved = true
+		}
+	}
+	var breakouts []*Room
+	if r.Breakout != nil {
+		breakouts = r.Breakout.Rooms
+	}
+	r.Mu.Unlock()
+	// Breakout-комнаты живут по правилам основной
+	for _, child := range breakouts {
+		child.configure(rec)
+	}
+}
+
+// findClient — client with the ID in the room or its lobby
+func (r *Room) findClient(clientID string) (*Client, bool) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if client, ok := r.Clients[clientID]; ok {
+		return client, true
+	}
+	for _, entry := range r.Lobby {
+		if entry.client.ID == clientID {
+			return entry.client, true
+		}
+	}
+	return nil, false
+}
+
+// admitOrQueue — add client to the room or to the lobby, returns queue position (0 — admitted)
+func (r *Room) admitOrQueue(client *Client, bypass bool) int {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	// Пока в очереди кто-то есть, новые не проходят вперёд неё
+	hasRoom := !r.LobbyEnabled && len(r.Lobby) == 0 && r.headcount() < r.MaxParticipants
+	if bypass || hasRoom {
+		r.Clients[client.ID] = client
+		return 0
+	}
+	r.Lobby = append(r.Lobby, &lobbyEntry{client: client, approved: !r.LobbyEnabled})
+	return len(r.Lobby)
+}
+
+// removeWaiting — drop client from the lobby
+func (r *Room) removeWaiting(clientID string) (*Client, bool) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	for i, entry := range r.Lobby {
+		if entry.client.ID == clientID {
+			r.Lobby = append(r.Lobby[:i], r.Lobby[i+1:]...)
+			return entry.client, true
+		}
+	}
+	return nil, false
+}
+
+// removeWaitingUser — drop all user connections from the lobby
+func (r *Room) removeWaitingUser(userID int) []*Client {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	var removed []*Client
+	remaining := r.Lobby[:0]
+	for _, entry := range r.Lobby {
+		if entry.client.UserID == userID {
+			removed = append(removed, entry.client)
+			continue
+		}
+		remaining = append(remaining, entry)
+	}
+	r.Lobby = remaining
+	return removed
+}
+
+// approve — mark waiting client as let in by a moderator
+func (r *Room) approve(clientID string) bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	for _, entry := range r.Lobby {
+		if entry.client.ID == clientID {
+			entry.approved = true
+			return true
+		}
+	}
+	return false
+}
+
+// popAdmitted — move approved waiting clients into the room while there is space
+func (r *Room) popAdmitted() []*Client {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	var admitted []*Client
+	remaining := r.Lobby[:0]
+	for _, entry := range r.Lobby {
+		if entry.approved && r.headcount() < r.MaxParticipants {
+			r.Clients[entry.client.ID] = entry.client
+			admitted = append(admitted, entry.client)
+			continue
+		}
+		remaining = append(remaining, entry)
+	}
+	r.Lobby = remaining
+	return admitted
+}
+
+// lobbySnapshot — copy of the queue in order
+func (r *Room) lobbySnapshot() []lobbyEntry {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	entries := make([]lobbyEntry, 0, len(r.Lobby))
+	for _, entry := range r.Lobby {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// waitingClients — clients waiting in the lobby
+func (r *Room) waitingClients() []*Client {
+	entries := r.lobbySnapshot()
+	clients := make([]*Client, 0, len(entries))
+	for _, entry := range entries {
+		clients = append(clients, entry.client)
+	}
+	return clients
+}
+
+// leaveLobby — take client out of the lobby it is waiting in
+func (s *Server) leaveLobby(client *Client) {
+	room := client.waitingRoom()
+	if room == nil {
+		return
+	}
+	room.removeWaiting(client.ID)
+	client.setWaiting(nil)
+	s.notifyLobby(room)
+}
+
+// admitFromLobby — let approved waiting clients in and refresh queue positions
+func (s *Server) admitFromLobby(room *Room) bool {
+	admitted := room.popAdmitted()
+	for _, client := range admitted {
+		client.setWaiting(nil)
+		s.enterRoom(client, room)
+		if err := client.Send(
+			WebSocketMessageDTO{Type: MsgTypeParticipants, RoomID: room.ID, Participants: room.Participants()},
+		); err != nil {
+			slog.Error("notify admitted client", "clientID", client.ID, "error", err)
+		}
+	}
+	if len(admitted) == 0 {
+		return false
+	}
+	s.notifyLobby(room)
+	return true
+}
+
+// notifyLobby — send queue positions to waiting clients and the queue to moderators
+func (s *Server) notifyLobby(room *Room) {
+	for i, entry := range room.lobbySnapshot() {
+		reason := LobbyReasonApprovalRequired
+		if entry.approved {
+			reason = LobbyReasonRoomFull
+		}
+		if err := entry.client.Send(
+			WebSocketMessageDTO{Type: MsgTypeLobbyWaiting, RoomID: room.ID, Position: i + 1, Code: reason},
+		); err != nil {
+			slog.Error("notify lobby position", "clientID", entry.client.ID, "error", err)
+		}
+	}
+	for _, client := range room.GetClients() {
+		if roleRank[client.RoomRole()] >= roleRank[RoomRoleModerator] {
+			s.sendLobby(client, room)
+		}
+	}
+}
+
+// sendLobby — send waiting participants to a moderator
+func (s *Server) sendLobby(moderator *Client, room *Room) {
+	waiting := room.waitingClients()
+	participants := make([]ParticipantDTO, 0, len(waiting))
+	for _, client := range waiting {
+		participants = append(participants, client.Participant())
+	}
+	if err := moderator.Send(
+		WebSocketMessageDTO{Type: MsgTypeLobby, RoomID: room.ID, Participants: participants},
+	); err != nil {
+		slog.Error("send lobby", "clientID", moderator.ID, "error", err)
+	}
+}
+
+// moderateLobby — handle admit and deny from a moderator
+func (s *Server) moderateLobby(actor *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	// Лобби есть только у основной комнаты, модератор может быть и в breakout
+	room := actor.CurrentRoom().root()
+	if _, _, errMsg := requireModerator(actor, room); errMsg != nil {
+		return *errMsg
+	}
+
+	switch msg.Type {
+	case MsgTypeAdmit:
+		if !room.approve(msg.TargetClientID) {
+			return moderationError(ModErrTargetNotFound, "Client is not waiting in the lobby")
+		}
+		// Комната полна — впущенный остаётся в очереди, но ждёт уже только места
+		if !s.admitFromLobby(room) {
+			s.notifyLobby(room)
+		}
+
+	case MsgTypeDeny:
+		target, ok := room.removeWaiting(msg.TargetClientID)
+		if !ok {
+			return moderationError(ModErrTargetNotFound, "Client is not waiting in the lobby")
+		}
+		target.setWaiting(nil)
+		if err := target.Send(
+			WebSocketMessageDTO{Type: MsgTypeLobbyDenied, RoomID: room.ID, Message: "Denied by moderator"},
+		); err != nil {
+			slog.Error("notify denied client", "clientID", target.ID, "error", err)
+		}
+		s.notifyLobby(room)
+	}
+
+	slog.Info("Lobby action", "action", msg.Type, "roomID", room.ID, "by", actor.UserID, "target", msg.TargetClientID)
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", TargetClientID: msg.TargetClientID}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// lobbyRoom — live room of two places with its lobby enabled or not
+func lobbyRoom(t *testing.T, s *Server, lobbyEnabled bool) *Room {
+	t.Helper()
+	// Комнаты нет в БД, как у ad-hoc
+	openTestDB(t)
+	prev := cfg
+	cfg.MaxRoomParticipants = 10
+	t.Cleanup(func() { cfg = prev })
+	room := NewRoom("room")
+	room.configure(RoomRecord{ID: "room", MaxParticipants: 2, LobbyEnabled: lobbyEnabled})
+	s.Rooms[room.ID] = room
+	return room
+}
+
+// queue — connect client and put it into the room or the lobby as joinRoom does
+func queue(t *testing.T, s *Server, room *Room, id string, bypass bool) (*Client, *websocket.Conn, int) {
+	t.Helper()
+	client, peer := wsClient(t, id, nil, len(room.GetClients())+1)
+	position := room.admitOrQueue(client, bypass)
+	if position == 0 {
+		s.enterRoom(client, room)
+	} else {
+		client.setWaiting(room)
+	}
+	return client, peer, position
+}
+
+func TestLobbyCapacity(t *testing.T) {
+	s := NewServer()
+	room := lobbyRoom(t, s, false)
+	clients := make(map[string]*Client)
+	tests := []struct {
+		id       string
+		bypass   bool
+		position int
+	}{
+		{"a", false, 0},
+		{"b", false, 0},
+		{"c", false, 1},
+		{"d", false, 2},
+		// Модератор заходит и в полную комнату
+		{"moderator", true, 0},
+	}
+	for _, tt := range tests {
+		client, _, position := queue(t, s, room, tt.id, tt.bypass)
+		if position != tt.position {
+			t.Errorf("%s: position %d, want %d", tt.id, position, tt.position)
+		}
+		clients[tt.id] = client
+	}
+
+	// Место не освободилось: в комнате всё ещё двое
+	s.leaveRoom(clients["a"], room)
+	if clients["c"].CurrentRoom() != nil {
+		t.Error("c admitted into a full room")
+	}
+	// Первым в очереди входит c, d ждёт дальше
+	s.leaveRoom(clients["b"], room)
+	if clients["c"].CurrentRoom() != room || clients["c"].waitingRoom() != nil {
+		t.Error("c not admitted after a place freed")
+	}
+	if clients["d"].CurrentRoom() != nil || clients["d"].waitingRoom() != room {
+		t.Error("d admitted ahead of the queue")
+	}
+}
+
+func TestLobbyApproval(t *testing.T) {
+	s := NewServer()
+	room := lobbyRoom(t, s, true)
+	guest, _, position := queue(t, s, room, "guest", false)
+	if position != 1 {
+		t.Fatalf("guest position %d, want 1", position)
+	}
+	// Место есть, но без модератора лобби никого не пускает
+	if s.admitFromLobby(room) || guest.CurrentRoom() != nil {
+		t.Fatal("guest admitted without approval")
+	}
+	if !room.approve("guest") || !s.admitFromLobby(room) || guest.CurrentRoom() != room {
+		t.Error("approved guest not admitted")
+	}
+}
+
+func TestCloseRoomWithLobby(t *testing.T) {
+	s := NewServer()
+	room := lobbyRoom(t, s, false)
+	var members []*Client
+	for _, id := range []string{"a", "b"} {
+		client, _, _ := queue(t, s, room, id, false)
+		members = append(members, client)
+	}
+	waiting, peer, _ := queue(t, s, room, "waiting", false)
+
+	s.closeRoom(room.ID)
+
+	// Уходящие из закрытой комнаты не освобождают место для очереди
+	if waiting.CurrentRoom() != nil || waiting.waitingRoom() != nil {
+		t.Error("waiting client admitted into the closed room")
+	}
+	if msg := readMessage(t, peer); msg.Type != MsgTypeRoomClosed {
+		t.Errorf("waiting client got %q, want %q", msg.Type, MsgTypeRoomClosed)
+	}
+	for _, client := range members {
+		if client.CurrentRoom() != nil {
+			t.Errorf("client %s still in the closed room", client.ID)
+		}
+	}
+}
@@ -2,26 +2,34 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/jmoiron/sqlx"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 	"golang.org/x/crypto/bcrypt"
-
-	_ "github.com/lib/pq"
 )
 
 // Константы для типов сообщений WebSocket
 const (
 	MsgTypeJoin            = "join"
 	MsgTypeOffer           = "offer"
+	MsgTypeAnswer          = "answer"
 	MsgTypeCandidate       = "candidate"
 	MsgTypeMute            = "mute"
 	MsgTypeUnmute          = "unmute"
@@ -32,7 +40,8 @@ const (
 )
 
 const (
-	userIdContextKey = "user_id"
+	userIdContextKey    = "user_id"
+	sessionIdContextKey = "session_id"
 )
 
 var (
@@ -41,33 +50,75 @@ var (
 	}
 	jwtSecret = []byte("your-secret-key") // Replace with your secret key
 	db        *sqlx.DB
+	cfg       Config
 )
 
 // WebSocketMessageDTO — structure for WebSocket messages
 type WebSocketMessageDTO struct {
-	Type           string                     `json:"type"`
-	RoomID         string                     `json:"roomId,omitempty"`
-	ClientID       string                     `json:"clientId,omitempty"`
-	SDP            *webrtc.SessionDescription `json:"sdp,omitempty"`
-	Candidate      *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
-	TargetClientID string                     `json:"targetClientId,omitempty"`
-	Volume         *float64                   `json:"volume,omitempty"`
-	Participants   []string                   `json:"participants,omitempty"`
-	Message        string                     `json:"message,omitempty"`
+	Type            string                     `json:"type"`
+	RoomID          string                     `json:"roomId,omitempty"`
+	ClientID        string                     `json:"clientId,omitempty"`
+	SDP             *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate       *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	TargetClientID  string                     `json:"targetClientId,omitempty"`
+	TargetClientIDs []string                   `json:"targetClientIds,omitempty"`
+	Volume          *float64                   `json:"volume,omitempty"`
+	Participants    []ParticipantDTO           `json:"participants,omitempty"`
+	Participant     *ParticipantDTO            `json:"participant,omitempty"`
+	Message         string                     `json:"message,omitempty"`
+	Code            string                     `json:"code,omitempty"`
+	Password        string                     `json:"password,omitempty"`
+	InviteToken     string                     `json:"inviteToken,omitempty"`
+	Visibility      string                     `json:"visibility,omitempty"`
+	Role            string                     `json:"role,omitempty"`
+	TargetUserID    int                        `json:"targetUserId,omitempty"`
+	DurationSeconds int                        `json:"durationSeconds,omitempty"` // срок бана, длительность breakout
+	Position        int                        `json:"position,omitempty"`        // место в очереди лобби
+	Count           int                        `json:"count,omitempty"`
+	Assignments     map[string]int             `json:"assignments,omitempty"` // clientId → номер breakout, 0 — основная
+	Randomize       bool                       `json:"randomize,omitempty"`
+	Breakouts       []BreakoutDTO              `json:"breakouts,omitempty"`
+	EndsAt          *time.Time                 `json:"endsAt,omitempty"`
+	Tracks          []TrackDTO                 `json:"tracks,omitempty"`
+	TrackSids       []string                   `json:"trackSids,omitempty"`
+	Quality         string                     `json:"quality,omitempty"`
+	AudioMode       string                     `json:"audioMode,omitempty"`
+	Score           float64                    `json:"score,omitempty"` // MOS качества соединения
 }
 
 // User — user structure
 type User struct {
-	ID       int    `db:"id"`
-	Username string `db:"username"`
-	Password string `db:"password"`
+	ID           int    `db:"id"`
+	Username     string `db:"username"`
+	Password     string `db:"password"`
+	TOTPSecret   string `db:"totp_secret"`
+	TOTPEnabled  bool   `db:"totp_enabled"`
+	TOTPLastStep int64  `db:"totp_last_step"`
+	DisplayName  string `db:"display_name"`
+	Avatar       string `db:"avatar"`
 }
 
 // Room — room structure
 type Room struct {
-	ID      string
-	Clients map[string]*Client
-	Mu      sync.Mutex
+	ID              string
+	Clients         map[string]*Client
+	ServerMuted     map[int]bool // по userID — переживает переподключение
+	Lobby           []*lobbyEntry
+	MaxParticipants int
+	LobbyEnabled    bool
+	StageMode       bool
+	StageRoles      map[int]string // временные роли на сцене по userID
+	PushToTalk      bool
+	LastN           int       // сколько самых громких спикеров слышит каждый, 0 — всех
+	AudioProfile    string    // voice или music — параметры Opus новых соединений
+	MaxAudioBitrate int       // потолок битрейта Opus, 0 — по профилю
+	speakersAt      time.Time // когда последний раз выбирали спикеров Last-N
+	speakersMu      sync.Mutex
+	AdHoc           bool      // нет записи в БД
+	PriorityUntil   time.Time // до этого момента говорит приоритетный спикер
+	Parent          *Room     // у breakout-комнаты — основная комната
+	Breakout        *breakoutSession
+	Mu              sync.Mutex
 }
 
 // Client — client structure
@@ -75,11 +126,38 @@ type Client struct {
 	ID             string
 	Room           *Room
 	PeerConnection *webrtc.PeerConnection
+	Estimator      cc.BandwidthEstimator // оценка канала к клиенту по TWCC, nil — нет
 	Conn           *websocket.Conn
 	MutedClients   map[string]bool
 	VolumeSettings map[string]float64
 	Mu             sync.Mutex
 	UserID         int
+	DisplayName    string
+	AvatarURL      string
+	Role           string
+	ServerMuted    bool
+	Waiting        *Room // лобби, в котором клиент ждёт входа
+	HandRaised     bool
+	SpeakInvited   bool // модератор позвал на сцену, ждём accept_speak
+	Talking        bool // держит push-to-talk
+	pttTimer       *time.Timer
+	pttSeq         int
+	Publications   map[string]*Publication // входящие дорожки по ID
+	Whisper        map[string]bool         // кому шепчет, nil — говорит всей комнате
+	Chat           *webrtc.DataChannel     // data channel чата
+	TrackSources   map[string]string       // источник по ID дорожки из track_info
+	VideoSelection map[string]bool         // какие видео получать по sid, nil — все
+	VideoQuality   map[string]string       // качество simulcast по sid, "" — для остальных
+	videoSubs      int                     // сколько видео пересылаем клиенту
+	AudioSlots     []*audioSlot            // дорожки Last-N, пусто — звук пересылается как есть
+	AudioMode      string                  // forward или mixed, пусто — forward
+	Mixer          *audioMixer             // сведение на сервере, nil — звук пересылается как есть
+	Quality        string                  // последний уровень качества соединения, о котором сказали комнате
+	Ingest         bool                    // WHIP-издатель: только публикует, без WebSocket и подписок
+	closed         chan struct{}           // закрывается, когда клиент отключился
+	negMu          sync.Mutex              // сериализует offer/answer с клиентом
+	negPending     bool                    // offer отложен до ответа клиента
+	writeMu        sync.Mutex
 }
 
 // Server — server structure
@@ -95,39 +173,14 @@ func NewServer() *Server {
 	}
 }
 
-// initDB — initialize database connection
-func initDB() {
-	var err error
-	db, err = sqlx.Connect(
-		"postgres",
-		"user=postgres password=postgres dbname=grok sslmode=disable host=localhost port=5432",
-	)
-	if err != nil {
-		slog.Error("connect to PostgreSQL", "error", err)
-		os.Exit(1)
-	}
-
-	db.MustExec(
-		`
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			username VARCHAR(255) UNIQUE NOT NULL,
-			password VARCHAR(255) NOT NULL
-		);
-		CREATE TABLE IF NOT EXISTS rooms (
-			id VARCHAR(255) PRIMARY KEY,
-			owner_id INT REFERENCES users(id)
-		);
-	`,
-	)
-	slog.Info("Database initialized")
-}
-
 // NewRoom — create a new room
 func NewRoom(id string) *Room {
 	return &Room{
-		ID:      id,
-		Clients: make(map[string]*Client),
+		ID:              id,
+		Clients:         make(map[string]*Client),
+		ServerMuted:     make(map[int]bool),
+		StageRoles:      make(map[int]string),
+		MaxParticipants: cfg.MaxRoomParticipants,
 	}
 }
 
@@ -158,6 +211,33 @@ func (r *Room) GetClients() map[string]*Client {
 	return clients
 }
 
+// Participants — participant list sorted by client ID
+func (r *Room) Participants() []ParticipantDTO {
+	clients := r.GetClients()
+	participants := make([]ParticipantDTO, 0, len(clients))
+	for _, client := range clients {
+		participants = append(participants, client.Participant())
+	}
+	sort.Slice(
+		participants, func(i, j int) bool {
+			return participants[i].ClientID < participants[j].ClientID
+		},
+	)
+	return participants
+}
+
+// Broadcast — send message to every client in the room except one
+func (r *Room) Broadcast(msg WebSocketMessageDTO, exceptClientID string) {
+	for id, client := range r.GetClients() {
+		if id == exceptClientID {
+			continue
+		}
+		if err := client.Send(msg); err != nil {
+			slog.Error("broadcast message", "type", msg.Type, "clientID", id, "error", err)
+		}
+	}
+}
+
 // NewClient — create a new client
 func NewClient(id string, room *Room, conn *websocket.Conn, userID int) *Client {
 	return &Client{
@@ -167,7 +247,35 @@ func NewClient(id string, room *Room, conn *websocket.Conn, userID int) *Client
 		MutedClients:   make(map[string]bool),
 		VolumeSettings: make(map[string]float64),
 		UserID:         userID,
+		Publications:   make(map[string]*Publication),
+		TrackSources:   make(map[string]string),
+		VideoQuality:   make(map[string]string),
+		closed:         make(chan struct{}),
+	}
+}
+
+// CurrentRoom — room the client is currently in
+func (c *Client) CurrentRoom() *Room {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Room
+}
+
+// setRoom — move client to another room
+func (c *Client) setRoom(room *Room) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.Room = room
+}
+
+// Send — write message to client WebSocket, safe for concurrent use
+func (c *Client) Send(msg WebSocketMessageDTO) error {
+	if c.Conn == nil {
+		return nil // у WHIP-издателя канала сигналинга нет
 	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteJSON(msg)
 }
 
 // MuteClient — mute a specific client
@@ -214,24 +322,113 @@ func (c *Client) GetVolume(clientID string) float64 {
 	return 1.0
 }
 
-// createPeerConnection — create WebRTC PeerConnection
-func createPeerConnection() (*webrtc.PeerConnection, error) {
+// newWebRTCAPI — WebRTC API with our codecs and the audio level header extension;
+// onEstimator, if set, receives the bandwidth estimator of each PeerConnection created by it
+func newWebRTCAPI(onEstimator func(cc.BandwidthEstimator)) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := registerCodecs(m); err != nil {
+		return nil, err
+	}
+	// RID-расширения нужны, чтобы принимать simulcast
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return nil, err
+	}
+	// По уровню звука определяем, говорит ли приоритетный спикер
+	if err := m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio,
+	); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := registerInterceptors(m, i, onEstimator); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
+
+// registerInterceptors — pion defaults minus the NACK responder and receiver reports, which the SFU does itself,
+// plus the TWCC bandwidth estimator
+func registerInterceptors(
+	m *webrtc.MediaEngine, i *interceptor.Registry, onEstimator func(cc.BandwidthEstimator),
+) error {
+	// NACK издателю шлёт pion, а на NACK подписчиков отвечаем из общего кэша публикации,
+	// чтобы не хранить копию каждого пакета на каждого подписчика
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	i.Add(generator)
+
+	// Sender report подписчикам — от pion, receiver report издателям собираем сами
+	sender, err := report.NewSenderInterceptor()
+	if err != nil {
+		return err
+	}
+	i.Add(sender)
+
+	// transport-cc согласован, поэтому Chrome шлёт TWCC вместо REMB:
+	// оценку канала к подписчику считаем сами (GCC). Пакеты не придерживаем —
+	// битрейт подстраиваем выбором слоя simulcast
+	estimator, err := cc.NewInterceptor(
+		func() (cc.BandwidthEstimator, error) {
+			return gcc.NewSendSideBWE(
+				gcc.SendSideBWEInitialBitrate(initialBandwidth),
+				gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+			)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if onEstimator != nil {
+		estimator.OnNewPeerConnection(
+			func(_ string, bwe cc.BandwidthEstimator) {
+				onEstimator(bwe)
+			},
+		)
+	}
+	i.Add(estimator)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return err
+	}
+
+	return webrtc.ConfigureTWCCSender(m, i)
+}
+
+// createPeerConnection — create WebRTC PeerConnection and its bandwidth estimator
+func createPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
 	config := webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{URLs: []string{"stun:stun.l.google.com:19302"}},
 		},
 	}
-	pc, err := webrtc.NewPeerConnection(config)
+	// pion отдаёт оценщик через callback без привязки к соединению, поэтому
+	// у каждого PeerConnection свой API и свой набор interceptor'ов
+	var estimator cc.BandwidthEstimator
+	api, err := newWebRTCAPI(
+		func(bwe cc.BandwidthEstimator) {
+			estimator = bwe
+		},
+	)
+	if err != nil {
+		slog.Error("create WebRTC API", "error", err)
+		return nil, nil, err
+	}
+	pc, err := api.NewPeerConnection(config)
 	if err != nil {
 		slog.Error("create PeerConnection", "error", err)
-		return nil, err
+		return nil, nil, err
 	}
 	slog.Info("PeerConnection created")
-	return pc, nil
+	return pc, estimator, nil
 }
 
-// handleOffer — handle SDP offer
-func handleOffer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+// handleOffer — handle SDP offer, asking for Opus with the parameters in the answer
+func handleOffer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription, fmtp string) (
+	webrtc.SessionDescription, error,
+) {
 	if err := pc.SetRemoteDescription(offer); err != nil {
 		slog.Error("set remote description", "error", err)
 		return webrtc.SessionDescription{}, err
@@ -246,7 +443,7 @@ func handleOffer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription) (we
 		return webrtc.SessionDescription{}, err
 	}
 	slog.Info("Answer created")
-	return answer, nil
+	return withAudioParams(answer, fmtp), nil
 }
 
 // addICECandidate — add ICE candidate
@@ -259,87 +456,6 @@ func addICECandidate(pc *webrtc.PeerConnection, candidate webrtc.ICECandidateIni
 	return nil
 }
 
-// forwardTrack — forward audio track to other clients
-func forwardTrack(sender *Client, track *webrtc.TrackRemote) {
-	clients := sender.Room.GetClients()
-	for id, client := range clients {
-		if id == sender.ID || client.PeerConnection == nil {
-			continue
-		}
-		if client.IsMuted(sender.ID) {
-			slog.Info("Skipping muted client", "clientID", id)
-			continue
-		}
-		volume := client.GetVolume(sender.ID)
-		slog.Info("Forwarding track", "from", sender.ID, "to", id, "volume", volume)
-
-		localTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, "audio", "stream_"+sender.ID)
-		if err != nil {
-			slog.Error("create local track", "error", err)
-			continue
-		}
-		senderTrack, err := client.PeerConnection.AddTrack(localTrack)
-		if err != nil {
-			slog.Error("add track", "error", err)
-			continue
-		}
-
-		go func(tLocal *webrtc.TrackLocalStaticRTP) {
-			for {
-				pkt, _, err := track.ReadRTP()
-				if err != nil {
-					slog.Error("read RTP", "error", err)
-					break
-				}
-				if err := tLocal.WriteRTP(pkt); err != nil {
-					slog.Error("write RTP", "error", err)
-					break
-				}
-			}
-			if client.PeerConnection != nil {
-				client.PeerConnection.RemoveTrack(senderTrack)
-			}
-			slog.Info("Track forwarding stopped", "from", sender.ID, "to", id)
-		}(localTrack)
-	}
-}
-
-// generateJWT — generate JWT token
-func generateJWT(userID int) (string, error) {
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256, jwt.MapClaims{
-			"user_id": userID,
-			"exp":     time.Now().Add(time.Hour * 24).Unix(),
-		},
-	)
-	return token.SignedString(jwtSecret)
-}
-
-// validateJWT — validate JWT token
-func validateJWT(tokenString string) (int, error) {
-	token, err := jwt.Parse(
-		tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return jwtSecret, nil
-		},
-	)
-	if err != nil {
-		return 0, err
-	}
-
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		userIDFloat, ok := claims["user_id"].(float64)
-		if !ok {
-			return 0, jwt.ErrTokenInvalidClaims
-		}
-		return int(userIDFloat), nil
-	}
-
-	return 0, jwt.ErrTokenInvalidClaims
-}
-
 // registerUser — register user via REST
 func registerUser(w http.ResponseWriter, r *http.Request) {
 	var creds struct {
@@ -351,6 +467,13 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fields := validateUsername(creds.Username)
+	fields = append(fields, validatePassword(creds.Password, creds.Username)...)
+	if len(fields) > 0 {
+		writeValidationErrors(w, fields)
+		return
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
@@ -370,24 +493,12 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 	}
 	slog.Info("User registered", "username", creds.Username)
 
-	token, err := generateJWT(userID)
-	if err != nil {
+	if err := startSession(w, userID); err != nil {
+		slog.Error("start session", "userID", userID, "error", err)
 		http.Error(w, "generate token", http.StatusInternalServerError)
 		return
 	}
 
-	http.SetCookie(
-		w, &http.Cookie{
-			Name:     "token",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   false, // Только HTTPS (отключите для localhost)
-			SameSite: http.SameSiteStrictMode,
-			MaxAge:   86400, // 24 часа
-		},
-	)
-
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -402,128 +513,221 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkLoginAllowed(w, r, creds.Username) {
+		return
+	}
+
 	var user User
 	err := db.Get(&user, "SELECT * FROM users WHERE username=$1", creds.Username)
 	if err != nil {
 		slog.Error("User not found", "username", creds.Username, "error", err)
+		registerLoginFailure(r, creds.Username)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password)); err != nil {
 		slog.Error("Invalid password", "username", creds.Username)
+		registerLoginFailure(r, creds.Username)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	token, err := generateJWT(user.ID)
-	if err != nil {
+	if user.TOTPEnabled {
+		// Второй шаг: cookie выдаём только после POST /login/totp
+		mfaToken, err := generateMFAToken(user.ID)
+		if err != nil {
+			http.Error(w, "generate token", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Password accepted, TOTP required", "username", creds.Username)
+		writeJSON(
+			w, http.StatusAccepted, map[string]interface{}{
+				"mfaRequired": true,
+				"mfaToken":    mfaToken,
+			},
+		)
+		return
+	}
+
+	if err := startSession(w, user.ID); err != nil {
+		slog.Error("start session", "userID", user.ID, "error", err)
 		http.Error(w, "generate token", http.StatusInternalServerError)
 		return
 	}
+	loginGuard.Succeed(creds.Username)
 	slog.Info("User logged in", "username", creds.Username)
 
-	http.SetCookie(
-		w, &http.Cookie{
-			Name:     "token",
-			Value:    token,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   false, // Только HTTPS (отключите для localhost)
-			SameSite: http.SameSiteStrictMode,
-			MaxAge:   86400, // 24 часа
-		},
-	)
-
 	w.WriteHeader(http.StatusOK)
 }
 
-func RoomsList(w http.ResponseWriter, r *http.Request) {
-	// todo тут ещё добавить where есть user_id
-	rows, err := db.Queryx("SELECT id FROM rooms")
-	if err != nil {
-		slog.Error("load rooms", "error", err)
-		return
+// writeJSON — write JSON response with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("encode response", "error", err)
 	}
-	defer rows.Close()
+}
 
-	rooms := make([]Room, 0)
-	for rows.Next() {
-		var room Room
-		if err := rows.Scan(&room); err != nil {
-			slog.Error("scan room", "error", err)
-			continue
-		}
+// createRoomViaWebSocket — create room via WebSocket
+func (s *Server) createRoomViaWebSocket(userID int, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	visibility := msg.Visibility
+	if visibility == "" {
+		visibility = RoomVisibilityPublic
+	}
+	fields := validateRoomID(msg.RoomID)
+	fields = append(fields, validateVisibility(visibility)...)
+	if len(fields) > 0 {
+		return WebSocketMessageDTO{Type: MsgTypeError, Code: fields[0].Code, Message: fields[0].Message}
+	}
 
+	rec := RoomRecord{
+		ID:           msg.RoomID,
+		OwnerID:      sql.NullInt64{Int64: int64(userID), Valid: true},
+		Visibility:   visibility,
+		AudioProfile: AudioProfileVoice,
+	}
+	err := s.createRoom(&rec, msg.Password)
+	if errors.Is(err, errRoomExists) {
+		return WebSocketMessageDTO{Type: MsgTypeError, Message: "Room already exists"}
+	}
+	if err != nil {
+		slog.Error("create room", "roomID", msg.RoomID, "error", err)
+		return WebSocketMessageDTO{Type: MsgTypeError, Message: "create room"}
 	}
 
-	json.NewEncoder(w).Encode(rooms)
+	return WebSocketMessageDTO{Type: MsgTypeRoomCreated, RoomID: msg.RoomID, Message: "Room created successfully"}
 }
 
-// переделать под REST
+// joinRoom — authorize and move client into the requested room
+func (s *Server) joinRoom(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	rec, err := authorizeJoin(client.UserID, msg.RoomID, msg.Password, msg.InviteToken)
+	if err != nil {
+		return joinError(err)
+	}
+	role, err := roomRole(rec, client.UserID)
+	if err != nil {
+		return joinError(err)
+	}
+
+	room := s.getOrCreateRoom(msg.RoomID)
+	if other, ok := room.findClient(client.ID); ok && other != client {
+		return WebSocketMessageDTO{
+			Type:    MsgTypeError,
+			Code:    JoinErrClientIDTaken,
+			Message: "clientId already in use in this room",
+		}
+	}
 
-// createRoomViaWebSocket — create room via WebSocket
-func (s *Server) createRoomViaWebSocket(client *Client, msg WebSocketMessageDTO) (WebSocketMessageDTO, error) {
-	if msg.RoomID == "" {
-		return WebSocketMessageDTO{Type: MsgTypeError, Message: "Missing roomId"}, nil
+	room.configure(rec)
+	client.setRole(room.stageRole(client.UserID, role))
+	client.resetTalking()
+	client.setServerMuted(room.IsServerMuted(client.UserID))
+
+	if client.CurrentRoom() == room {
+		return WebSocketMessageDTO{Type: MsgTypeParticipants, RoomID: room.ID, Participants: room.Participants()}
+	}
+	if client.waitingRoom() == room {
+		s.notifyLobby(room)
+		return WebSocketMessageDTO{}
 	}
 
-	_, err := db.Exec(
-		"INSERT INTO rooms (id, owner_id) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING",
-		msg.RoomID,
-		client.UserID,
-	)
-	if err != nil {
-		slog.Error("create room", "roomID", msg.RoomID, "error", err)
-		return WebSocketMessageDTO{Type: MsgTypeError, Message: "create room"}, nil
+	if old := client.CurrentRoom(); old != nil {
+		s.leaveRoom(client, old)
+		client.setRoom(nil)
+	}
+	s.leaveLobby(client)
+
+	// Модераторы проходят мимо лобби и лимита — иначе некому будет впускать
+	isModerator := roleRank[role] >= roleRank[RoomRoleModerator]
+	if position := room.admitOrQueue(client, isModerator); position > 0 {
+		client.setWaiting(room)
+		slog.Info("Client waiting in lobby", "clientID", client.ID, "roomID", room.ID, "position", position)
+		s.notifyLobby(room)
+		return WebSocketMessageDTO{}
+	}
+	s.enterRoom(client, room)
+	if isModerator {
+		s.sendLobby(client, room)
 	}
-	slog.Info("Permanent room created", "roomID", msg.RoomID, "ownerID", client.UserID)
 
-	s.RoomsMu.Lock()
-	s.Rooms[msg.RoomID] = NewRoom(msg.RoomID)
-	s.RoomsMu.Unlock()
+	return WebSocketMessageDTO{Type: MsgTypeParticipants, RoomID: room.ID, Participants: room.Participants()}
+}
 
-	return WebSocketMessageDTO{Type: "room_created", Message: "Room created successfully"}, nil
+// enterRoom — finish moving client into the room after it was added to Clients
+func (s *Server) enterRoom(client *Client, room *Room) {
+	client.setRoom(room)
+	// Из breakout в основную комнату клиент возвращается с её ролью на сцене
+	s.syncStageRole(client, room)
+	announceMedia(client, room)
+	s.attachMedia(client, room)
+	slog.Info("Client added to room", "clientID", client.ID, "roomID", room.ID)
+	room.Broadcast(
+		WebSocketMessageDTO{
+			Type:        MsgTypeParticipantJoined,
+			RoomID:      room.ID,
+			Participant: ptr(client.Participant()),
+		}, client.ID,
+	)
+}
+
+// leaveRoom — remove client from room, notify the rest and let the lobby in
+func (s *Server) leaveRoom(client *Client, room *Room) {
+	s.exitRoom(client, room)
+	// Место освободилось в основной комнате, даже если клиент был в breakout
+	s.admitFromLobby(room.root())
+}
+
+// exitRoom — remove client from the room without letting anyone in from the lobby
+func (s *Server) exitRoom(client *Client, room *Room) {
+	s.stopWhisper(client, room)
+	s.detachMedia(client, room)
+	room.RemoveClient(client.ID)
+	room.Broadcast(
+		WebSocketMessageDTO{
+			Type:        MsgTypeParticipantLeft,
+			RoomID:      room.ID,
+			Participant: ptr(client.Participant()),
+		}, client.ID,
+	)
 }
 
 // handleSignaling — handle WebSocket signaling messages
 func (s *Server) handleSignaling(client *Client, msg WebSocketMessageDTO) (WebSocketMessageDTO, error) {
+	if client.CurrentRoom() == nil && msg.Type != MsgTypeJoin && msg.Type != MsgTypeCreateRoom {
+		return WebSocketMessageDTO{Type: MsgTypeError, Message: "Join a room first"}, nil
+	}
+
 	switch msg.Type {
 	case MsgTypeCreateRoom:
-		return s.createRoomViaWebSocket(client, msg)
+		return s.createRoomViaWebSocket(client.UserID, msg), nil
 
 	case MsgTypeJoin:
-		s.RoomsMu.Lock()
-		room, ok := s.Rooms[msg.RoomID]
-		if !ok {
-			room = NewRoom(msg.RoomID)
-			s.Rooms[msg.RoomID] = room
-		}
-		s.RoomsMu.Unlock()
-		room.AddClient(client)
-
-		clients := room.GetClients()
-		participants := make([]string, 0, len(clients))
-		for id := range clients {
-			participants = append(participants, id)
-		}
-		return WebSocketMessageDTO{Type: "participants", Participants: participants}, nil
+		return s.joinRoom(client, msg), nil
 
 	case MsgTypeOffer:
-		if client.PeerConnection == nil {
-			pc, err := createPeerConnection()
+		// После kick соединение закрыто сервером — поднимаем новое
+		if pc := client.peer(); pc == nil || pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			pc, estimator, err := createPeerConnection()
 			if err != nil {
 				return WebSocketMessageDTO{
 					Type:    MsgTypeError,
 					Message: "create connection: " + err.Error(),
 				}, nil
 			}
-			client.PeerConnection = pc
+			client.setPeer(pc, estimator)
 
 			pc.OnTrack(
 				func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 					slog.Info("Track received", "clientID", client.ID)
-					forwardTrack(client, track)
+					forwardTrack(client, track, receiver)
+				},
+			)
+
+			pc.OnDataChannel(
+				func(dc *webrtc.DataChannel) {
+					s.acceptDataChannel(client, dc)
 				},
 			)
 
@@ -531,7 +735,7 @@ func (s *Server) handleSignaling(client *Client, msg WebSocketMessageDTO) (WebSo
 				func(c *webrtc.ICECandidate) {
 					if c != nil {
 						slog.Info("Sending ICE candidate", "candidate", c.ToJSON())
-						if err := client.Conn.WriteJSON(
+						if err := client.Send(
 							WebSocketMessageDTO{
 								Type: MsgTypeCandidate,
 								// TODO костылик временно
@@ -547,17 +751,32 @@ func (s *Server) handleSignaling(client *Client, msg WebSocketMessageDTO) (WebSo
 				},
 			)
 		}
-		answer, err := handleOffer(client.PeerConnection, *msg.SDP)
+		answer, err := client.acceptOffer(*msg.SDP)
 		if err != nil {
 			return WebSocketMessageDTO{Type: MsgTypeError, Message: "process offer: " + err.Error()}, nil
 		}
-		return WebSocketMessageDTO{Type: "answer", SDP: &answer}, nil
+		// Сначала answer, потом наши offer с дорожками комнаты — иначе клиент получит их не по порядку
+		if err := client.Send(WebSocketMessageDTO{Type: MsgTypeAnswer, SDP: &answer}); err != nil {
+			return WebSocketMessageDTO{}, err
+		}
+		if room := client.CurrentRoom(); room != nil {
+			s.attachMedia(client, room)
+		}
+		client.flushNegotiation()
+		return WebSocketMessageDTO{}, nil
+
+	case MsgTypeAnswer:
+		if err := client.acceptAnswer(*msg.SDP); err != nil {
+			return WebSocketMessageDTO{Type: MsgTypeError, Message: "process answer: " + err.Error()}, nil
+		}
+		return WebSocketMessageDTO{}, nil
 
 	case MsgTypeCandidate:
-		if client.PeerConnection == nil {
+		pc := client.peer()
+		if pc == nil {
 			return WebSocketMessageDTO{Type: MsgTypeError, Message: "PeerConnection not initialized"}, nil
 		}
-		if err := addICECandidate(client.PeerConnection, *msg.Candidate); err != nil {
+		if err := addICECandidate(pc, *msg.Candidate); err != nil {
 			return WebSocketMessageDTO{Type: MsgTypeError, Message: "add candidate: " + err.Error()}, nil
 		}
 		return WebSocketMessageDTO{}, nil
@@ -576,13 +795,44 @@ func (s *Server) handleSignaling(client *Client, msg WebSocketMessageDTO) (WebSo
 			return WebSocketMessageDTO{Type: "volume_ack"}, nil
 		}
 
+	case MsgTypeServerMute, MsgTypeServerUnmute, MsgTypeKick, MsgTypeBan, MsgTypeUnban, MsgTypeSetRole,
+		MsgTypeTransferOwnership:
+		return s.moderate(client, msg), nil
+
+	case MsgTypeAdmit, MsgTypeDeny:
+		return s.moderateLobby(client, msg), nil
+
+	case MsgTypeBreakoutStart, MsgTypeBreakoutAssign, MsgTypeBreakoutEnd:
+		return s.handleBreakout(client, msg), nil
+
+	case MsgTypeTrackInfo:
+		return s.handleTrackInfo(client, msg), nil
+
+	case MsgTypeSelectVideo:
+		return s.handleSelectVideo(client, msg), nil
+
+	case MsgTypeSetVideoQuality:
+		return s.handleSetVideoQuality(client, msg), nil
+
+	case MsgTypeSetAudioMode:
+		return s.handleSetAudioMode(client, msg), nil
+
+	case MsgTypeWhisper, MsgTypeWhisperStop:
+		return s.handleWhisper(client, msg), nil
+
+	case MsgTypePTTStart, MsgTypePTTStop:
+		return s.handlePTT(client, msg), nil
+
+	case MsgTypeRaiseHand, MsgTypeLowerHand, MsgTypeInviteToSpeak, MsgTypeAcceptSpeak, MsgTypeDeclineSpeak,
+		MsgTypeMoveToAudience:
+		return s.handleStage(client, msg), nil
+
 	case MsgTypeGetParticipants:
-		clients := client.Room.GetClients()
-		participants := make([]string, 0, len(clients))
-		for id := range clients {
-			participants = append(participants, id)
+		room := client.CurrentRoom()
+		if room == nil {
+			return WebSocketMessageDTO{Type: MsgTypeError, Message: "Not in a room"}, nil
 		}
-		return WebSocketMessageDTO{Type: "participants", Participants: participants}, nil
+		return WebSocketMessageDTO{Type: MsgTypeParticipants, RoomID: room.ID, Participants: room.Participants()}, nil
 	}
 	return WebSocketMessageDTO{}, nil
 }
@@ -596,6 +846,17 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	if sessionID, ok := r.Context().Value(sessionIdContextKey).(string); ok {
+		sessions.Track(sessionID, conn)
+		defer sessions.Untrack(sessionID, conn)
+	}
+
+	userID, ok := currentUserID(r)
+	if !ok {
+		conn.WriteJSON(WebSocketMessageDTO{Type: MsgTypeError, Message: "User ID not found"})
+		return
+	}
+
 	// Read initial message
 	var msg WebSocketMessageDTO
 	if err := conn.ReadJSON(&msg); err != nil {
@@ -611,40 +872,20 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	// Handle "create_room" message
 	if msg.Type == MsgTypeCreateRoom {
-		resp, err := s.createRoomViaWebSocket(nil, msg)
-		if err != nil {
-			conn.WriteJSON(WebSocketMessageDTO{Type: MsgTypeError, Message: err.Error()})
-			return
-		}
-		conn.WriteJSON(resp)
+		conn.WriteJSON(s.createRoomViaWebSocket(userID, msg))
 		return
 	}
 
 	// Handle "join" message
-	s.RoomsMu.Lock()
-	room, ok := s.Rooms[msg.RoomID]
-	if !ok {
-		room = NewRoom(msg.RoomID)
-		s.Rooms[msg.RoomID] = room
+	client := NewClient(msg.ClientID, nil, conn, userID)
+	loadParticipantProfile(client)
+	defer s.cleanupClient(client)
+	go client.monitorQuality()
+
+	// При отказе соединение не рвём: клиент может повторить join с паролем
+	if response := s.joinRoom(client, msg); response.Type != "" {
+		client.Send(response)
 	}
-	s.RoomsMu.Unlock()
-
-	userID, ok := r.Context().Value(userIdContextKey).(int)
-	if !ok {
-		conn.WriteJSON(WebSocketMessageDTO{Type: MsgTypeError, Message: "User ID not found"})
-		return
-	}
-
-	client := NewClient(msg.ClientID, room, conn, userID)
-	room.AddClient(client)
-	defer s.cleanupClient(client, msg.RoomID)
-
-	response, err := s.handleSignaling(client, msg)
-	if err != nil {
-		conn.WriteJSON(WebSocketMessageDTO{Type: MsgTypeError, Message: err.Error()})
-		return
-	}
-	conn.WriteJSON(response)
 
 	// Main message loop
 	for {
@@ -657,50 +898,69 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 		response, err := s.handleSignaling(client, innerMsg)
 		if err != nil {
-			conn.WriteJSON(WebSocketMessageDTO{Type: MsgTypeError, Message: err.Error()})
+			client.Send(WebSocketMessageDTO{Type: MsgTypeError, Message: err.Error()})
 			continue
 		}
 		if response.Type != "" {
-			conn.WriteJSON(response)
+			client.Send(response)
 		}
 	}
 }
 
 // cleanupClient — cleanup client on disconnect
-func (s *Server) cleanupClient(client *Client, roomID string) {
-	if client.PeerConnection != nil {
-		client.PeerConnection.Close()
+func (s *Server) cleanupClient(client *Client) {
+	close(client.closed)
+	if pc := client.peer(); pc != nil {
+		pc.Close()
 	}
-	client.Room.RemoveClient(client.ID)
-	slog.Info("Client disconnected", "clientID", client.ID, "roomID", roomID)
+	s.leaveLobby(client)
+	client.resetTalking()
+	room := client.CurrentRoom()
+	if room == nil {
+		return
+	}
+	s.leaveRoom(client, room)
+	slog.Info("Client disconnected", "clientID", client.ID, "roomID", room.ID)
 }
 
 // authMiddleware — middleware for JWT authentication
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			cookie, err := r.Cookie("token")
-			if err != nil {
-				slog.Error("Token not found in cookies", "error", err)
-				http.Error(w, "Token not found", http.StatusUnauthorized)
-				return
+			// Браузер шлёт токен в cookie, OBS и прочие WHIP-клиенты — в Authorization: Bearer
+			token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !isBearer {
+				cookie, err := r.Cookie(accessCookieName)
+				if err != nil {
+					slog.Error("Token not found in cookies", "error", err)
+					http.Error(w, "Token not found", http.StatusUnauthorized)
+					return
+				}
+				token = cookie.Value
 			}
 
-			if cookie.Value == "" {
+			if token == "" {
 				slog.Error("Authorization token required")
 				http.Error(w, "Authorization token required", http.StatusUnauthorized)
 				return
 			}
 
-			userID, err := validateJWT(cookie.Value)
+			userID, sessionID, err := validateJWT(token)
 			if err != nil {
 				slog.Error("Invalid token", "error", err)
 				http.Error(w, "Invalid token", http.StatusUnauthorized)
 				return
 			}
 
-			r.WithContext(context.WithValue(r.Context(), userIdContextKey, userID))
-			next.ServeHTTP(w, r)
+			if sessions.IsRevoked(sessionID) {
+				slog.Warn("Revoked session used", "sessionID", sessionID, "userID", userID)
+				http.Error(w, "Session revoked", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userIdContextKey, userID)
+			ctx = context.WithValue(ctx, sessionIdContextKey, sessionID)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		},
 	)
 }
@@ -723,7 +983,17 @@ func main() {
 			),
 		),
 	)
-	initDB()
+	cfg = loadConfig()
+	initDB(cfg.DatabaseDSN)
+	if err := loadRevokedSessions(); err != nil {
+		slog.Error("load revoked sessions", "error", err)
+		os.Exit(1)
+	}
+	// API собирается заново на каждый PeerConnection, здесь только проверяем настройку
+	if _, err := newWebRTCAPI(nil); err != nil {
+		slog.Error("init WebRTC", "error", err)
+		os.Exit(1)
+	}
 	server := NewServer()
 
 	mux := http.NewServeMux()
@@ -731,17 +1001,48 @@ func main() {
 	// Для SSR
 	mux.Handle("/", http.FileServer(http.Dir("./frontend")))
 
-	mux.Handle("POST /register", http.HandlerFunc(registerUser))
-	mux.Handle("POST /login", http.HandlerFunc(loginUser))
-	mux.Handle("GET /rooms", authMiddleware(http.HandlerFunc(RoomsList)))
+	mux.Handle("POST /register", rateLimitByIP(registerIPLimiter, http.HandlerFunc(registerUser)))
+	mux.Handle("POST /login", rateLimitByIP(loginIPLimiter, http.HandlerFunc(loginUser)))
+	mux.Handle("POST /login/totp", rateLimitByIP(loginIPLimiter, http.HandlerFunc(loginTOTP)))
+	mux.Handle("POST /logout", http.HandlerFunc(logoutUser))
+	mux.Handle("POST /token/refresh", http.HandlerFunc(refreshTokens))
+	if cfg.OIDCIssuer != "" {
+		oidcProvider, err := NewOIDCProvider(context.Background(), cfg)
+		if err != nil {
+			slog.Error("init OIDC provider", "error", err)
+			os.Exit(1)
+		}
+		mux.Handle("GET /auth/oidc/login", http.HandlerFunc(oidcProvider.handleLogin))
+		mux.Handle("GET /auth/oidc/callback", http.HandlerFunc(oidcProvider.handleCallback))
+		slog.Info("OIDC login enabled", "issuer", cfg.OIDCIssuer)
+	}
+	mux.Handle("GET /me", authMiddleware(http.HandlerFunc(getMe)))
+	mux.Handle("POST /account/password", authMiddleware(http.HandlerFunc(changePassword)))
+	mux.Handle("DELETE /account", authMiddleware(http.HandlerFunc(server.deleteAccount)))
+	mux.Handle("PATCH /account/profile", authMiddleware(http.HandlerFunc(server.updateProfile)))
+	mux.Handle("POST /account/avatar", authMiddleware(http.HandlerFunc(server.uploadAvatar)))
+	mux.Handle("DELETE /account/avatar", authMiddleware(http.HandlerFunc(server.deleteAvatar)))
+	mux.Handle("GET /avatars/", authMiddleware(serveAvatars()))
+	mux.Handle("POST /account/totp/enroll", authMiddleware(http.HandlerFunc(enrollTOTP)))
+	mux.Handle("POST /account/totp/confirm", authMiddleware(http.HandlerFunc(confirmTOTP)))
+	mux.Handle("POST /account/totp/disable", authMiddleware(http.HandlerFunc(disableTOTP)))
+	mux.Handle("GET /rooms", authMiddleware(http.HandlerFunc(server.RoomsList)))
+	mux.Handle("POST /rooms", authMiddleware(http.HandlerFunc(server.createRoomREST)))
+	mux.Handle("PATCH /rooms/{id}", authMiddleware(http.HandlerFunc(server.updateRoom)))
+	mux.Handle("POST /rooms/{id}/invites", authMiddleware(http.HandlerFunc(server.createInvite)))
+	mux.Handle("GET /rooms/{id}/messages", authMiddleware(http.HandlerFunc(server.roomMessages)))
+	mux.Handle("GET /admin/rooms/{id}/stats", authMiddleware(adminOnly(http.HandlerFunc(server.roomStats))))
 	mux.Handle("/ws", authMiddleware(http.HandlerFunc(server.handleWebSocket)))
+	mux.Handle("POST /whip/{room}", authMiddleware(http.HandlerFunc(server.whipPublish)))
+	mux.Handle("PATCH /whip/{room}/{session}", authMiddleware(http.HandlerFunc(server.whipTrickle)))
+	mux.Handle("DELETE /whip/{room}/{session}", authMiddleware(http.HandlerFunc(server.whipDelete)))
 
 	srv := http.Server{
-		Addr:    ":8080",
+		Addr:    cfg.Addr,
 		Handler: mux,
 	}
 
-	slog.Info("Server started on :8080")
+	slog.Info("Server started", "addr", cfg.Addr)
 	if err := srv.ListenAndServe(); err != nil {
 		slog.Error("Server error", "error", err)
 	}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var errNoPeerConnection = errors.New("PeerConnection not initialized")
+
+// Publication — incoming track of a client, read once and fanned out to subscriptions
+type Publication struct {
+	ID         string
+	Publisher  *Client
+	Track      *webrtc.TrackRemote // первая пришедшая дорожка: по ней kind и кодек
+	Source     string
+	Simulcast  bool // издатель шлёт несколько RID-слоёв
+	levelExtID uint8
+	layers     []*simulcastLayer
+	subs       map[string]*Subscription // по ID клиента-подписчика
+	loudness   float64                  // сглаженная громкость для Last-N
+	lastVoice  time.Time
+	reportSSRC uint32        // наш SSRC в receiver report издателю
+	done       chan struct{} // закрывается, когда кончились все слои
+	mu         sync.Mutex
+}
+
+// Subscription — copy of a publication forwarded into a subscriber PeerConnection
+type Subscription struct {
+	Subscriber *Client
+	Local      *webrtc.TrackLocalStaticRTP
+	Sender     *webrtc.RTPSender
+	mu         sync.Mutex
+	rewriter   rtpRewriter      // источник — RID слоя, который получает подписчик
+	slot       bool             // дорожка Last-N: при отписке переключается, а не удаляется
+	mix        *mixInput        // звук идёт в сведение подписчика, своей дорожки нет
+	target     string           // RID, на который переключимся на ближайшем keyframe
+	bandwidth  uint64           // REMB подписчика, бит/с: запасная оценка, если нет TWCC; 0 — не присылал
+	report     downstreamReport // последний отчёт подписчика о его копии
+	red        bool             // RED издателя идёт подписчику как есть, иначе срезаем до основного Opus
+}
+
+// peer — current PeerConnection of the client, nil before the first offer
+func (c *Client) peer() *webrtc.PeerConnection {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.PeerConnection
+}
+
+// setPeer — replace PeerConnection of the client together with its bandwidth estimator
+func (c *Client) setPeer(pc *webrtc.PeerConnection, estimator cc.BandwidthEstimator) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.PeerConnection = pc
+	c.Estimator = estimator
+}
+
+// opusFmtp — Opus parameters of the client room, "" outside rooms; applied on the next offer or answer
+func (c *Client) opusFmtp() string {
+	if room := c.CurrentRoom(); room != nil {
+		return room.opusFmtp()
+	}
+	return ""
+}
+
+// bandwidth — TWCC estimate of the connection to the client, bit/s; 0 if unknown
+func (c *Client) bandwidth() uint64 {
+	c.Mu.Lock()
+	estimator := c.Estimator
+	c.Mu.Unlock()
+	if estimator == nil {
+		return 0
+	}
+	return uint64(estimator.GetTargetBitrate())
+}
+
+// publications — snapshot of tracks the client publishes
+func (c *Client) publications() []*Publication {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	pubs := make([]*Publication, 0, len(c.Publications))
+	for _, pub := range c.Publications {
+		pubs = append(pubs, pub)
+	}
+	return pubs
+}
+
+// forwardTrack — publish incoming track and fan it out to the room
+func forwardTrack(sender *Client, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	layer := &simulcastLayer{RID: track.RID(), Track: track}
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		layer.cache = &packetCache{}
+	}
+	source := sender.trackSource(track.ID(), track.Kind())
+	sender.Mu.Lock()
+	// Слои simulcast приходят отдельными OnTrack с тем же ID дорожки
+	if pub, ok := sender.Publications[track.ID()]; ok && pub.Simulcast && track.RID() != "" {
+		sender.Mu.Unlock()
+		pub.addLayer(layer)
+		go pub.readSenderReports(layer, receiver)
+		return
+	}
+	pub := &Publication{
+		ID:         track.ID(),
+		Publisher:  sender,
+		Track:      track,
+		Source:     source,
+		Simulcast:  track.RID() != "",
+		levelExtID: audioLevelExtensionID(receiver),
+		layers:     []*simulcastLayer{layer},
+		subs:       make(map[string]*Subscription),
+		reportSSRC: rand.Uint32(),
+		done:       make(chan struct{}),
+	}
+	sender.Publications[pub.ID] = pub
+	sender.Mu.Unlock()
+	slog.Info(
+		"Track published",
+		"clientID", sender.ID, "trackID", pub.ID, "kind", track.Kind(), "source", pub.Source, "rid", layer.RID,
+	)
+
+	if room := sender.CurrentRoom(); room != nil {
+		announceTrack(room, pub, MsgTypeTrackPublished)
+		for id, client := range room.GetClients() {
+			if id != sender.ID {
+				pub.subscribe(client)
+			}
+		}
+	}
+	go pub.run(layer)
+	go pub.readSenderReports(layer, receiver)
+	go pub.sendReceiverReports()
+}
+
+// run — read a layer and write every packet to the subscriptions allowed to get it
+func (p *Publication) run(layer *simulcastLayer) {
+	codec := p.Track.Codec()
+	for {
+		pkt, _, err := layer.Track.ReadRTP()
+		if err != nil {
+			slog.Info("Track ended", "clientID", p.Publisher.ID, "trackID", p.ID, "rid", layer.RID, "error", err)
+			break
+		}
+		if p.measure(layer, pkt, codec.ClockRate) {
+			p.rebalance()
+		}
+		// Проверяем на каждом пакете: роль, mute и PTT могут смениться посреди потока
+		room := p.Publisher.CurrentRoom()
+		if room == nil || !p.allowed(room, pkt) {
+			for _, sub := range p.subscriptions() {
+				sub.skip(layer.RID, pkt)
+			}
+			continue
+		}
+		if isOpus(codec.MimeType) {
+			p.trackLevel(pkt)
+			room.maybeSelectSpeakers()
+		}
+		// Без simulcast переключаться некуда — любой пакет годится
+		switchPoint := !p.Simulcast || isKeyframe(codec.MimeType, pkt.Payload)
+		primary := p.primary(pkt)
+		for _, sub := range p.subscriptions() {
+			out := pkt
+			if codec.MimeType == mimeTypeRED && !sub.red {
+				out = primary
+			}
+			if out == nil || !p.delivers(room, sub.Subscriber) {
+				sub.skip(layer.RID, pkt)
+				continue
+			}
+			if err := sub.forward(layer.RID, out, switchPoint, codec.ClockRate); err != nil {
+				slog.Error("write RTP", "from", p.Publisher.ID, "to", sub.Subscriber.ID, "error", err)
+			}
+		}
+	}
+	if p.removeLayer(layer) > 0 {
+		p.rebalance()
+		return
+	}
+
+	p.Publisher.Mu.Lock()
+	if p.Publisher.Publications[p.ID] == p {
+		delete(p.Publisher.Publications, p.ID)
+	}
+	p.Publisher.Mu.Unlock()
+	if room := p.Publisher.CurrentRoom(); room != nil {
+		announceTrack(room, p, MsgTypeTrackUnpublished)
+	}
+	p.unsubscribeAll()
+	close(p.done)
+}
+
+// primary — the packet with only the primary Opus frame for subscribers without RED,
+// nil if the publication is not RED or the payload is broken
+func (p *Publication) primary(pkt *rtp.Packet) *rtp.Packet {
+	if p.Track.Codec().MimeType != mimeTypeRED {
+		return nil
+	}
+	payload, ok := redPrimary(pkt.Payload)
+	if !ok {
+		slog.Debug("malformed RED", "clientID", p.Publisher.ID, "trackID", p.ID)
+		return nil
+	}
+	out := *pkt
+	out.Payload = payload
+	return &out
+}
+
+// allowed — publisher-side policy; push-to-talk and ducking only concern audio
+func (p *Publication) allowed(room *Room, pkt *rtp.Packet) bool {
+	if p.Track.Kind() == webrtc.RTPCodecTypeVideo {
+		return p.Publisher.CanPublish(room)
+	}
+	return p.Publisher.shouldForward(room, pkt, p.levelExtID)
+}
+
+// delivers — per-subscriber policy: same room, and for audio not muted locally and inside the whisper
+func (p *Publication) delivers(room *Room, subscriber *Client) bool {
+	if subscriber.CurrentRoom() != room {
+		return false
+	}
+	if p.Track.Kind() == webrtc.RTPCodecTypeVideo {
+		return true
+	}
+	return !subscriber.IsMuted(p.Publisher.ID) && p.Publisher.whispersTo(subscriber.ID)
+}
+
+// subscriptions — snapshot of current subscriptions
+func (p *Publication) subscriptions() []*Subscription {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subs := make([]*Subscription, 0, len(p.subs))
+	for _, sub := range p.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// subscribe — add the publication to the subscriber PeerConnection and renegotiate
+func (p *Publication) subscribe(subscriber *Client) {
+	pc := subscriber.peer()
+	if pc == nil || pc.ConnectionState() == webrtc.PeerConnectionStateClosed || !subscriber.wantsTrack(p) {
+		return
+	}
+	if p.Track.Kind() == webrtc.RTPCodecTypeAudio {
+		if mixer := subscriber.mixer(); mixer != nil && p.mixable() {
+			mixer.subscribe(p)
+			return
+		}
+		// В комнате Last-N звук идёт через слоты подписчика
+		if room := p.Publisher.CurrentRoom(); room != nil && room.lastN() > 0 {
+			return
+		}
+	}
+
+	p.mu.Lock()
+	if _, ok := p.subs[subscriber.ID]; ok {
+		p.mu.Unlock()
+		return
+	}
+	codec := p.Track.Codec().RTPCodecCapability
+	red := codec.MimeType == mimeTypeRED && sameREDBlocks(codec.SDPFmtpLine, subscriber.redFmtp())
+	if codec.MimeType == mimeTypeRED && !red {
+		// Подписчик без RED получит обычный Opus: основной кадр из каждого пакета
+		codec = opusCodec
+	}
+	local, err := webrtc.NewTrackLocalStaticRTP(codec, p.ID, p.StreamID())
+	if err != nil {
+		p.mu.Unlock()
+		slog.Error("create local track", "error", err)
+		return
+	}
+	rtpSender, err := pc.AddTrack(local)
+	if err != nil {
+		p.mu.Unlock()
+		slog.Error("add track", "clientID", subscriber.ID, "error", err)
+		return
+	}
+	sub := &Subscription{Subscriber: subscriber, Local: local, Sender: rtpSender, red: red}
+	p.subs[subscriber.ID] = sub
+	p.mu.Unlock()
+	go sub.readRTCP(p)
+	if p.Track.Kind() == webrtc.RTPCodecTypeVideo {
+		subscriber.countVideoSubscription(1)
+	}
+
+	slog.Info("Subscribed", "from", p.Publisher.ID, "to", subscriber.ID, "trackID", p.ID)
+	subscriber.renegotiate()
+	// Выбор слоя сам попросит keyframe: без него новый подписчик не увидит картинку
+	p.rebalance()
+}
+
+// unsubscribe — remove the publication from the subscriber PeerConnection
+func (p *Publication) unsubscribe(subscriberID string) {
+	p.mu.Lock()
+	sub, ok := p.subs[subscriberID]
+	delete(p.subs, subscriberID)
+	p.mu.Unlock()
+	if ok {
+		sub.stop(p)
+	}
+}
+
+// unsubscribeAll — drop every subscription of the publication
+func (p *Publication) unsubscribeAll() {
+	p.mu.Lock()
+	subs := p.subs
+	p.subs = make(map[string]*Subscription)
+	p.mu.Unlock()
+	for _, sub := range subs {
+		sub.stop(p)
+	}
+}
+
+// stop — remove forwarded track from the subscriber and renegotiate
+func (s *Subscription) stop(p *Publication) {
+	if s.mix != nil {
+		s.mix.mixer.remove(s.mix)
+		return
+	}
+	if s.slot {
+		s.mu.Lock()
+		s.rewriter.stale = true
+		s.mu.Unlock()
+		return
+	}
+	if p.Track.Kind() == webrtc.RTPCodecTypeVideo {
+		s.Subscriber.countVideoSubscription(-1)
+	}
+	pc := s.Subscriber.peer()
+	if pc == nil || pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	if err := pc.RemoveTrack(s.Sender); err != nil {
+		slog.Error("remove track", "clientID", s.Subscriber.ID, "error", err)
+		return
+	}
+	s.Subscriber.renegotiate()
+}
+
+// attachMedia — subscribe client to the room and the room to the client
+func (s *Server) attachMedia(client *Client, room *Room) {
+	startMixer(client)
+	for id, other := range room.GetClients() {
+		if id == client.ID {
+			continue
+		}
+		for _, pub := range other.publications() {
+			pub.subscribe(client)
+		}
+		for _, pub := range client.publications() {
+			pub.subscribe(other)
+		}
+	}
+	if n := room.lastN(); n > 0 {
+		room.speakersMu.Lock()
+		createSlots(client, n)
+		room.speakersMu.Unlock()
+	}
+}
+
+// detachMedia — undo attachMedia when the client leaves the room
+func (s *Server) detachMedia(client *Client, room *Room) {
+	for id, other := range room.GetClients() {
+		if id == client.ID {
+			continue
+		}
+		for _, pub := range other.publications() {
+			pub.unsubscribe(client.ID)
+		}
+	}
+	for _, pub := range client.publications() {
+		announceTrack(room, pub, MsgTypeTrackUnpublished)
+		pub.unsubscribeAll()
+	}
+	room.speakersMu.Lock()
+	dropSlots(client)
+	room.speakersMu.Unlock()
+	stopMixer(client)
+}
+
+// renegotiate — send a server offer after subscriptions changed
+func (c *Client) renegotiate() {
+	pc := c.peer()
+	if pc == nil {
+		return
+	}
+	c.negMu.Lock()
+	defer c.negMu.Unlock()
+	// Пока ждём answer на прошлый offer, новый не шлём — отправим после ответа
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		c.negPending = true
+		return
+	}
+	c.negPending = false
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		slog.Error("create offer", "clientID", c.ID, "error", err)
+		return
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		slog.Error("set local description", "clientID", c.ID, "error", err)
+		return
+	}
+	offer = withAudioParams(offer, c.opusFmtp())
+	if err := c.Send(WebSocketMessageDTO{Type: MsgTypeOffer, SDP: &offer}); err != nil {
+		slog.Error("send offer", "clientID", c.ID, "error", err)
+	}
+}
+
+// acceptOffer — answer client offer, rolling back our own offer on glare
+func (c *Client) acceptOffer(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	pc := c.peer()
+	if pc == nil {
+		return webrtc.SessionDescription{}, errNoPeerConnection
+	}
+	c.negMu.Lock()
+	defer c.negMu.Unlock()
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		// Уступаем клиенту: его offer важнее, свой повторим после
+		if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+		c.negPending = true
+	}
+	return handleOffer(pc, offer, c.opusFmtp())
+}
+
+// acceptAnswer — apply client answer to our offer and send a queued offer if any
+func (c *Client) acceptAnswer(answer webrtc.SessionDescription) error {
+	pc := c.peer()
+	if pc == nil {
+		return errNoPeerConnection
+	}
+	c.negMu.Lock()
+	err := pc.SetRemoteDescription(answer)
+	c.negMu.Unlock()
+	if err != nil {
+		return err
+	}
+	c.flushNegotiation()
+	return nil
+}
+
+// flushNegotiation — send the offer postponed while negotiation was in progress
+func (c *Client) flushNegotiation() {
+	c.negMu.Lock()
+	pending := c.negPending
+	c.negMu.Unlock()
+	if pending {
+		c.renegotiate()
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	MsgTypeSetAudioMode = "set_audio_mode"
+
+	AudioModeForward = "forward" // каждый собеседник отдельной дорожкой
+	AudioModeMixed   = "mixed"   // сервер сводит всех в одну дорожку
+
+	TrackErrInvalidAudioMode = "invalid_audio_mode"
+	TrackErrMixUnavailable   = "mix_unavailable"
+
+	mixSampleRate = 48000
+	// mixFrame — длительность кадра сведения, как у обычного Opus из браузера
+	mixFrame        = 20 * time.Millisecond
+	mixFrameSamples = mixSampleRate / 50
+	// mixMaxBuffered — больше этого от одного собеседника не копим: дрейф часов и всплески сети
+	mixMaxBuffered = 10 * mixFrameSamples
+	// mixPrebuffer — перед началом и после опустошения ждём столько, чтобы не щёлкать на джиттере
+	mixPrebuffer = 2 * mixFrameSamples
+	mixBitrate   = 32000
+	// opusMaxSamples — 120 мс, самый длинный пакет Opus
+	opusMaxSamples = 120 * mixSampleRate / 1000
+	opusMaxPacket  = 1275
+	mixStreamID    = "mix"
+)
+
+// opusEncoder — Opus encoder of the mix; libopus via cgo, see mixer_cgo.go.
+// Mixing is built only with `go build -tags opus` (cgo and libopus-dev required),
+// without the tag set_audio_mode: mixed is rejected with mix_unavailable
+type opusEncoder interface {
+	Encode(pcm []int16, frameSize, maxDataBytes int) ([]byte, error)
+}
+
+// opusDecoder — Opus decoder of one mix input
+type opusDecoder interface {
+	Decode(data []byte, frameSize int, fec bool) ([]int16, error)
+}
+
+// audioMixer — server-side mix of everything a client hears, sent as one Opus track
+type audioMixer struct {
+	client  *Client
+	local   *webrtc.TrackLocalStaticSample
+	sender  *webrtc.RTPSender
+	encoder opusEncoder
+	inputs  map[*Publication]*mixInput
+	report  downstreamReport // последний отчёт клиента о сведённой дорожке
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+// mixInput — decoded audio of one publication waiting to be mixed
+type mixInput struct {
+	mixer   *audioMixer
+	pub     *Publication
+	decoder opusDecoder
+	pcm     []int16 // моно 48 кГц
+	primed  bool
+	mu      sync.Mutex
+}
+
+// audioMode — how the client receives audio, forward by default
+func (c *Client) audioMode() string {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if c.AudioMode == "" {
+		return AudioModeForward
+	}
+	return c.AudioMode
+}
+
+// mixer — running mixer of the client, nil if audio is forwarded as is
+func (c *Client) mixer() *audioMixer {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Mixer
+}
+
+// mixable — check if the publication can go into a mix; only Opus is decoded, RED is cut to it
+func (p *Publication) mixable() bool {
+	return isOpus(p.Track.Codec().MimeType)
+}
+
+// startMixer — add the mixed track to the client PeerConnection if the client asked for it
+func startMixer(client *Client) {
+	pc := client.peer()
+	if pc == nil || pc.ConnectionState() == webrtc.PeerConnectionStateClosed ||
+		client.audioMode() != AudioModeMixed || client.mixer() != nil {
+		return
+	}
+	encoder, err := newOpusEncoder()
+	if err != nil {
+		slog.Error("create Opus encoder", "error", err)
+		return
+	}
+	local, err := webrtc.NewTrackLocalStaticSample(opusCodec, mixStreamID, mixStreamID)
+	if err != nil {
+		slog.Error("create mix track", "error", err)
+		return
+	}
+	sender, err := pc.AddTrack(local)
+	if err != nil {
+		slog.Error("add mix track", "clientID", client.ID, "error", err)
+		return
+	}
+	m := &audioMixer{
+		client:  client,
+		local:   local,
+		sender:  sender,
+		encoder: encoder,
+		inputs:  make(map[*Publication]*mixInput),
+		done:    make(chan struct{}),
+	}
+	client.Mu.Lock()
+	client.Mixer = m
+	client.Mu.Unlock()
+	go drainRTCP(sender, m.setReport)
+	go m.run()
+	slog.Info("Audio mixer started", "clientID", client.ID)
+	client.renegotiate()
+}
+
+// stopMixer — remove the mixed track of the client
+func stopMixer(client *Client) {
+	client.Mu.Lock()
+	m := client.Mixer
+	client.Mixer = nil
+	client.Mu.Unlock()
+	if m == nil {
+		return
+	}
+	close(m.done)
+	pc := client.peer()
+	if pc != nil && pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+		if err := pc.RemoveTrack(m.sender); err != nil {
+			slog.Error("remove mix track", "clientID", client.ID, "error", err)
+		}
+	}
+	slog.Info("Audio mixer stopped", "clientID", client.ID)
+	client.renegotiate()
+}
+
+// subscribe — start mixing the publication for the client
+func (m *audioMixer) subscribe(p *Publication) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.subs[m.client.ID]; ok {
+		return
+	}
+	decoder, err := newOpusDecoder()
+	if err != nil {
+		slog.Error("create Opus decoder", "error", err)
+		return
+	}
+	input := &mixInput{mixer: m, pub: p, decoder: decoder}
+	m.mu.Lock()
+	m.inputs[p] = input
+	m.mu.Unlock()
+	// Через подписку пакеты проходят те же mute, шёпот и PTT, что и при пересылке
+	p.subs[m.client.ID] = &Subscription{Subscriber: m.client, mix: input}
+	slog.Info("Subscribed to mix", "from", p.Publisher.ID, "to", m.client.ID, "trackID", p.ID)
+}
+
+// setReport — remember the last reception report of the client about the mix
+func (m *audioMixer) setReport(rr *rtcp.ReceiverReport) {
+	if report, ok := matchReport(rr, senderSSRC(m.sender), time.Now()); ok {
+		m.mu.Lock()
+		m.report = report
+		m.mu.Unlock()
+	}
+}
+
+// remove — stop mixing the input
+func (m *audioMixer) remove(input *mixInput) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.inputs[input.pub] == input {
+		delete(m.inputs, input.pub)
+	}
+}
+
+// push — decode a packet into the input buffer
+func (in *mixInput) push(pkt *rtp.Packet) {
+	if len(pkt.Payload) == 0 {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	pcm, err := in.decoder.Decode(pkt.Payload, opusMaxSamples, false)
+	if err != nil {
+		slog.Debug("decode Opus", "clientID", in.pub.Publisher.ID, "trackID", in.pub.ID, "error", err)
+		return
+	}
+	in.pcm = append(in.pcm, pcm...)
+	if extra := len(in.pcm) - mixMaxBuffered; extra > 0 {
+		// Отстаём — выбрасываем самое старое, задержка важнее полноты
+		in.pcm = in.pcm[:copy(in.pcm, in.pcm[extra:])]
+	}
+}
+
+// pop — take one frame of decoded audio, false while the buffer is filling up
+func (in *mixInput) pop(frame []int16) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.primed && len(in.pcm) < mixPrebuffer {
+		return false
+	}
+	if len(in.pcm) < len(frame) {
+		in.primed = false
+		return false
+	}
+	in.primed = true
+	copy(frame, in.pcm)
+	in.pcm = in.pcm[:copy(in.pcm, in.pcm[len(frame):])]
+	return true
+}
+
+// run — every frame mix the inputs with the client volumes and send the result
+func (m *audioMixer) run() {
+	ticker := time.NewTicker(mixFrame)
+	defer ticker.Stop()
+	frame := make([]int16, mixFrameSamples)
+	mixed := make([]float64, mixFrameSamples)
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		clear(mixed)
+		for _, input := range m.snapshot() {
+			if !input.pop(frame) {
+				continue
+			}
+			volume := m.client.GetVolume(input.pub.Publisher.ID)
+			for i, sample := range frame {
+				mixed[i] += float64(sample) * volume
+			}
+		}
+		// Тишину тоже кодируем: у Opus она почти ничего не стоит, а время на дорожке идёт ровно
+		for i, sample := range mixed {
+			frame[i] = int16(max(min(sample, math.MaxInt16), math.MinInt16))
+		}
+		data, err := m.encoder.Encode(frame, mixFrameSamples, opusMaxPacket)
+		if err != nil {
+			slog.Error("encode Opus", "clientID", m.client.ID, "error", err)
+			continue
+		}
+		if err := m.local.WriteSample(media.Sample{Data: data, Duration: mixFrame}); err != nil {
+			slog.Error("write mix", "clientID", m.client.ID, "error", err)
+		}
+	}
+}
+
+// snapshot — current inputs of the mixer
+func (m *audioMixer) snapshot() []*mixInput {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inputs := make([]*mixInput, 0, len(m.inputs))
+	for _, input := range m.inputs {
+		inputs = append(inputs, input)
+	}
+	return inputs
+}
+
+// handleSetAudioMode — switch the client between forwarded tracks and a server-side mix
+func (s *Server) handleSetAudioMode(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	switch msg.AudioMode {
+	case AudioModeForward, AudioModeMixed:
+	default:
+		return WebSocketMessageDTO{
+			Type:    MsgTypeError,
+			Code:    TrackErrInvalidAudioMode,
+			Message: "audioMode must be 'forward' or 'mixed'",
+		}
+	}
+	if msg.AudioMode == AudioModeMixed && !mixAvailable {
+		return WebSocketMessageDTO{
+			Type:    MsgTypeError,
+			Code:    TrackErrMixUnavailable,
+			Message: "server-side mixing is not available: the server is built without the opus build tag",
+		}
+	}
+	if client.audioMode() != msg.AudioMode {
+		client.Mu.Lock()
+		client.AudioMode = msg.AudioMode
+		client.Mu.Unlock()
+		slog.Info("Audio mode set", "clientID", client.ID, "mode", msg.AudioMode)
+		if room := client.CurrentRoom(); room != nil {
+			s.resetClientAudio(client, room)
+		}
+	}
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", AudioMode: msg.AudioMode}
+}
@@ -0,0 +1,23 @@
+//go:build opus
+
+package main
+
+import "layeh.com/gopus"
+
+// mixAvailable — сведение возможно: собрано с -tags opus, libopus подключена через cgo
+const mixAvailable = true
+
+// newOpusEncoder — mono VoIP encoder of the mix
+func newOpusEncoder() (opusEncoder, error) {
+	encoder, err := gopus.NewEncoder(mixSampleRate, 1, gopus.Voip)
+	if err != nil {
+		return nil, err
+	}
+	encoder.SetBitrate(mixBitrate)
+	return encoder, nil
+}
+
+// newOpusDecoder — mono decoder of one mix input
+func newOpusDecoder() (opusDecoder, error) {
+	return gopus.NewDecoder(mixSampleRate, 1)
+}
@@ -0,0 +1,20 @@
+//go:build !opus
+
+package main
+
+import "errors"
+
+// mixAvailable — без тега opus нет libopus, set_audio_mode: mixed отклоняем
+const mixAvailable = false
+
+var errMixUnavailable = errors.New("opus codec requires the opus build tag")
+
+// newOpusEncoder — unavailable without the opus build tag
+func newOpusEncoder() (opusEncoder, error) {
+	return nil, errMixUnavailable
+}
+
+// newOpusDecoder — unavailable without the opus build tag
+func newOpusDecoder() (opusDecoder, error) {
+	return nil, errMixUnavailable
+}
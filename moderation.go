@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	RoomRoleOwner     = "owner"
+	RoomRoleModerator = "moderator"
+	// RoomRolePrioritySpeaker — пока говорит, остальные спикеры не пересылаются
+	RoomRolePrioritySpeaker = "priority_speaker"
+	RoomRoleSpeaker         = "speaker"
+	RoomRoleListener        = "listener"
+
+	maxBanDuration = 365 * 24 * time.Hour
+
+	MsgTypeServerMute        = "server_mute"
+	MsgTypeServerUnmute      = "server_unmute"
+	MsgTypeKick              = "kick"
+	MsgTypeBan               = "ban"
+	MsgTypeUnban             = "unban"
+	MsgTypeSetRole           = "set_role"
+	MsgTypeTransferOwnership = "transfer_ownership"
+	MsgTypeKicked            = "kicked"
+
+	// Причина в поле code сообщения kicked
+	KickReasonKicked = "kicked"
+	KickReasonBanned = "banned"
+)
+
+// Коды ошибок модерации
+const (
+	ModErrForbidden       = "forbidden"
+	ModErrTargetNotFound  = "target_not_found"
+	ModErrInvalidRole     = "invalid_role"
+	ModErrInvalidDuration = "invalid_duration"
+)
+
+var errRoomBanned = errors.New("banned from room")
+
+// roleRank — higher rank may moderate lower ranks
+var roleRank = map[string]int{
+	RoomRoleListener:        0,
+	RoomRoleSpeaker:         1,
+	RoomRolePrioritySpeaker: 2,
+	RoomRoleModerator:       3,
+	RoomRoleOwner:           4,
+}
+
+// roomRole — role of the user in the room
+func roomRole(rec RoomRecord, userID int) (string, error) {
+	if rec.IsOwner(userID) {
+		return RoomRoleOwner, nil
+	}
+	if rec.AdHoc {
+		return rec.DefaultRole(), nil
+	}
+	var role string
+	err := db.Get(&role, "SELECT role FROM room_members WHERE room_id=$1 AND user_id=$2", rec.ID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rec.DefaultRole(), nil
+	}
+	return role, err
+}
+
+// setMemberRole — persist role, the user becomes a room member
+func setMemberRole(roomID string, userID int, role string) error {
+	_, err := db.Exec(
+		`INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET role=excluded.role`,
+		roomID,
+		userID,
+		role,
+	)
+	return err
+}
+
+// activeBan — ban expiry if the user is currently banned from the room
+func activeBan(roomID string, userID int) (time.Time, bool, error) {
+	var expiresAt time.Time
+	err := db.Get(&expiresAt, "SELECT expires_at FROM room_bans WHERE room_id=$1 AND user_id=$2", roomID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return expiresAt, time.Now().Before(expiresAt), nil
+}
+
+// checkBan — errRoomBanned while the ban is active
+func checkBan(roomID string, userID int) error {
+	expiresAt, banned, err := activeBan(roomID, userID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return fmt.Errorf("%w until %s", errRoomBanned, expiresAt.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RoomRole — client role in its current room
+func (c *Client) RoomRole() string {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Role
+}
+
+// setRole — change client role in its current room
+func (c *Client) setRole(role string) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.Role = role
+}
+
+// setServerMuted — mute or unmute client for everyone
+func (c *Client) setServerMuted(muted bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.ServerMuted = muted
+}
+
+// CanPublish — check if client audio may be forwarded to the room
+func (c *Client) CanPublish(room *Room) bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Room == room && !c.ServerMuted && c.Role != RoomRoleListener
+}
+
+// IsServerMuted — check if user is muted for everyone in the room
+func (r *Room) IsServerMuted(userID int) bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.ServerMuted[userID]
+}
+
+// setServerMuted — remember server mute so reconnecting doesn't lift it
+func (r *Room) setServerMuted(userID int, muted bool) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if muted {
+		r.ServerMuted[userID] = true
+	} else {
+		delete(r.ServerMuted, userID)
+	}
+}
+
+// clientsOfUser — all connections of the user in the room
+func (r *Room) clientsOfUser(userID int) []*Client {
+	var clients []*Client
+	for _, client := range r.GetClients() {
+		if client.UserID == userID {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// broadcastUpdated — notify the room about changed participants
+func (r *Room) broadcastUpdated(clients []*Client) {
+	for _, client := range clients {
+		r.Broadcast(
+			WebSocketMessageDTO{
+				Type:        MsgTypeParticipantUpdated,
+				RoomID:      r.ID,
+				Participant: ptr(client.Participant()),
+			}, "",
+		)
+	}
+}
+
+// moderationError — WebSocket error message for moderation failure
+func moderationError(code, message string) WebSocketMessageDTO {
+	return WebSocketMessageDTO{Type: MsgTypeError, Code: code, Message: message}
+}
+
+// requireModerator — room settings and actor role, or error message if actor is not a moderator
+func requireModerator(actor *Client, room *Room) (RoomRecord, string, *WebSocketMessageDTO) {
+	// У breakout-комнат своей записи нет — права берём из основной
+	rec, err := loadRoomRecord(room.root().ID)
+	if errors.Is(err, errRoomNotFound) {
+		return RoomRecord{}, "", ptr(moderationError(ModErrForbidden, "Ad-hoc rooms have no moderators"))
+	}
+	if err != nil {
+		slog.Error("load room", "roomID", room.ID, "error", err)
+		return RoomRecord{}, "", &WebSocketMessageDTO{Type: MsgTypeError, Message: "moderate"}
+	}
+
+	// Роли берём из БД, а не из клиента: их могли поменять с другого соединения
+	role, err := roomRole(rec, actor.UserID)
+	if err != nil {
+		slog.Error("load room role", "roomID", room.ID, "userID", actor.UserID, "error", err)
+		return RoomRecord{}, "", &WebSocketMessageDTO{Type: MsgTypeError, Message: "moderate"}
+	}
+	if roleRank[role] < roleRank[RoomRoleModerator] {
+		return RoomRecord{}, "", ptr(moderationError(ModErrForbidden, "Only moderators can do this"))
+	}
+	return rec, role, nil
+}
+
+// moderate — handle moderator command from client
+func (s *Server) moderate(actor *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	room := actor.CurrentRoom()
+	rec, actorRole, errMsg := requireModerator(actor, room)
+	if errMsg != nil {
+		return *errMsg
+	}
+
+	targetUserID := msg.TargetUserID
+	if msg.TargetClientID != "" {
+		target, ok := room.GetClients()[msg.TargetClientID]
+		if !ok {
+			return moderationError(ModErrTargetNotFound, "Participant not found")
+		}
+		targetUserID = target.UserID
+	}
+	if targetUserID == 0 {
+		return moderationError(ModErrTargetNotFound, "targetClientId or targetUserId is required")
+	}
+	if targetUserID == actor.UserID {
+		return moderationError(ModErrForbidden, "Cannot moderate yourself")
+	}
+	targetRole, err := roomRole(rec, targetUserID)
+	if err != nil {
+		slog.Error("load room role", "roomID", room.ID, "userID", targetUserID, "error", err)
+		return WebSocketMessageDTO{Type: MsgTypeError, Message: "moderate"}
+	}
+	if roleRank[targetRole] >= roleRank[actorRole] {
+		return moderationError(ModErrForbidden, "Cannot moderate a participant with the same or higher role")
+	}
+
+	switch msg.Type {
+	case MsgTypeServerMute, MsgTypeServerUnmute:
+		muted := msg.Type == MsgTypeServerMute
+		room.root().setServerMuted(targetUserID, muted)
+		targets := room.clientsOfUser(targetUserID)
+		for _, client := range targets {
+			client.setServerMuted(muted)
+		}
+		room.broadcastUpdated(targets)
+
+	case MsgTypeKick:
+		s.removeUserFromRoom(room.root(), targetUserID, KickReasonKicked, "Kicked by moderator")
+
+	case MsgTypeBan:
+		duration := time.Duration(msg.DurationSeconds) * time.Second
+		if duration <= 0 || duration > maxBanDuration {
+			return moderationError(ModErrInvalidDuration, "durationSeconds must be between 1 and 31536000")
+		}
+		expiresAt := time.Now().Add(duration).UTC()
+		if _, err := db.Exec(
+			`INSERT INTO room_bans (room_id, user_id, banned_by, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (room_id, user_id) DO UPDATE SET banned_by=excluded.banned_by, expires_at=excluded.expires_at, created_at=excluded.created_at`,
+			rec.ID,
+			targetUserID,
+			actor.UserID,
+			expiresAt,
+			time.Now().UTC(),
+		); err != nil {
+			slog.Error("ban user", "roomID", room.ID, "userID", targetUserID, "error", err)
+			return WebSocketMessageDTO{Type: MsgTypeError, Message: "ban"}
+		}
+		s.removeUserFromRoom(room.root(), targetUserID, KickReasonBanned, "Banned until "+expiresAt.Format(time.RFC3339))
+
+	case MsgTypeUnban:
+		if _, err := db.Exec("DELETE FROM room_bans WHERE room_id=$1 AND user_id=$2", rec.ID, targetUserID); err != nil {
+			slog.Error("unban user", "roomID", room.ID, "userID", targetUserID, "error", err)
+			return WebSocketMessageDTO{Type: MsgTypeError, Message: "unban"}
+		}
+
+	case MsgTypeSetRole:
+		if _, ok := roleRank[msg.Role]; !ok || msg.Role == RoomRoleOwner {
+			return moderationError(
+				ModErrInvalidRole, "Role must be 'moderator', 'priority_speaker', 'speaker' or 'listener'",
+			)
+		}
+		if roleRank[msg.Role] >= roleRank[actorRole] {
+			return moderationError(ModErrForbidden, "Cannot grant a role equal to or above your own")
+		}
+		// Роль хранится в room_members, так что заодно даёт доступ в приватную комнату
+		if err := setMemberRole(rec.ID, targetUserID, msg.Role); err != nil {
+			slog.Error("set room role", "roomID", room.ID, "userID", targetUserID, "error", err)
+			return WebSocketMessageDTO{Type: MsgTypeError, Message: "set role"}
+		}
+		// Постоянная роль важнее временной роли на сцене
+		room.setStageRole(targetUserID, "")
+		targets := room.clientsOfUser(targetUserID)
+		for _, client := range targets {
+			client.setRole(msg.Role)
+		}
+		room.broadcastUpdated(targets)
+
+	case MsgTypeTransferOwnership:
+		if actorRole != RoomRoleOwner {
+			return moderationError(ModErrForbidden, "Only the room owner can transfer ownership")
+		}
+		if err := transferOwnership(rec.ID, actor.UserID, targetUserID); err != nil {
+			slog.Error("transfer ownership", "roomID", room.ID, "to", targetUserID, "error", err)
+			return WebSocketMessageDTO{Type: MsgTypeError, Message: "transfer ownership"}
+		}
+		previous := room.clientsOfUser(actor.UserID)
+		for _, client := range previous {
+			client.setRole(RoomRoleModerator)
+		}
+		next := room.clientsOfUser(targetUserID)
+		for _, client := range next {
+			client.setRole(RoomRoleOwner)
+		}
+		room.broadcastUpdated(append(previous, next...))
+	}
+
+	slog.Info(
+		"Moderation action", "action", msg.Type, "roomID", room.ID, "by", actor.UserID, "target", targetUserID,
+		"role", msg.Role, "durationSeconds", msg.DurationSeconds,
+	)
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", TargetClientID: msg.TargetClientID, TargetUserID: targetUserID}
+}
+
+// transferOwnership — hand the room to another user, previous owner stays moderator
+func transferOwnership(roomID string, fromUserID, toUserID int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE rooms SET owner_id=$1 WHERE id=$2 AND owner_id=$3", toUserID, roomID, fromUserID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errRoomForbidden
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET role=excluded.role`,
+		roomID,
+		fromUserID,
+		RoomRoleModerator,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeUserFromRoom — disconnect all user connections from the room and its lobby
+func (s *Server) removeUserFromRoom(room *Room, userID int, reason, message string) {
+	waiting := room.removeWaitingUser(userID)
+	for _, client := range waiting {
+		client.setWaiting(nil)
+		if err := client.Send(
+			WebSocketMessageDTO{Type: MsgTypeKicked, RoomID: room.ID, Code: reason, Message: message},
+		); err != nil {
+			slog.Error("notify kicked client", "clientID", client.ID, "error", err)
+		}
+	}
+	if len(waiting) > 0 {
+		s.notifyLobby(room)
+	}
+
+	// Из breakout-комнат тоже выводим: они часть той же комнаты
+	for _, client := range room.familyClientsOfUser(userID) {
+		s.leaveRoom(client, client.CurrentRoom())
+		client.setRoom(nil)
+		// Закрываем PeerConnection, чтобы оборвать и входящий, и исходящий звук;
+		// при следующем join клиент пришлёт новый offer
+		if pc := client.peer(); pc != nil {
+			pc.Close()
+		}
+		if err := client.Send(
+			WebSocketMessageDTO{Type: MsgTypeKicked, RoomID: room.ID, Code: reason, Message: message},
+		); err != nil {
+			slog.Error("notify kicked client", "clientID", client.ID, "error", err)
+		}
+	}
+}
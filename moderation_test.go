@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// moderatedRoom — room "open" of user 1 with user 2 as moderator, 3 as speaker and 4 as listener, all connected
+func moderatedRoom(t *testing.T) (*Server, *Room, map[int]*Client) {
+	t.Helper()
+	s := seedRooms(t)
+	for userID, role := range map[int]string{2: RoomRoleModerator, 4: RoomRoleListener} {
+		if err := setMemberRole("open", userID, role); err != nil {
+			t.Fatalf("set role: %v", err)
+		}
+	}
+	rec, err := loadRoomRecord("open")
+	if err != nil {
+		t.Fatalf("load room: %v", err)
+	}
+	room := s.getOrCreateRoom("open")
+	clients := make(map[int]*Client)
+	for userID, id := range map[int]string{1: "owner", 2: "moderator", 3: "speaker", 4: "listener"} {
+		client, _ := wsClient(t, id, room, userID)
+		role, err := roomRole(rec, userID)
+		if err != nil {
+			t.Fatalf("load role: %v", err)
+		}
+		client.setRole(role)
+		room.AddClient(client)
+		clients[userID] = client
+	}
+	return s, room, clients
+}
+
+func TestModerateRoles(t *testing.T) {
+	s, _, clients := moderatedRoom(t)
+	tests := []struct {
+		name  string
+		actor int
+		msg   WebSocketMessageDTO
+		code  string // пусто — действие выполнено
+	}{
+		{"speaker mutes listener", 3, WebSocketMessageDTO{Type: MsgTypeServerMute, TargetUserID: 4}, ModErrForbidden},
+		{"moderator mutes speaker", 2, WebSocketMessageDTO{Type: MsgTypeServerMute, TargetUserID: 3}, ""},
+		{"moderator mutes owner", 2, WebSocketMessageDTO{Type: MsgTypeServerMute, TargetUserID: 1}, ModErrForbidden},
+		{"moderator kicks owner", 2, WebSocketMessageDTO{Type: MsgTypeKick, TargetClientID: "owner"}, ModErrForbidden},
+		{"moderator bans owner", 2, WebSocketMessageDTO{Type: MsgTypeBan, TargetUserID: 1, DurationSeconds: 60}, ModErrForbidden},
+		{"moderator mutes self", 2, WebSocketMessageDTO{Type: MsgTypeServerMute, TargetUserID: 2}, ModErrForbidden},
+		{"unknown target", 2, WebSocketMessageDTO{Type: MsgTypeKick, TargetClientID: "nobody"}, ModErrTargetNotFound},
+		{"no target", 2, WebSocketMessageDTO{Type: MsgTypeKick}, ModErrTargetNotFound},
+		{
+			"moderator promotes to owner", 2,
+			WebSocketMessageDTO{Type: MsgTypeSetRole, TargetUserID: 3, Role: RoomRoleOwner}, ModErrInvalidRole,
+		},
+		{
+			"moderator promotes to moderator", 2,
+			WebSocketMessageDTO{Type: MsgTypeSetRole, TargetUserID: 3, Role: RoomRoleModerator}, ModErrForbidden,
+		},
+		{
+			"moderator transfers ownership", 2,
+			WebSocketMessageDTO{Type: MsgTypeTransferOwnership, TargetUserID: 3}, ModErrForbidden,
+		},
+		{"ban without duration", 2, WebSocketMessageDTO{Type: MsgTypeBan, TargetUserID: 3}, ModErrInvalidDuration},
+		{
+			"ban longer than a year", 2,
+			WebSocketMessageDTO{Type: MsgTypeBan, TargetUserID: 3, DurationSeconds: int(maxBanDuration/time.Second) + 1},
+			ModErrInvalidDuration,
+		},
+		{"moderator demotes speaker", 2, WebSocketMessageDTO{Type: MsgTypeSetRole, TargetUserID: 3, Role: RoomRoleListener}, ""},
+		{"owner promotes listener", 1, WebSocketMessageDTO{Type: MsgTypeSetRole, TargetUserID: 4, Role: RoomRoleModerator}, ""},
+		// Второй модератор наравне с первым
+		{"moderator mutes moderator", 2, WebSocketMessageDTO{Type: MsgTypeServerMute, TargetUserID: 4}, ModErrForbidden},
+	}
+	for _, tt := range tests {
+		resp := s.moderate(clients[tt.actor], tt.msg)
+		if tt.code == "" {
+			if resp.Type != tt.msg.Type+"_ack" {
+				t.Errorf("%s: %s %q %q", tt.name, resp.Type, resp.Code, resp.Message)
+			}
+			continue
+		}
+		if resp.Type != MsgTypeError || resp.Code != tt.code {
+			t.Errorf("%s: %s %q, want error %q", tt.name, resp.Type, resp.Code, tt.code)
+		}
+	}
+
+	if !clients[3].ServerMuted || clients[3].RoomRole() != RoomRoleListener || clients[4].RoomRole() != RoomRoleModerator {
+		t.Errorf(
+			"speaker muted %v with role %q, listener role %q", clients[3].ServerMuted, clients[3].RoomRole(),
+			clients[4].RoomRole(),
+		)
+	}
+	if clients[1].ServerMuted {
+		t.Error("owner muted by moderator")
+	}
+}
+
+func TestBan(t *testing.T) {
+	s, room, clients := moderatedRoom(t)
+
+	resp := s.moderate(clients[2], WebSocketMessageDTO{Type: MsgTypeBan, TargetClientID: "speaker", DurationSeconds: 3600})
+	if resp.Type != MsgTypeBan+"_ack" {
+		t.Fatalf("ban: %s %q", resp.Type, resp.Message)
+	}
+	if _, ok := room.GetClients()["speaker"]; ok || clients[3].CurrentRoom() != nil {
+		t.Error("banned user is still in the room")
+	}
+
+	// Бан читается из БД с учётом срока
+	expiresAt, banned, err := activeBan("open", 3)
+	if err != nil || !banned {
+		t.Fatalf("active ban: %v, %v", banned, err)
+	}
+	if d := time.Until(expiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("ban expires in %v, want an hour", d)
+	}
+	if err := checkBan("open", 3); !errors.Is(err, errRoomBanned) {
+		t.Errorf("check ban: error %v, want %v", err, errRoomBanned)
+	}
+	if err := checkBan("open", 4); err != nil {
+		t.Errorf("check ban of another user: %v", err)
+	}
+
+	// Ни приглашение, ни пароль бан не снимают
+	if _, err := authorizeJoin(3, "open", "", inviteToken(t, "open", time.Hour)); !errors.Is(err, errRoomBanned) {
+		t.Errorf("join by invite: error %v, want %v", err, errRoomBanned)
+	}
+
+	// Истёкший бан пускает обратно
+	if _, err := db.Exec("UPDATE room_bans SET expires_at=$1", time.Now().Add(-time.Second).UTC()); err != nil {
+		t.Fatalf("expire ban: %v", err)
+	}
+	if _, banned, err := activeBan("open", 3); err != nil || banned {
+		t.Errorf("expired ban: %v, %v", banned, err)
+	}
+	if _, err := authorizeJoin(3, "open", "", ""); err != nil {
+		t.Errorf("join after ban expired: %v", err)
+	}
+
+	// Снятый бан тоже
+	if _, err := db.Exec("UPDATE room_bans SET expires_at=$1", time.Now().Add(time.Hour).UTC()); err != nil {
+		t.Fatalf("renew ban: %v", err)
+	}
+	if resp := s.moderate(clients[2], WebSocketMessageDTO{Type: MsgTypeUnban, TargetUserID: 3}); resp.Type != MsgTypeUnban+"_ack" {
+		t.Fatalf("unban: %s %q", resp.Type, resp.Message)
+	}
+	if err := checkBan("open", 3); err != nil {
+		t.Errorf("check ban after unban: %v", err)
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	s, _, clients := moderatedRoom(t)
+
+	resp := s.moderate(clients[1], WebSocketMessageDTO{Type: MsgTypeTransferOwnership, TargetUserID: 3})
+	if resp.Type != MsgTypeTransferOwnership+"_ack" {
+		t.Fatalf("transfer: %s %q", resp.Type, resp.Message)
+	}
+	rec, err := loadRoomRecord("open")
+	if err != nil {
+		t.Fatalf("load room: %v", err)
+	}
+	tests := []struct {
+		userID int
+		role   string
+	}{
+		{1, RoomRoleModerator},
+		{2, RoomRoleModerator},
+		{3, RoomRoleOwner},
+		{4, RoomRoleListener},
+	}
+	for _, tt := range tests {
+		role, err := roomRole(rec, tt.userID)
+		if err != nil || role != tt.role {
+			t.Errorf("user %d: role %q, %v, want %q", tt.userID, role, err, tt.role)
+		}
+		if got := clients[tt.userID].RoomRole(); tt.userID != 2 && tt.userID != 4 && got != tt.role {
+			t.Errorf("user %d: client role %q, want %q", tt.userID, got, tt.role)
+		}
+	}
+
+	// Прежний владелец больше не может ни передать комнату, ни тронуть нового владельца
+	if err := transferOwnership("open", 1, 2); !errors.Is(err, errRoomForbidden) {
+		t.Errorf("second transfer: error %v, want %v", err, errRoomForbidden)
+	}
+	if resp := s.moderate(clients[1], WebSocketMessageDTO{Type: MsgTypeKick, TargetUserID: 3}); resp.Code != ModErrForbidden {
+		t.Errorf("previous owner kicks new owner: %s %q", resp.Type, resp.Code)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookieName = "oidc_state"
+	oidcFlowTTL         = 10 * time.Minute
+)
+
+var errIdentityLinkedElsewhere = errors.New("identity already linked to another account")
+
+// oidcFlow — pending authorization-code flow waiting for the callback
+type oidcFlow struct {
+	Verifier   string
+	Nonce      string
+	LinkUserID int // не 0 — привязываем identity к уже вошедшему пользователю
+	ExpiresAt  time.Time
+}
+
+// oidcClaims — ID token claims used for account linking
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+// OIDCProvider — OpenID Connect relying party (authorization code + PKCE)
+type OIDCProvider struct {
+	issuer   string
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+
+	mu    sync.Mutex
+	flows map[string]oidcFlow
+}
+
+// NewOIDCProvider — discover issuer and create OIDC provider
+func NewOIDCProvider(ctx context.Context, cfg Config) (*OIDCProvider, error) {
+	// Discovery заодно настраивает проверку подписи по JWKS из jwks_uri
+	provider, err := oidc.NewProvider(ctx, cfg.OIDCIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover issuer %q: %w", cfg.OIDCIssuer, err)
+	}
+
+	return &OIDCProvider{
+		issuer:   cfg.OIDCIssuer,
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.OIDCClientID}),
+		oauth: oauth2.Config{
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       cfg.OIDCScopes,
+		},
+		flows: make(map[string]oidcFlow),
+	}, nil
+}
+
+// startFlow — remember PKCE verifier and nonce for the state
+func (p *OIDCProvider) startFlow(state string, flow oidcFlow) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for key, f := range p.flows {
+		if now.After(f.ExpiresAt) {
+			delete(p.flows, key)
+		}
+	}
+	p.flows[state] = flow
+}
+
+// takeFlow — get and forget pending flow for the state
+func (p *OIDCProvider) takeFlow(state string) (oidcFlow, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	flow, ok := p.flows[state]
+	delete(p.flows, state)
+	if !ok || time.Now().After(flow.ExpiresAt) {
+		return oidcFlow{}, false
+	}
+	return flow, true
+}
+
+// handleLogin — redirect browser to the IdP authorization endpoint
+func (p *OIDCProvider) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state, err := randomToken(16)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	flow := oidcFlow{
+		Verifier:  oauth2.GenerateVerifier(),
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(oidcFlowTTL),
+	}
+
+	// ?link=1 от вошедшего пользователя — привязка SSO к существующему аккаунту
+	if r.URL.Query().Get("link") == "1" {
+		cookie, err := r.Cookie(accessCookieName)
+		if err != nil {
+			http.Error(w, "Login required for account linking", http.StatusUnauthorized)
+			return
+		}
+		userID, sessionID, err := validateJWT(cookie.Value)
+		if err != nil || sessions.IsRevoked(sessionID) {
+			http.Error(w, "Login required for account linking", http.StatusUnauthorized)
+			return
+		}
+		flow.LinkUserID = userID
+	}
+
+	p.startFlow(state, flow)
+
+	// Lax, а не Strict: cookie должна прийти на callback после редиректа с IdP
+	http.SetCookie(
+		w, &http.Cookie{
+			Name:     oidcStateCookieName,
+			Value:    state,
+			Path:     "/auth/oidc",
+			HttpOnly: true,
+			Secure:   false, // Только HTTPS (отключите для localhost)
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   int(oidcFlowTTL.Seconds()),
+		},
+	)
+
+	url := p.oauth.AuthCodeURL(
+		state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(flow.Verifier),
+	)
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// handleCallback — exchange authorization code, validate ID token and start session
+func (p *OIDCProvider) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		slog.Warn("OIDC authorization failed", "error", errCode, "description", query.Get("error_description"))
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || cookie.Value != state {
+		slog.Warn("OIDC state mismatch")
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/auth/oidc", MaxAge: -1})
+
+	flow, ok := p.takeFlow(state)
+	if !ok {
+		http.Error(w, "Login flow expired", http.StatusBadRequest)
+		return
+	}
+
+	token, err := p.oauth.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		slog.Error("exchange OIDC code", "error", err)
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		slog.Error("OIDC token response without id_token")
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := p.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		slog.Error("verify ID token", "error", err)
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != flow.Nonce {
+		slog.Error("ID token nonce mismatch")
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		slog.Error("parse ID token claims", "error", err)
+		http.Error(w, "SSO login failed", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := p.resolveUser(claims, flow.LinkUserID)
+	if errors.Is(err, errIdentityLinkedElsewhere) {
+		http.Error(w, "SSO account is linked to another user", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("resolve OIDC user", "subject", claims.Subject, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var totpEnabled bool
+	if err := db.Get(&totpEnabled, "SELECT totp_enabled FROM users WHERE id=$1", userID); err != nil {
+		slog.Error("load user", "userID", userID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if totpEnabled {
+		// Вход через IdP не заменяет второй фактор: cookie выдаст POST /login/totp.
+		// Токен во фрагменте — браузер не шлёт его серверу и не пишет в Referer
+		mfaToken, err := generateMFAToken(userID)
+		if err != nil {
+			http.Error(w, "generate token", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("OIDC login accepted, TOTP required", "userID", userID, "issuer", p.issuer)
+		http.Redirect(w, r, "/#mfa="+url.QueryEscape(mfaToken), http.StatusFound)
+		return
+	}
+
+	if err := startSession(w, userID); err != nil {
+		slog.Error("start session", "userID", userID, "error", err)
+		http.Error(w, "generate token", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("User logged in via OIDC", "userID", userID, "issuer", p.issuer)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// resolveUser — find linked user, link to the current user or provision a new one
+func (p *OIDCProvider) resolveUser(claims oidcClaims, linkUserID int) (int, error) {
+	var userID int
+	err := db.Get(
+		&userID,
+		"SELECT user_id FROM user_identities WHERE issuer=$1 AND subject=$2",
+		p.issuer,
+		claims.Subject,
+	)
+	switch {
+	case err == nil:
+		if linkUserID != 0 && linkUserID != userID {
+			return 0, errIdentityLinkedElsewhere
+		}
+		return userID, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return 0, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userID = linkUserID
+	if userID == 0 {
+		username, err := availableUsername(tx, oidcUsername(claims))
+		if err != nil {
+			return 0, err
+		}
+		// Пустой пароль: bcrypt-сравнение всегда падает, вход только через SSO
+		if err := tx.QueryRow(
+			"INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id",
+			username,
+			"",
+		).Scan(&userID); err != nil {
+			return 0, err
+		}
+		slog.Info("User provisioned via OIDC", "username", username, "userID", userID)
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO user_identities (user_id, issuer, subject, email) VALUES ($1, $2, $3, $4)",
+		userID,
+		p.issuer,
+		claims.Subject,
+		claims.Email,
+	); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	slog.Info("OIDC identity linked", "userID", userID, "issuer", p.issuer, "subject", claims.Subject)
+	return userID, nil
+}
+
+// oidcUsername — pick username candidate from ID token claims
+func oidcUsername(claims oidcClaims) string {
+	switch {
+	case claims.PreferredUsername != "":
+		return claims.PreferredUsername
+	case claims.Email != "" && claims.EmailVerified:
+		return claims.Email
+	default:
+		return "sso-" + claims.Subject
+	}
+}
+
+// availableUsername — add random suffix until username is free
+func availableUsername(tx *sqlx.Tx, base string) (string, error) {
+	username := base
+	for range 5 {
+		var taken bool
+		if err := tx.Get(&taken, "SELECT EXISTS (SELECT 1 FROM users WHERE username=$1)", username); err != nil {
+			return "", err
+		}
+		if !taken {
+			return username, nil
+		}
+		suffix, err := randomToken(3)
+		if err != nil {
+			return "", err
+		}
+		username = base + "-" + strings.ToLower(suffix)
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/oauth2"
+
+	"grok_voice/internal/stubidp"
+)
+
+// oidcTestApp — OIDC login of the app against the stub IdP, both on httptest servers
+type oidcTestApp struct {
+	app *httptest.Server
+}
+
+func newOIDCTestApp(t *testing.T) *oidcTestApp {
+	t.Helper()
+	openTestDB(t)
+	prev := cfg
+	cfg.AccessTokenTTL = time.Minute
+	cfg.RefreshTokenTTL = time.Hour
+	t.Cleanup(func() { cfg = prev })
+
+	idpServer := httptest.NewUnstartedServer(nil)
+	issuer := "http://" + idpServer.Listener.Addr().String()
+	idp, err := stubidp.New(
+		issuer, "grok", "", map[string]interface{}{
+			"sub":                "stub-user-1",
+			"preferred_username": "stub.user",
+			"email":              "stub.user@example.com",
+			"email_verified":     true,
+		},
+	)
+	if err != nil {
+		t.Fatalf("create IdP: %v", err)
+	}
+	idpServer.Config.Handler = idp.Handler()
+	idpServer.Start()
+	t.Cleanup(idpServer.Close)
+
+	mux := http.NewServeMux()
+	app := httptest.NewUnstartedServer(mux)
+	provider, err := NewOIDCProvider(
+		context.Background(), Config{
+			OIDCIssuer:      issuer,
+			OIDCClientID:    "grok",
+			OIDCRedirectURL: "http://" + app.Listener.Addr().String() + "/auth/oidc/callback",
+			OIDCScopes:      []string{"openid", "profile", "email"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("create provider: %v", err)
+	}
+	mux.HandleFunc("GET /auth/oidc/login", provider.handleLogin)
+	mux.HandleFunc("GET /auth/oidc/callback", provider.handleCallback)
+	app.Start()
+	t.Cleanup(app.Close)
+	return &oidcTestApp{app: app}
+}
+
+// login — walk the browser through login, IdP and callback; the hooks edit the query of
+// the authorization request and of the callback, access logs in as an existing user
+func (a *oidcTestApp) login(t *testing.T, query, access string, authorize, callback func(url.Values)) *http.Response {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("create cookie jar: %v", err)
+	}
+	appURL, _ := url.Parse(a.app.URL)
+	if access != "" {
+		jar.SetCookies(appURL, []*http.Cookie{{Name: accessCookieName, Value: access}})
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	step := func(target string, edit func(url.Values)) *http.Response {
+		t.Helper()
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatalf("parse %q: %v", target, err)
+		}
+		if edit != nil {
+			q := u.Query()
+			edit(q)
+			u.RawQuery = q.Encode()
+		}
+		resp, err := client.Get(u.String())
+		if err != nil {
+			t.Fatalf("GET %s: %v", u, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := step(a.app.URL+"/auth/oidc/login"+query, nil)
+	if resp.StatusCode != http.StatusFound {
+		return resp
+	}
+	resp = step(resp.Header.Get("Location"), authorize)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	return step(resp.Header.Get("Location"), callback)
+}
+
+// sessionCookie — check if the response logged the browser in
+func sessionCookie(resp *http.Response) bool {
+	for _, c := range resp.Cookies() {
+		if c.Name == accessCookieName && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOIDCLoginRejectsTamperedFlow(t *testing.T) {
+	a := newOIDCTestApp(t)
+	tests := []struct {
+		name      string
+		authorize func(url.Values)
+		callback  func(url.Values)
+		status    int
+	}{
+		{"state mismatch", nil, func(q url.Values) { q.Set("state", "forged") }, http.StatusBadRequest},
+		{"missing state", nil, func(q url.Values) { q.Del("state") }, http.StatusBadRequest},
+		// Код перехвачен, но verifier к нему не подходит — IdP не выдаёт токен
+		{
+			"PKCE mismatch",
+			func(q url.Values) {
+				q.Set("code_challenge", oauth2.S256ChallengeFromVerifier(oauth2.GenerateVerifier()))
+			},
+			nil,
+			http.StatusUnauthorized,
+		},
+		// ID token выдан под другой вход
+		{"nonce mismatch", func(q url.Values) { q.Set("nonce", "forged") }, nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		resp := a.login(t, "", "", tt.authorize, tt.callback)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if sessionCookie(resp) {
+			t.Errorf("%s: session started", tt.name)
+		}
+	}
+	var users int
+	if err := db.Get(&users, "SELECT COUNT(*) FROM users"); err != nil {
+		t.Fatalf("count users: %v", err)
+	}
+	if users != 0 {
+		t.Errorf("%d users provisioned by rejected logins", users)
+	}
+}
+
+func TestOIDCLoginProvisionsAndLinks(t *testing.T) {
+	a := newOIDCTestApp(t)
+	// Локальные пользователи: stub.user занимает имя из preferred_username, alice привязывает SSO
+	for _, name := range []string{"stub.user", "alice"} {
+		if _, err := db.Exec("INSERT INTO users (username, password) VALUES ($1, $2)", name, "hash"); err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+	}
+	access, _, err := createSession(2)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	linkedUser := func(subject string) (id int, username string) {
+		t.Helper()
+		if err := db.QueryRow(
+			`SELECT u.id, u.username FROM user_identities i JOIN users u ON u.id = i.user_id
+			WHERE i.subject=$1`,
+			subject,
+		).Scan(&id, &username); err != nil {
+			t.Fatalf("identity %s: %v", subject, err)
+		}
+		return id, username
+	}
+	hint := func(subject string) func(url.Values) {
+		return func(q url.Values) { q.Set("login_hint", subject) }
+	}
+
+	// Первый вход — новый пользователь, имя занято, поэтому с суффиксом
+	resp := a.login(t, "", "", nil, nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" || !sessionCookie(resp) {
+		t.Fatalf("first login: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	provisioned, username := linkedUser("stub-user-1")
+	if provisioned == 1 || provisioned == 2 || !strings.HasPrefix(username, "stub.user-") {
+		t.Errorf("first login provisioned user %d %q, want a new stub.user-*", provisioned, username)
+	}
+
+	// Повторный вход — тот же пользователь
+	if resp := a.login(t, "", "", nil, nil); resp.StatusCode != http.StatusFound || !sessionCookie(resp) {
+		t.Errorf("second login: status %d", resp.StatusCode)
+	}
+	if id, _ := linkedUser("stub-user-1"); id != provisioned {
+		t.Errorf("second login resolved user %d, want %d", id, provisioned)
+	}
+
+	// Вошедший пользователь alice привязывает к себе новую identity, а чужую — не может
+	if resp := a.login(t, "?link=1", access, hint("alice-sso"), nil); resp.StatusCode != http.StatusFound {
+		t.Errorf("link: status %d", resp.StatusCode)
+	}
+	if id, _ := linkedUser("alice-sso"); id != 2 {
+		t.Errorf("link attached identity to user %d, want 2", id)
+	}
+	if resp := a.login(t, "?link=1", access, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("link of an identity of another user: status %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if resp := a.login(t, "?link=1", "", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("link without login: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	var users int
+	if err := db.Get(&users, "SELECT COUNT(*) FROM users"); err != nil {
+		t.Fatalf("count users: %v", err)
+	}
+	if users != 3 {
+		t.Errorf("%d users, want 3: linking must not provision", users)
+	}
+}
+
+func TestOIDCLoginRequiresTOTP(t *testing.T) {
+	a := newOIDCTestApp(t)
+	if resp := a.login(t, "", "", nil, nil); resp.StatusCode != http.StatusFound || !sessionCookie(resp) {
+		t.Fatalf("first login: status %d", resp.StatusCode)
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "stub.user"})
+	if err != nil {
+		t.Fatalf("generate secret: %v", err)
+	}
+	if _, err := db.Exec("UPDATE users SET totp_secret=$1, totp_enabled=$2", key.Secret(), true); err != nil {
+		t.Fatalf("enable TOTP: %v", err)
+	}
+
+	// IdP подтвердил личность, но без второго фактора сессии нет
+	resp := a.login(t, "", "", nil, nil)
+	fragment, ok := strings.CutPrefix(resp.Header.Get("Location"), "/#mfa=")
+	if resp.StatusCode != http.StatusFound || !ok || sessionCookie(resp) {
+		t.Fatalf("login with TOTP: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	mfaToken, err := url.QueryUnescape(fragment)
+	if err != nil {
+		t.Fatalf("unescape MFA token: %v", err)
+	}
+
+	code, err := totp.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	stale, err := totp.GenerateCode(key.Secret(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+	tests := []struct {
+		name   string
+		code   string
+		status int
+	}{
+		{"stale code", stale, http.StatusUnauthorized},
+		{"valid code", code, http.StatusOK},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(map[string]string{"mfaToken": mfaToken, "code": tt.code})
+		w := httptest.NewRecorder()
+		loginTOTP(w, httptest.NewRequest(http.MethodPost, "/login/totp", strings.NewReader(string(body))))
+		if w.Code != tt.status || sessionCookie(w.Result()) != (tt.status == http.StatusOK) {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
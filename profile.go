@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/image/draw"
+
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+const (
+	displayNameMaxLength = 64
+	// avatarMaxDimension — проверяем до декодирования, чтобы не распаковать «бомбу»
+	avatarMaxDimension = 4096
+	avatarSize         = 256
+	avatarThumbSize    = 64
+	avatarURLPrefix    = "/avatars/"
+
+	MsgTypeParticipants       = "participants"
+	MsgTypeParticipantJoined  = "participant_joined"
+	MsgTypeParticipantLeft    = "participant_left"
+	MsgTypeParticipantUpdated = "participant_updated"
+)
+
+var errUnsupportedImage = errors.New("unsupported image type")
+
+// allowedAvatarTypes — content types accepted for avatar upload
+var allowedAvatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// ParticipantDTO — participant entry in participant lists and join events
+type ParticipantDTO struct {
+	ClientID    string `json:"clientId"`
+	UserID      int    `json:"userId"`
+	DisplayName string `json:"displayName"`
+	AvatarURL   string `json:"avatarUrl,omitempty"` // миниатюра
+	Role        string `json:"role,omitempty"`
+	ServerMuted bool   `json:"serverMuted,omitempty"`
+	HandRaised  bool   `json:"handRaised,omitempty"`
+	Talking     bool   `json:"talking,omitempty"` // держит push-to-talk
+	Quality     string `json:"quality,omitempty"` // качество соединения, пусто — ещё не оценено
+}
+
+// Name — display name or username as fallback
+func (u User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+// avatarURL — public URL of the full avatar
+func avatarURL(avatar string) string {
+	if avatar == "" {
+		return ""
+	}
+	return avatarURLPrefix + avatar + ".png"
+}
+
+// avatarThumbURL — public URL of the avatar thumbnail
+func avatarThumbURL(avatar string) string {
+	if avatar == "" {
+		return ""
+	}
+	return avatarURLPrefix + avatar + "_thumb.png"
+}
+
+// loadParticipantProfile — fill client profile fields from users table
+func loadParticipantProfile(client *Client) {
+	var user User
+	if err := db.Get(&user, "SELECT * FROM users WHERE id=$1", client.UserID); err != nil {
+		slog.Error("load participant profile", "userID", client.UserID, "error", err)
+		user.Username = client.ID
+	}
+	client.Mu.Lock()
+	defer client.Mu.Unlock()
+	client.DisplayName = user.Name()
+	client.AvatarURL = avatarThumbURL(user.Avatar)
+}
+
+// Participant — participant DTO for the client
+func (c *Client) Participant() ParticipantDTO {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return ParticipantDTO{
+		ClientID:    c.ID,
+		UserID:      c.UserID,
+		DisplayName: c.DisplayName,
+		AvatarURL:   c.AvatarURL,
+		Role:        c.Role,
+		ServerMuted: c.ServerMuted,
+		HandRaised:  c.HandRaised,
+		Talking:     c.Talking,
+		Quality:     c.Quality,
+	}
+}
+
+// validateDisplayName — check display name policy
+func validateDisplayName(name string) []FieldError {
+	switch {
+	case name == "":
+		return nil // пустое имя — показываем username
+	case utf8.RuneCountInString(name) > displayNameMaxLength:
+		return []FieldError{{Field: "displayName", Code: "too_long", Message: "Display name must be at most 64 characters"}}
+	}
+	for _, ch := range name {
+		if unicode.IsControl(ch) {
+			return []FieldError{{Field: "displayName", Code: "invalid_characters", Message: "Display name must not contain control characters"}}
+		}
+	}
+	return nil
+}
+
+// updateProfile — change display name via REST
+func (s *Server) updateProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DisplayName string `json:"displayName"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	req.DisplayName = strings.TrimSpace(req.DisplayName)
+	if fields := validateDisplayName(req.DisplayName); len(fields) > 0 {
+		writeValidationErrors(w, fields)
+		return
+	}
+
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET display_name=$1 WHERE id=$2", req.DisplayName, userID); err != nil {
+		slog.Error("update display name", "userID", userID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.refreshParticipantProfiles(userID)
+	slog.Info("Profile updated", "userID", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadAvatar — validate, thumbnail and store avatar image via REST
+func (s *Server) uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	// Запас на заголовки multipart сверх лимита на сам файл
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.AvatarMaxBytes+64<<10)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeValidationErrors(
+				w, []FieldError{{Field: "avatar", Code: "too_large", Message: "Avatar must be at most " + strconv.FormatInt(cfg.AvatarMaxBytes>>10, 10) + " KiB"}},
+			)
+			return
+		}
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, cfg.AvatarMaxBytes+1))
+	if err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > cfg.AvatarMaxBytes {
+		writeValidationErrors(
+			w, []FieldError{{Field: "avatar", Code: "too_large", Message: "Avatar must be at most " + strconv.FormatInt(cfg.AvatarMaxBytes>>10, 10) + " KiB"}},
+		)
+		return
+	}
+
+	full, thumb, err := processAvatar(data)
+	if err != nil {
+		slog.Warn("Avatar rejected", "userID", user.ID, "error", err)
+		writeValidationErrors(
+			w, []FieldError{{Field: "avatar", Code: "invalid_image", Message: "Avatar must be a PNG, JPEG or GIF image up to 4096x4096"}},
+		)
+		return
+	}
+
+	suffix, err := randomToken(8)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	avatar := fmt.Sprintf("%d-%s", user.ID, suffix)
+	if err := writeAvatarFiles(avatar, full, thumb); err != nil {
+		slog.Error("write avatar", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET avatar=$1 WHERE id=$2", avatar, user.ID); err != nil {
+		slog.Error("update avatar", "userID", user.ID, "error", err)
+		removeAvatarFiles(avatar)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	removeAvatarFiles(user.Avatar)
+
+	s.refreshParticipantProfiles(user.ID)
+	slog.Info("Avatar uploaded", "userID", user.ID)
+	writeJSON(
+		w, http.StatusOK, map[string]string{
+			"avatarUrl":      avatarURL(avatar),
+			"avatarThumbUrl": avatarThumbURL(avatar),
+		},
+	)
+}
+
+// deleteAvatar — remove avatar via REST
+func (s *Server) deleteAvatar(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET avatar='' WHERE id=$1", user.ID); err != nil {
+		slog.Error("clear avatar", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	removeAvatarFiles(user.Avatar)
+	s.refreshParticipantProfiles(user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// processAvatar — decode image, crop to square and render full size and thumbnail PNGs
+func processAvatar(data []byte) ([]byte, []byte, error) {
+	if !allowedAvatarTypes[http.DetectContentType(data)] {
+		return nil, nil, errUnsupportedImage
+	}
+	imgCfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !allowedAvatarTypes["image/"+format] {
+		return nil, nil, errUnsupportedImage
+	}
+	if imgCfg.Width > avatarMaxDimension || imgCfg.Height > avatarMaxDimension {
+		return nil, nil, fmt.Errorf("image too large: %dx%d", imgCfg.Width, imgCfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	full, err := encodeSquare(src, avatarSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	thumb, err := encodeSquare(src, avatarThumbSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return full, thumb, nil
+}
+
+// encodeSquare — center-crop image to square, scale to size and encode PNG
+func encodeSquare(src image.Image, size int) ([]byte, error) {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(
+		b.Min.X+(b.Dx()-side)/2,
+		b.Min.Y+(b.Dy()-side)/2,
+		b.Min.X+(b.Dx()-side)/2+side,
+		b.Min.Y+(b.Dy()-side)/2+side,
+	)
+	if side < size {
+		size = side // маленькие картинки не растягиваем
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAvatarFiles — store full size avatar and thumbnail on disk
+func writeAvatarFiles(avatar string, full, thumb []byte) error {
+	if err := os.MkdirAll(cfg.AvatarDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(cfg.AvatarDir, avatar+".png"), full, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cfg.AvatarDir, avatar+"_thumb.png"), thumb, 0o644)
+}
+
+// removeAvatarFiles — delete avatar files, missing files are ignored
+func removeAvatarFiles(avatar string) {
+	if avatar == "" {
+		return
+	}
+	for _, name := range []string{avatar + ".png", avatar + "_thumb.png"} {
+		if err := os.Remove(filepath.Join(cfg.AvatarDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("remove avatar file", "file", name, "error", err)
+		}
+	}
+}
+
+// serveAvatars — serve avatar files without directory listing
+func serveAvatars() http.Handler {
+	files := http.StripPrefix(avatarURLPrefix, http.FileServer(http.Dir(cfg.AvatarDir)))
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/") {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Cache-Control", "private, max-age=86400")
+			files.ServeHTTP(w, r)
+		},
+	)
+}
+
+// refreshParticipantProfiles — reload profile of connected clients and notify their rooms
+func (s *Server) refreshParticipantProfiles(userID int) {
+	s.RoomsMu.Lock()
+	rooms := make([]*Room, 0, len(s.Rooms))
+	for _, room := range s.Rooms {
+		rooms = append(rooms, room)
+	}
+	s.RoomsMu.Unlock()
+
+	for _, room := range rooms {
+		for _, client := range room.GetClients() {
+			if client.UserID != userID {
+				continue
+			}
+			loadParticipantProfile(client)
+			room.Broadcast(
+				WebSocketMessageDTO{
+					Type:        MsgTypeParticipantUpdated,
+					RoomID:      room.ID,
+					Participant: ptr(client.Participant()),
+				}, "",
+			)
+		}
+	}
+}
+
+// ptr — pointer to value
+func ptr[T any](v T) *T {
+	return &v
+}
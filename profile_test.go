@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var (
+	stripeRed   = color.RGBA{R: 255, A: 255}
+	stripeGreen = color.RGBA{G: 255, A: 255}
+	stripeBlue  = color.RGBA{B: 255, A: 255}
+)
+
+// stripedImage — image in three equal stripes red, green, blue: across if it is wide, down if tall
+func stripedImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			stripe := x * 3 / width
+			if height > width {
+				stripe = y * 3 / height
+			}
+			img.Set(x, y, []color.RGBA{stripeRed, stripeGreen, stripeBlue}[stripe])
+		}
+	}
+	return img
+}
+
+// encodeImage — image encoded in the format
+func encodeImage(t *testing.T, img image.Image, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("encode %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+// nearColor — check if the colors match up to compression noise
+func nearColor(c color.Color, want color.RGBA) bool {
+	r, g, b, _ := c.RGBA()
+	diff := func(got uint32, want uint8) bool {
+		d := int(got>>8) - int(want)
+		return d > -48 && d < 48
+	}
+	return diff(r, want.R) && diff(g, want.G) && diff(b, want.B)
+}
+
+func TestProcessAvatar(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		full  int // сторона большой картинки, 0 — картинку не принимаем
+		thumb int
+	}{
+		{"wide PNG", encodeImage(t, stripedImage(900, 300), "png"), avatarSize, avatarThumbSize},
+		{"tall JPEG", encodeImage(t, stripedImage(300, 900), "jpeg"), avatarSize, avatarThumbSize},
+		{"GIF", encodeImage(t, stripedImage(600, 600), "gif"), avatarSize, avatarThumbSize},
+		// Маленькие картинки не растягиваем
+		{"smaller than the thumbnail", encodeImage(t, stripedImage(120, 40), "png"), 40, 40},
+		{"between the sizes", encodeImage(t, stripedImage(300, 100), "png"), 100, avatarThumbSize},
+		{"at the dimension limit", encodeImage(t, stripedImage(avatarMaxDimension, 3), "png"), 3, 3},
+		{"wider than the limit", encodeImage(t, stripedImage(avatarMaxDimension+1, 3), "png"), 0, 0},
+		{"taller than the limit", encodeImage(t, stripedImage(3, avatarMaxDimension+1), "png"), 0, 0},
+		{"not an image", []byte("<html><body>avatar</body></html>"), 0, 0},
+		{"empty", nil, 0, 0},
+		// Тип определяем по содержимому: BMP и WebP не принимаем, даже если декодер нашёлся бы
+		{"BMP", append([]byte("BM"), make([]byte, 64)...), 0, 0},
+		{"WebP", append([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), make([]byte, 64)...), 0, 0},
+		{"truncated PNG", encodeImage(t, stripedImage(90, 30), "png")[:40], 0, 0},
+	}
+	for _, tt := range tests {
+		full, thumb, err := processAvatar(tt.data)
+		if tt.full == 0 {
+			if err == nil {
+				t.Errorf("%s: accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for _, out := range []struct {
+			data []byte
+			side int
+		}{{full, tt.full}, {thumb, tt.thumb}} {
+			img, format, err := image.Decode(bytes.NewReader(out.data))
+			if err != nil || format != "png" {
+				t.Errorf("%s: output %q: %v", tt.name, format, err)
+				continue
+			}
+			if b := img.Bounds(); b.Dx() != out.side || b.Dy() != out.side {
+				t.Errorf("%s: output %dx%d, want %dx%d", tt.name, b.Dx(), b.Dy(), out.side, out.side)
+			}
+		}
+	}
+
+	if _, _, err := processAvatar([]byte("plain text")); !errors.Is(err, errUnsupportedImage) {
+		t.Errorf("text: error %v, want %v", err, errUnsupportedImage)
+	}
+}
+
+func TestProcessAvatarCrop(t *testing.T) {
+	for _, format := range []string{"png", "jpeg"} {
+		for _, size := range [][2]int{{900, 300}, {300, 900}} {
+			full, thumb, err := processAvatar(encodeImage(t, stripedImage(size[0], size[1]), format))
+			if err != nil {
+				t.Fatalf("%s %dx%d: %v", format, size[0], size[1], err)
+			}
+			for _, data := range [][]byte{full, thumb} {
+				img, err := png.Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("decode output: %v", err)
+				}
+				// От квадрата по центру остаётся только средняя, зелёная полоса
+				b := img.Bounds()
+				for _, p := range []image.Point{
+					{2, 2}, {b.Dx() - 3, 2}, {2, b.Dy() - 3}, {b.Dx() - 3, b.Dy() - 3}, {b.Dx() / 2, b.Dy() / 2},
+				} {
+					if c := img.At(p.X, p.Y); !nearColor(c, stripeGreen) {
+						t.Errorf("%s %dx%d -> %d: pixel %v is %v, want green", format, size[0], size[1], b.Dx(), p, c)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	MsgTypePTTStart   = "ptt_start"
+	MsgTypePTTStop    = "ptt_stop"
+	MsgTypePTTTimeout = "ptt_timeout"
+
+	PTTErrDisabled = "ptt_disabled"
+
+	// voiceHangover — сколько ещё считать приоритетного спикера говорящим после пакета с голосом
+	voiceHangover = 500 * time.Millisecond
+	// voiceLevelThreshold — уровень RFC 6464 в -dBov: 0 — громко, 127 — тишина
+	voiceLevelThreshold = 50
+)
+
+// isPushToTalk — check if the room forwards audio only during ptt_start/ptt_stop
+func (r *Room) isPushToTalk() bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.PushToTalk
+}
+
+// markPriorityVoice — priority speaker is talking, duck others until the deadline
+func (r *Room) markPriorityVoice(until time.Time) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if until.After(r.PriorityUntil) {
+		r.PriorityUntil = until
+	}
+}
+
+// priorityActive — check if a priority speaker is talking right now
+func (r *Room) priorityActive() bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return time.Now().Before(r.PriorityUntil)
+}
+
+// isTalking — check if client holds push-to-talk
+func (c *Client) isTalking() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Talking
+}
+
+// resetTalking — release push-to-talk without notifying anyone
+func (c *Client) resetTalking() {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.Talking = false
+	c.pttSeq++
+	if c.pttTimer != nil {
+		c.pttTimer.Stop()
+		c.pttTimer = nil
+	}
+}
+
+// audioLevelExtensionID — negotiated ID of the RFC 6464 audio level extension, 0 if absent
+func audioLevelExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.AudioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// hasVoice — check packet audio level, without the extension every packet counts as voice
+func hasVoice(pkt *rtp.Packet, levelExtID uint8) bool {
+	if levelExtID == 0 {
+		return true
+	}
+	payload := pkt.GetExtension(levelExtID)
+	if payload == nil {
+		return true
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(payload); err != nil {
+		return true
+	}
+	return level.Level < voiceLevelThreshold
+}
+
+// shouldForward — per-packet policy: role, server mute, push-to-talk and priority ducking
+func (c *Client) shouldForward(room *Room, pkt *rtp.Packet, levelExtID uint8) bool {
+	if !c.CanPublish(room) {
+		return false
+	}
+	if room.isPushToTalk() && !c.isTalking() {
+		return false
+	}
+	if c.RoomRole() == RoomRolePrioritySpeaker {
+		if hasVoice(pkt, levelExtID) {
+			room.markPriorityVoice(time.Now().Add(voiceHangover))
+		}
+		return true
+	}
+	// Пока говорит приоритетный спикер, остальных не пересылаем
+	return !room.priorityActive()
+}
+
+// handlePTT — push-to-talk start and stop
+func (s *Server) handlePTT(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	room := client.CurrentRoom()
+	if !room.isPushToTalk() {
+		return WebSocketMessageDTO{Type: MsgTypeError, Code: PTTErrDisabled, Message: "Push-to-talk is not enabled in this room"}
+	}
+	talking := msg.Type == MsgTypePTTStart
+	if talking && roleRank[client.RoomRole()] < roleRank[RoomRoleSpeaker] {
+		return moderationError(ModErrForbidden, "Listeners cannot talk")
+	}
+
+	client.Mu.Lock()
+	changed := client.Talking != talking
+	client.Talking = talking
+	// pttSeq отсекает таймер от предыдущего нажатия, который успел сработать
+	client.pttSeq++
+	seq := client.pttSeq
+	if client.pttTimer != nil {
+		client.pttTimer.Stop()
+		client.pttTimer = nil
+	}
+	if talking {
+		client.pttTimer = time.AfterFunc(cfg.PTTTimeout, func() { s.pttTimeout(client, room, seq) })
+	}
+	client.Mu.Unlock()
+
+	if changed {
+		room.broadcastUpdated([]*Client{client})
+	}
+	return WebSocketMessageDTO{Type: msg.Type + "_ack"}
+}
+
+// pttTimeout — release push-to-talk held longer than allowed
+func (s *Server) pttTimeout(client *Client, room *Room, seq int) {
+	client.Mu.Lock()
+	expired := client.pttSeq == seq && client.Talking
+	if expired {
+		client.Talking = false
+		client.pttTimer = nil
+	}
+	client.Mu.Unlock()
+	if !expired {
+		return
+	}
+
+	slog.Info("Push-to-talk timed out", "clientID", client.ID, "roomID", room.ID)
+	room.broadcastUpdated([]*Client{client})
+	if err := client.Send(
+		WebSocketMessageDTO{Type: MsgTypePTTTimeout, RoomID: room.ID, Message: "Push-to-talk released after timeout"},
+	); err != nil {
+		slog.Error("notify ptt timeout", "clientID", client.ID, "error", err)
+	}
+}
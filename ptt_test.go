@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const testLevelExtID = 1
+
+// levelPacket — RTP packet with the RFC 6464 audio level, negative level — without the extension
+func levelPacket(t *testing.T, level int) *rtp.Packet {
+	t.Helper()
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2}}
+	if level < 0 {
+		return pkt
+	}
+	payload, err := rtp.AudioLevelExtension{Level: uint8(level), Voice: true}.Marshal()
+	if err != nil {
+		t.Fatalf("marshal audio level: %v", err)
+	}
+	if err := pkt.SetExtension(testLevelExtID, payload); err != nil {
+		t.Fatalf("set audio level: %v", err)
+	}
+	return pkt
+}
+
+func TestShouldForward(t *testing.T) {
+	tests := []struct {
+		name    string
+		ptt     bool
+		role    string
+		talking bool
+		muted   bool
+		want    bool
+	}{
+		{"speaker", false, RoomRoleSpeaker, false, false, true},
+		{"listener", false, RoomRoleListener, false, false, false},
+		{"server muted", false, RoomRoleSpeaker, false, true, false},
+		{"push-to-talk released", true, RoomRoleSpeaker, false, false, false},
+		{"push-to-talk held", true, RoomRoleSpeaker, true, false, true},
+		{"push-to-talk held by muted", true, RoomRoleSpeaker, true, true, false},
+		{"push-to-talk held by listener", true, RoomRoleListener, true, false, false},
+		// Приоритетный спикер в PTT-комнате тоже говорит только с кнопкой
+		{"priority speaker released", true, RoomRolePrioritySpeaker, false, false, false},
+		{"priority speaker", false, RoomRolePrioritySpeaker, false, false, true},
+	}
+	for _, tt := range tests {
+		room := NewRoom("room")
+		room.PushToTalk = tt.ptt
+		client := NewClient("client", room, nil, 1)
+		client.Role = tt.role
+		client.Talking = tt.talking
+		client.ServerMuted = tt.muted
+		if got := client.shouldForward(room, levelPacket(t, 10), testLevelExtID); got != tt.want {
+			t.Errorf("%s: forward %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Клиент, ушедший из комнаты, в неё не пересылается
+	room := NewRoom("room")
+	client := NewClient("client", NewRoom("other"), nil, 1)
+	client.Role = RoomRoleSpeaker
+	if client.shouldForward(room, levelPacket(t, 10), testLevelExtID) {
+		t.Error("forwarded into a room the client left")
+	}
+}
+
+func TestPriorityDucking(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  int // уровень пакета приоритетного спикера, -1 — без расширения
+		extID  uint8
+		ducked bool
+	}{
+		{"loud voice", 10, testLevelExtID, true},
+		{"silence", 127, testLevelExtID, false},
+		{"at the threshold", voiceLevelThreshold, testLevelExtID, false},
+		{"no extension negotiated", 127, 0, true},
+		{"packet without extension", -1, testLevelExtID, true},
+	}
+	for _, tt := range tests {
+		room := NewRoom("room")
+		priority := NewClient("priority", room, nil, 1)
+		priority.Role = RoomRolePrioritySpeaker
+		speaker := NewClient("speaker", room, nil, 2)
+		speaker.Role = RoomRoleSpeaker
+
+		if !priority.shouldForward(room, levelPacket(t, tt.level), tt.extID) {
+			t.Errorf("%s: priority speaker not forwarded", tt.name)
+		}
+		if got := speaker.shouldForward(room, levelPacket(t, 10), testLevelExtID); got == tt.ducked {
+			t.Errorf("%s: speaker forwarded %v, want %v", tt.name, got, !tt.ducked)
+		}
+		// Приоритетного спикера не приглушает никто, в том числе другой такой же
+		if tt.ducked && !priority.shouldForward(room, levelPacket(t, 127), testLevelExtID) {
+			t.Errorf("%s: priority speaker ducked", tt.name)
+		}
+	}
+
+	// После паузы длиннее hangover остальные снова слышны
+	room := NewRoom("room")
+	speaker := NewClient("speaker", room, nil, 2)
+	speaker.Role = RoomRoleSpeaker
+	room.markPriorityVoice(time.Now().Add(-time.Millisecond))
+	if !speaker.shouldForward(room, levelPacket(t, 10), testLevelExtID) {
+		t.Error("speaker ducked after the hangover")
+	}
+}
+
+func TestHandlePTT(t *testing.T) {
+	prev := cfg
+	cfg.PTTTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { cfg = prev })
+
+	s := NewServer()
+	room := NewRoom("room")
+	room.PushToTalk = true
+	speaker, peer := wsClient(t, "speaker", room, 1)
+	speaker.Role = RoomRoleSpeaker
+	listener, _ := wsClient(t, "listener", room, 2)
+	listener.Role = RoomRoleListener
+	room.AddClient(speaker)
+	room.AddClient(listener)
+
+	if resp := s.handlePTT(listener, WebSocketMessageDTO{Type: MsgTypePTTStart}); resp.Code != ModErrForbidden {
+		t.Errorf("listener ptt_start: %s %q", resp.Type, resp.Code)
+	}
+	if resp := s.handlePTT(speaker, WebSocketMessageDTO{Type: MsgTypePTTStart}); resp.Type != MsgTypePTTStart+"_ack" {
+		t.Fatalf("ptt_start: %s %q", resp.Type, resp.Message)
+	}
+	if !speaker.isTalking() {
+		t.Fatal("not talking after ptt_start")
+	}
+
+	// Зажатую кнопку сервер отпускает сам
+	for {
+		msg := readMessage(t, peer)
+		if msg.Type == MsgTypePTTTimeout {
+			break
+		}
+	}
+	if speaker.isTalking() {
+		t.Error("still talking after timeout")
+	}
+
+	room.PushToTalk = false
+	if resp := s.handlePTT(speaker, WebSocketMessageDTO{Type: MsgTypePTTStart}); resp.Code != PTTErrDisabled {
+		t.Errorf("ptt_start without push-to-talk: %s %q", resp.Type, resp.Code)
+	}
+}
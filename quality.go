@@ -0,0 +1,320 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	MsgTypeConnectionQuality = "connection_quality"
+
+	ConnectionQualityExcellent = "excellent"
+	ConnectionQualityGood      = "good"
+	ConnectionQualityPoor      = "poor"
+	ConnectionQualityBad       = "bad"
+
+	// qualityInterval — как часто пересчитываем качество соединения участников
+	qualityInterval = 5 * time.Second
+	// ntpEpochOffset — секунды между эпохами NTP (1900) и Unix (1970)
+	ntpEpochOffset = 2208988800
+)
+
+// StreamStatsDTO — loss and jitter of one RTP stream in one direction
+type StreamStatsDTO struct {
+	ClientID     string  `json:"clientId,omitempty"` // чья дорожка; у слотов Last-N и сведения пусто
+	TrackID      string  `json:"trackId"`
+	RID          string  `json:"rid,omitempty"`
+	FractionLost float64 `json:"fractionLost"` // доля потерь за последний интервал отчёта
+	TotalLost    uint32  `json:"totalLost"`
+	JitterMs     float64 `json:"jitterMs"`
+	RTTMs        float64 `json:"rttMs,omitempty"`   // только downstream: по LSR/DLSR отчёта
+	Bitrate      uint64  `json:"bitrate,omitempty"` // только upstream, бит/с
+}
+
+// ConnectionStatsDTO — raw connection numbers of a participant and the quality computed from them
+type ConnectionStatsDTO struct {
+	ClientID      string                        `json:"clientId"`
+	Quality       string                        `json:"quality,omitempty"` // пусто, пока оценивать нечего
+	Score         float64                       `json:"score,omitempty"`   // MOS от 1 до 5
+	RTTMs         float64                       `json:"rttMs"`
+	Upstream      []StreamStatsDTO              `json:"upstream"`   // что участник шлёт серверу
+	Downstream    []StreamStatsDTO              `json:"downstream"` // что сервер шлёт участнику, по его отчётам
+	CandidatePair *webrtc.ICECandidatePairStats `json:"candidatePair,omitempty"`
+}
+
+// downstreamReport — receiver report about a track we send, with the round trip measured on arrival
+type downstreamReport struct {
+	rtcp.ReceptionReport
+	rtt time.Duration
+}
+
+// senderSSRC — SSRC of a track we send, 0 before negotiation
+func senderSSRC(sender *webrtc.RTPSender) uint32 {
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		return uint32(encodings[0].SSRC)
+	}
+	return 0
+}
+
+// matchReport — reception report about the SSRC from a receiver report that arrived at the time
+func matchReport(rr *rtcp.ReceiverReport, ssrc uint32, at time.Time) (downstreamReport, bool) {
+	for _, report := range rr.Reports {
+		if report.SSRC != ssrc {
+			continue
+		}
+		result := downstreamReport{ReceptionReport: report}
+		if report.LastSenderReport != 0 {
+			// RFC 3550 6.4.1: RTT = A - LSR - DLSR в единицах 1/65536 секунды
+			if rtt := int32(ntpMiddle(at) - report.LastSenderReport - report.Delay); rtt > 0 {
+				result.rtt = time.Duration(rtt) * time.Second / 65536
+			}
+		}
+		return result, true
+	}
+	return downstreamReport{}, false
+}
+
+// ntpMiddle — middle 32 bits of the NTP timestamp, as in LSR
+func ntpMiddle(t time.Time) uint32 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(seconds<<16 | fraction>>16)
+}
+
+// streamStats — report as seen in the admin stats
+func streamStats(report rtcp.ReceptionReport, clockRate uint32) StreamStatsDTO {
+	stats := StreamStatsDTO{
+		FractionLost: float64(report.FractionLost) / 256,
+		TotalLost:    report.TotalLost,
+	}
+	if clockRate > 0 {
+		stats.JitterMs = float64(report.Jitter) * 1000 / float64(clockRate)
+	}
+	return stats
+}
+
+// upstreamStats — how the server receives tracks of the client
+func (c *Client) upstreamStats() []StreamStatsDTO {
+	streams := []StreamStatsDTO{}
+	for _, pub := range c.publications() {
+		clockRate := pub.Track.Codec().ClockRate
+		pub.mu.Lock()
+		for _, layer := range pub.layers {
+			if !layer.stats.started {
+				continue
+			}
+			stats := streamStats(layer.stats.last, clockRate)
+			stats.TrackID = pub.ID
+			stats.RID = layer.RID
+			stats.Bitrate = layer.bitrate
+			streams = append(streams, stats)
+		}
+		pub.mu.Unlock()
+	}
+	return streams
+}
+
+// downstreamStats — how the client receives what the server sends, from its receiver reports
+func (c *Client) downstreamStats() []StreamStatsDTO {
+	streams := []StreamStatsDTO{}
+	add := func(report downstreamReport, clockRate uint32, clientID, trackID string) {
+		if report.SSRC == 0 {
+			return // отчётов ещё не было
+		}
+		stats := streamStats(report.ReceptionReport, clockRate)
+		stats.ClientID = clientID
+		stats.TrackID = trackID
+		stats.RTTMs = float64(report.rtt) / float64(time.Millisecond)
+		streams = append(streams, stats)
+	}
+	if room := c.CurrentRoom(); room != nil {
+		for _, other := range room.GetClients() {
+			for _, pub := range other.publications() {
+				pub.mu.Lock()
+				sub := pub.subs[c.ID]
+				pub.mu.Unlock()
+				// Слоты посчитаем ниже, а у сведения своей дорожки нет
+				if sub == nil || sub.slot || sub.mix != nil {
+					continue
+				}
+				sub.mu.Lock()
+				report := sub.report
+				sub.mu.Unlock()
+				add(report, pub.Track.Codec().ClockRate, other.ID, pub.ID)
+			}
+		}
+	}
+	for _, slot := range c.slots() {
+		slot.Sub.mu.Lock()
+		report := slot.Sub.report
+		slot.Sub.mu.Unlock()
+		add(report, opusCodec.ClockRate, "", slot.Sub.Local.ID())
+	}
+	if m := c.mixer(); m != nil {
+		m.mu.Lock()
+		report := m.report
+		m.mu.Unlock()
+		add(report, opusCodec.ClockRate, "", mixStreamID)
+	}
+	return streams
+}
+
+// connectionStats — raw stats of the client connection and its quality score
+func (c *Client) connectionStats() ConnectionStatsDTO {
+	stats := ConnectionStatsDTO{
+		ClientID:   c.ID,
+		Upstream:   c.upstreamStats(),
+		Downstream: c.downstreamStats(),
+	}
+	if pc := c.peer(); pc != nil {
+		for _, s := range pc.GetStats() {
+			if pair, ok := s.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+				stats.CandidatePair = &pair
+				stats.RTTMs = pair.CurrentRoundTripTime * 1000
+			}
+		}
+	}
+	// Без STUN-проверок берём RTT из отчётов подписчика
+	if stats.RTTMs == 0 {
+		var sum float64
+		var n int
+		for _, s := range stats.Downstream {
+			if s.RTTMs > 0 {
+				sum += s.RTTMs
+				n++
+			}
+		}
+		if n > 0 {
+			stats.RTTMs = sum / float64(n)
+		}
+	}
+	if len(stats.Upstream) == 0 && len(stats.Downstream) == 0 && stats.RTTMs == 0 {
+		return stats
+	}
+
+	// Плохо хоть в одну сторону — значит, плохо: берём худшие потери и джиттер
+	var loss, jitter float64
+	for _, s := range slices.Concat(stats.Upstream, stats.Downstream) {
+		loss = max(loss, s.FractionLost)
+		jitter = max(jitter, s.JitterMs)
+	}
+	stats.Score = meanOpinionScore(stats.RTTMs, jitter, loss)
+	stats.Quality = qualityLevel(stats.Score)
+	return stats
+}
+
+// meanOpinionScore — simplified ITU-T G.107 E-model: MOS from 1 to 5 by RTT, jitter and loss
+func meanOpinionScore(rttMs, jitterMs, loss float64) float64 {
+	// Джиттер-буфер добавляет задержку примерно в два джиттера, плюс кодек
+	latency := rttMs/2 + 2*jitterMs + 10
+	r := 93.2 - latency/40
+	if latency >= 160 {
+		r = 93.2 - (latency-120)/10
+	}
+	r -= loss * 100 * 2.5
+	r = max(min(r, 100), 0)
+	mos := 1 + 0.035*r + 0.000007*r*(r-60)*(100-r)
+	return float64(int(mos*10+0.5)) / 10
+}
+
+// qualityLevel — quality level shown to users for a MOS
+func qualityLevel(mos float64) string {
+	switch {
+	case mos >= 4:
+		return ConnectionQualityExcellent
+	case mos >= 3.5:
+		return ConnectionQualityGood
+	case mos >= 2.5:
+		return ConnectionQualityPoor
+	}
+	return ConnectionQualityBad
+}
+
+// monitorQuality — score the client connection periodically and tell the room when the level changes
+func (c *Client) monitorQuality() {
+	ticker := time.NewTicker(qualityInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		stats := c.connectionStats()
+		c.Mu.Lock()
+		changed := stats.Quality != "" && stats.Quality != c.Quality
+		if changed {
+			c.Quality = stats.Quality
+		}
+		c.Mu.Unlock()
+		room := c.CurrentRoom()
+		if !changed || room == nil {
+			continue
+		}
+		slog.Info(
+			"Connection quality changed",
+			"clientID", c.ID, "quality", stats.Quality, "score", stats.Score, "rttMs", stats.RTTMs,
+		)
+		// Себе тоже: пусть видит, что проблема у него
+		room.Broadcast(
+			WebSocketMessageDTO{
+				Type: MsgTypeConnectionQuality, ClientID: c.ID, Quality: stats.Quality, Score: stats.Score,
+			}, "",
+		)
+	}
+}
+
+// isAdmin — check if the user may see server-wide diagnostics
+func isAdmin(user User) bool {
+	return slices.Contains(cfg.AdminUsers, user.Username)
+}
+
+// adminOnly — let through only users listed in GROK_ADMIN_USERS
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, ok := loadCurrentUser(r)
+			if !ok {
+				http.Error(w, "User not found", http.StatusUnauthorized)
+				return
+			}
+			if !isAdmin(user) {
+				http.Error(w, "Admin only", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		},
+	)
+}
+
+// roomStats — raw connection stats of everyone in the live room and its breakouts via REST
+func (s *Server) roomStats(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.liveRoom(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+	participants := []ConnectionStatsDTO{}
+	for _, part := range room.family() {
+		for _, client := range part.GetClients() {
+			participants = append(participants, client.connectionStats())
+		}
+	}
+	slices.SortFunc(
+		participants, func(a, b ConnectionStatsDTO) int {
+			switch {
+			case a.ClientID < b.ClientID:
+				return -1
+			case a.ClientID > b.ClientID:
+				return 1
+			}
+			return 0
+		},
+	)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"roomId": room.ID, "participants": participants})
+}
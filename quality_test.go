@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestMeanOpinionScore(t *testing.T) {
+	tests := []struct {
+		name   string
+		rttMs  float64
+		jitter float64
+		loss   float64
+		mos    float64
+		level  string
+	}{
+		{"perfect network", 0, 0, 0, 4.4, ConnectionQualityExcellent},
+		{"typical broadband", 50, 5, 0, 4.4, ConnectionQualityExcellent},
+		{"some loss", 100, 20, 0.01, 4.3, ConnectionQualityExcellent},
+		{"long distance", 300, 30, 0, 4.1, ConnectionQualityExcellent},
+		{"noticeable loss", 200, 10, 0.05, 3.9, ConnectionQualityGood},
+		{"satellite", 600, 50, 0, 3.3, ConnectionQualityPoor},
+		{"heavy loss", 100, 10, 0.2, 2.1, ConnectionQualityBad},
+		// R-фактор не уходит ниже нуля: MOS остаётся в пределах шкалы
+		{"half the packets lost", 100, 10, 0.5, 1, ConnectionQualityBad},
+		{"everything lost", 0, 0, 1, 1, ConnectionQualityBad},
+		{"huge delay", 2000, 0, 0, 1, ConnectionQualityBad},
+	}
+	for _, tt := range tests {
+		mos := meanOpinionScore(tt.rttMs, tt.jitter, tt.loss)
+		if mos != tt.mos {
+			t.Errorf("%s: meanOpinionScore(%v, %v, %v) = %v, want %v", tt.name, tt.rttMs, tt.jitter, tt.loss, mos, tt.mos)
+		}
+		if level := qualityLevel(mos); level != tt.level {
+			t.Errorf("%s: qualityLevel(%v) = %q, want %q", tt.name, mos, level, tt.level)
+		}
+	}
+}
+
+func TestMeanOpinionScoreMonotonic(t *testing.T) {
+	// Хуже любой из метрик — оценка не растёт, в том числе на стыке формулы при задержке 160 мс
+	prev := meanOpinionScore(0, 0, 0)
+	for rtt := 0.0; rtt <= 1000; rtt += 10 {
+		mos := meanOpinionScore(rtt, 0, 0)
+		if mos > prev {
+			t.Fatalf("MOS rose from %v to %v at RTT %v ms", prev, mos, rtt)
+		}
+		prev = mos
+	}
+	prev = meanOpinionScore(50, 5, 0)
+	for loss := 0.0; loss <= 1; loss += 0.01 {
+		mos := meanOpinionScore(50, 5, loss)
+		if mos > prev {
+			t.Fatalf("MOS rose from %v to %v at loss %v", prev, mos, loss)
+		}
+		prev = mos
+	}
+}
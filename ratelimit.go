@@ -0,0 +1,271 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Лимиты на IP: bcrypt на каждый запрос дорогой, поэтому держим их низкими
+	loginIPRate       = 10.0 / 60 // токенов в секунду
+	loginIPBurst      = 10
+	registerIPRate    = 3.0 / 60
+	registerIPBurst   = 3
+	usernameRate      = 5.0 / 60
+	usernameBurst     = 5
+	bucketIdleTimeout = 30 * time.Minute
+
+	// Прогрессивная блокировка по имени пользователя
+	lockoutThreshold   = 5
+	lockoutBase        = time.Minute
+	lockoutMax         = time.Hour
+	lockoutResetWindow = 24 * time.Hour
+)
+
+// AuditLoginLockout — audit event written when a username gets locked
+const AuditLoginLockout = "login_lockout"
+
+// tokenBucket — token bucket state for one key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter — per-key token bucket limiter
+type RateLimiter struct {
+	name    string
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// NewRateLimiter — create limiter with refill rate (tokens per second) and burst
+func NewRateLimiter(name string, rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		name:    name,
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// Allow — take a token for key, returns wait time when bucket is empty
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep — drop buckets that have been full and idle for a while
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < bucketIdleTimeout {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > bucketIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// loginFailures — failed login state for one username
+type loginFailures struct {
+	count       int
+	lockouts    int // сколько раз уже блокировали — от этого растёт срок
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// LoginGuard — progressive lockout after failed logins
+type LoginGuard struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+	swept    time.Time
+}
+
+// NewLoginGuard — create a new login guard
+func NewLoginGuard() *LoginGuard {
+	return &LoginGuard{
+		failures: make(map[string]*loginFailures),
+		swept:    time.Now(),
+	}
+}
+
+// Locked — check if username is locked, returns remaining lock time
+func (g *LoginGuard) Locked(username string) (bool, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.failures[strings.ToLower(username)]
+	if !ok {
+		return false, 0
+	}
+	if remaining := time.Until(f.lockedUntil); remaining > 0 {
+		return true, remaining
+	}
+	return false, 0
+}
+
+// Fail — register failed attempt, returns lock duration if username got locked
+func (g *LoginGuard) Fail(username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := strings.ToLower(username)
+	now := time.Now()
+	g.sweep(now)
+
+	f, ok := g.failures[key]
+	if !ok || now.Sub(f.lastFailure) > lockoutResetWindow {
+		f = &loginFailures{}
+		g.failures[key] = f
+	}
+	f.count++
+	f.lastFailure = now
+
+	if f.count < lockoutThreshold {
+		return 0
+	}
+
+	lock := lockoutBase << f.lockouts
+	if lock > lockoutMax || lock <= 0 {
+		lock = lockoutMax
+	}
+	f.lockouts++
+	f.count = 0
+	f.lockedUntil = now.Add(lock)
+	return lock
+}
+
+// sweep — drop stale entries so random usernames don't grow the map forever
+func (g *LoginGuard) sweep(now time.Time) {
+	if now.Sub(g.swept) < bucketIdleTimeout {
+		return
+	}
+	for key, f := range g.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.lastFailure) > lockoutResetWindow {
+			delete(g.failures, key)
+		}
+	}
+	g.swept = now
+}
+
+// Succeed — reset failures after successful login
+func (g *LoginGuard) Succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.failures, strings.ToLower(username))
+}
+
+var (
+	loginIPLimiter    = NewRateLimiter("login_ip", loginIPRate, loginIPBurst)
+	registerIPLimiter = NewRateLimiter("register_ip", registerIPRate, registerIPBurst)
+	usernameLimiter   = NewRateLimiter("username", usernameRate, usernameBurst)
+	loginGuard        = NewLoginGuard()
+)
+
+// clientIP — client IP address, X-Forwarded-For only behind trusted proxy
+func clientIP(r *http.Request) string {
+	if cfg.TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ip, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests — write 429 with Retry-After in whole seconds
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// rateLimitByIP — middleware limiting requests per client IP
+func rateLimitByIP(limiter *RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			if ok, wait := limiter.Allow(ip); !ok {
+				// В БД не пишем: под нагрузкой это только усилит DoS
+				slog.Warn("Rate limited", "limiter", limiter.name, "ip", ip, "path", r.URL.Path)
+				tooManyRequests(w, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		},
+	)
+}
+
+// checkLoginAllowed — per-username limit and lockout check before bcrypt
+func checkLoginAllowed(w http.ResponseWriter, r *http.Request, username string) bool {
+	if locked, remaining := loginGuard.Locked(username); locked {
+		slog.Warn("Login attempt for locked username", "username", username, "ip", clientIP(r))
+		tooManyRequests(w, remaining)
+		return false
+	}
+	if ok, wait := usernameLimiter.Allow(strings.ToLower(username)); !ok {
+		slog.Warn("Rate limited", "limiter", usernameLimiter.name, "username", username, "ip", clientIP(r))
+		tooManyRequests(w, wait)
+		return false
+	}
+	return true
+}
+
+// registerLoginFailure — count failed attempt and audit lockout
+func registerLoginFailure(r *http.Request, username string) {
+	if lock := loginGuard.Fail(username); lock > 0 {
+		ip := clientIP(r)
+		slog.Warn("Username locked after failed logins", "username", username, "ip", ip, "duration", lock)
+		recordAudit(AuditLoginLockout, username, ip, "locked for "+lock.String())
+	}
+}
+
+// recordAudit — persist security audit event
+func recordAudit(event, username, ip, details string) {
+	slog.Info("Audit event", "event", event, "username", username, "ip", ip, "details", details)
+	if _, err := db.Exec(
+		"INSERT INTO audit_events (event, username, ip, details, created_at) VALUES ($1, $2, $3, $4, $5)",
+		event,
+		username,
+		ip,
+		details,
+		time.Now().UTC(),
+	); err != nil {
+		slog.Error("record audit event", "event", event, "error", err)
+	}
+}
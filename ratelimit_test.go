@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter("test", 1, 3)
+
+	tests := []struct {
+		name    string
+		key     string
+		elapsed time.Duration // сдвиг последнего обращения назад перед вызовом
+		allowed bool
+	}{
+		{"burst 1", "a", 0, true},
+		{"burst 2", "a", 0, true},
+		{"burst 3", "a", 0, true},
+		{"empty bucket", "a", 0, false},
+		{"other key has own bucket", "b", 0, true},
+		{"refilled one token", "a", time.Second, true},
+		{"empty again", "a", 0, false},
+		{"refill capped by burst 1", "a", time.Hour, true},
+		{"refill capped by burst 2", "a", 0, true},
+		{"refill capped by burst 3", "a", 0, true},
+		{"refill capped by burst 4", "a", 0, false},
+	}
+	for _, tt := range tests {
+		if b, ok := limiter.buckets[tt.key]; ok {
+			b.last = b.last.Add(-tt.elapsed)
+		}
+		allowed, wait := limiter.Allow(tt.key)
+		if allowed != tt.allowed {
+			t.Fatalf("%s: allowed = %v, want %v", tt.name, allowed, tt.allowed)
+		}
+		if allowed && wait != 0 {
+			t.Errorf("%s: wait = %v for an allowed request", tt.name, wait)
+		}
+		if !allowed && (wait <= 0 || wait > time.Second) {
+			t.Errorf("%s: wait = %v, want (0, 1s]", tt.name, wait)
+		}
+	}
+}
+
+func TestLoginGuardLockoutGrowth(t *testing.T) {
+	guard := NewLoginGuard()
+
+	// Каждая следующая блокировка вдвое длиннее, но не дольше lockoutMax
+	want := []time.Duration{
+		lockoutBase,
+		2 * lockoutBase,
+		4 * lockoutBase,
+		8 * lockoutBase,
+		16 * lockoutBase,
+		32 * lockoutBase,
+		lockoutMax,
+		lockoutMax,
+	}
+	for i, lock := range want {
+		for attempt := 1; attempt < lockoutThreshold; attempt++ {
+			if got := guard.Fail("Alice"); got != 0 {
+				t.Fatalf("lockout %d, attempt %d: locked for %v before the threshold", i, attempt, got)
+			}
+		}
+		if got := guard.Fail("alice"); got != lock {
+			t.Fatalf("lockout %d: locked for %v, want %v", i, got, lock)
+		}
+		if locked, remaining := guard.Locked("ALICE"); !locked || remaining > lock {
+			t.Fatalf("lockout %d: Locked = %v, %v", i, locked, remaining)
+		}
+	}
+
+	// Старые неудачи забываются после lockoutResetWindow
+	guard.failures["alice"].lastFailure = time.Now().Add(-lockoutResetWindow - time.Minute)
+	for attempt := 1; attempt < lockoutThreshold; attempt++ {
+		guard.Fail("alice")
+	}
+	if got := guard.Fail("alice"); got != lockoutBase {
+		t.Errorf("after reset window: locked for %v, want %v", got, lockoutBase)
+	}
+
+	guard.Succeed("alice")
+	if locked, _ := guard.Locked("alice"); locked {
+		t.Error("still locked after a successful login")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// maxSeqJump — больший скачок номеров внутри одного источника считаем его перезапуском
+const maxSeqJump = 3000
+
+// rtpRewriter — keeps sequence numbers and timestamps of one forwarded track continuous
+// across source switches and packets the SFU deliberately drops
+type rtpRewriter struct {
+	started   bool
+	stale     bool   // источник сменился, следующий пакет начнёт новый отрезок
+	source    string // RID слоя, пакеты которого сейчас пересылаем
+	seqOffset uint16
+	tsOffset  uint32
+	lastIn    uint16 // входящий номер последнего пакета источника, отправленного или пропущенного
+	lastSeq   uint16 // последний отправленный номер
+	lastTS    uint32
+	lastWrite time.Time
+	// segmentStart — исходящий номер, начиная с которого смещения не менялись;
+	// более старые пакеты по NACK уже не восстановить
+	segmentStart uint16
+}
+
+// seqNewer — check if a is after b with wraparound
+func seqNewer(a, b uint16) bool {
+	return a != b && a-b < 1<<15
+}
+
+// current — check if packets of the source continue the current segment
+func (r *rtpRewriter) current(source string) bool {
+	return r.started && !r.stale && r.source == source
+}
+
+// switchTo — forward another source from the packet on, continuing outgoing numbering and time
+func (r *rtpRewriter) switchTo(source string, pkt *rtp.Packet, clockRate uint32) {
+	if r.started {
+		// У источников свои нумерация и часы: продолжаем с того места, где остановились
+		elapsed := uint32(time.Since(r.lastWrite).Seconds() * float64(clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		r.seqOffset = r.lastSeq + 1 - pkt.SequenceNumber
+		r.tsOffset = r.lastTS + elapsed - pkt.Timestamp
+	}
+	r.started = true
+	r.stale = false
+	r.source = source
+	r.lastIn = pkt.SequenceNumber - 1
+	r.segmentStart = pkt.SequenceNumber + r.seqOffset
+}
+
+// rewrite — outgoing copy of a packet of the current source
+func (r *rtpRewriter) rewrite(pkt *rtp.Packet, clockRate uint32) rtp.Packet {
+	if jump := pkt.SequenceNumber - r.lastIn; jump > maxSeqJump && -jump > maxSeqJump {
+		// Издатель начал нумерацию заново — сшиваем, как при смене источника
+		r.switchTo(r.source, pkt, clockRate)
+	}
+	// SSRC и payload type подставит TrackLocalStaticRTP
+	out := *pkt
+	out.SequenceNumber = pkt.SequenceNumber + r.seqOffset
+	out.Timestamp = pkt.Timestamp + r.tsOffset
+	if seqNewer(pkt.SequenceNumber, r.lastIn) {
+		r.lastIn = pkt.SequenceNumber
+		r.lastSeq = out.SequenceNumber
+		r.lastTS = out.Timestamp
+		r.lastWrite = time.Now()
+	}
+	return out
+}
+
+// skip — close the numbering gap of a packet not forwarded on purpose (mute, whisper, push-to-talk)
+func (r *rtpRewriter) skip(pkt *rtp.Packet) {
+	if !r.started || r.stale || !seqNewer(pkt.SequenceNumber, r.lastIn) {
+		return
+	}
+	// Время не трогаем: пауза в timestamp — обычная тишина, а дыра в номерах — потери
+	r.lastIn = pkt.SequenceNumber
+	r.seqOffset--
+	r.segmentStart = r.lastSeq + 1
+}
+
+// original — incoming number of an outgoing packet of the current segment
+func (r *rtpRewriter) original(seq uint16) (uint16, bool) {
+	// Сразу после пропуска сегмент пуст: lastSeq на единицу позади segmentStart
+	empty := r.lastSeq+1 == r.segmentStart
+	if !r.started || r.stale || empty || seq-r.segmentStart > r.lastSeq-r.segmentStart {
+		return 0, false
+	}
+	return seq - r.seqOffset, true
+}
+
+// outgoing — rewritten copy of a cached packet for retransmission, keeps the state untouched
+func (r *rtpRewriter) outgoing(pkt *rtp.Packet) rtp.Packet {
+	out := *pkt
+	out.SequenceNumber = pkt.SequenceNumber + r.seqOffset
+	out.Timestamp = pkt.Timestamp + r.tsOffset
+	return out
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPRewriter(t *testing.T) {
+	const clockRate = 90000
+	const (
+		opSwitch = "switch"
+		opSkip   = "skip"
+		opWrite  = "rewrite"
+	)
+	// Шаги идут по одному переписчику: каждый опирается на состояние после предыдущих
+	steps := []struct {
+		name    string
+		op      string
+		source  string
+		seq     uint16
+		ts      uint32
+		wantSeq uint16
+		// wantTS — сдвиг timestamp от прошлого отправленного пакета; 0 — сшивка, где он
+		// зависит от прошедшего времени и проверяется только на малость
+		wantTS uint32
+	}{
+		{"first packet keeps numbering", opSwitch, "q", 65534, 1<<32 - 1000, 65534, 0},
+		{"ts wraparound", opWrite, "q", 65535, 2000, 65535, 3000},
+		{"seq wraparound", opWrite, "q", 0, 5000, 0, 3000},
+		{"skipped packet", opSkip, "q", 1, 8000, 0, 0},
+		{"gap closed after skip", opWrite, "q", 2, 11000, 1, 6000},
+		{"switch to another layer", opSwitch, "h", 30000, 123, 2, 0},
+		{"new layer in order", opWrite, "h", 30001, 3123, 3, 3000},
+		{"publisher restarted numbering", opWrite, "h", 10, 500_000, 4, 0},
+		{"after restart", opWrite, "h", 11, 503_000, 5, 3000},
+	}
+
+	var r rtpRewriter
+	var last rtp.Packet
+	for i, step := range steps {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: step.seq, Timestamp: step.ts}}
+		switch step.op {
+		case opSkip:
+			r.skip(pkt)
+			continue
+		case opSwitch:
+			if r.current(step.source) {
+				t.Fatalf("%s: source %q is already current", step.name, step.source)
+			}
+			r.switchTo(step.source, pkt, clockRate)
+		}
+		if !r.current(step.source) {
+			t.Fatalf("%s: source %q is not current", step.name, step.source)
+		}
+		out := r.rewrite(pkt, clockRate)
+		if out.SequenceNumber != step.wantSeq {
+			t.Errorf("%s: seq = %d, want %d", step.name, out.SequenceNumber, step.wantSeq)
+		}
+		delta := out.Timestamp - last.Timestamp
+		switch {
+		case i == 0:
+			if out.Timestamp != step.ts {
+				t.Errorf("%s: ts = %d, want %d", step.name, out.Timestamp, step.ts)
+			}
+		case step.wantTS != 0:
+			if delta != step.wantTS {
+				t.Errorf("%s: ts advanced by %d, want %d", step.name, delta, step.wantTS)
+			}
+		case delta == 0 || delta > clockRate/10:
+			t.Errorf("%s: ts advanced by %d across the switch", step.name, delta)
+		}
+		last = out
+	}
+}
+
+func TestRTPRewriterOriginal(t *testing.T) {
+	var r rtpRewriter
+	if _, ok := r.original(0); ok {
+		t.Fatal("original before the first packet")
+	}
+	for seq := uint16(65530); seq != 4; seq++ {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}
+		if !r.started {
+			r.switchTo("", pkt, 48000)
+		}
+		r.rewrite(pkt, 48000)
+	}
+	r.switchTo("h", &rtp.Packet{Header: rtp.Header{SequenceNumber: 100}}, 48000)
+	for seq := uint16(100); seq < 105; seq++ {
+		r.rewrite(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, 48000)
+	}
+
+	tests := []struct {
+		name string
+		seq  uint16
+		want uint16
+		ok   bool
+	}{
+		{"first of the segment", 4, 100, true},
+		{"last sent", 8, 104, true},
+		{"not sent yet", 9, 0, false},
+		// Пакеты прошлого источника по NACK уже не восстановить
+		{"previous segment", 3, 0, false},
+		{"previous segment before wraparound", 65535, 0, false},
+	}
+	for _, tt := range tests {
+		original, ok := r.original(tt.seq)
+		if ok != tt.ok || original != tt.want {
+			t.Errorf("%s: original(%d) = %d, %v; want %d, %v", tt.name, tt.seq, original, ok, tt.want, tt.ok)
+		}
+	}
+
+	// После пропуска старые номера тоже уходят из сегмента
+	r.skip(&rtp.Packet{Header: rtp.Header{SequenceNumber: 105}})
+	if _, ok := r.original(8); ok {
+		t.Error("original of a packet sent before the skip")
+	}
+	r.rewrite(&rtp.Packet{Header: rtp.Header{SequenceNumber: 106}}, 48000)
+	if original, ok := r.original(9); !ok || original != 106 {
+		t.Errorf("original(9) after skip = %d, %v; want 106, true", original, ok)
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoomVisibilityPublic  = "public"
+	RoomVisibilityPrivate = "private"
+
+	MsgTypeRoomCreated = "room_created"
+
+	roomIDMaxLength    = 64
+	inviteTokenPurpose = "invite"
+	defaultInviteTTL   = 24 * time.Hour
+	maxInviteTTL       = 30 * 24 * time.Hour
+
+	roomPasswordRate  = 5.0 / 60
+	roomPasswordBurst = 5
+)
+
+// roomColumns — columns loaded into RoomRecord
+const roomColumns = "id, owner_id, visibility, password_hash, max_participants, lobby_enabled, stage_mode, push_to_talk, " +
+	"last_n, audio_profile, max_audio_bitrate"
+
+// Коды ошибок join — клиент по ним решает, что спросить у пользователя
+const (
+	JoinErrRoomNotFound     = "room_not_found"
+	JoinErrForbidden        = "forbidden"
+	JoinErrPasswordRequired = "password_required"
+	JoinErrPasswordInvalid  = "password_invalid"
+	JoinErrInviteInvalid    = "invite_invalid"
+	JoinErrRateLimited      = "rate_limited"
+	JoinErrClientIDTaken    = "client_id_taken"
+	JoinErrBanned           = "banned"
+)
+
+var (
+	errRoomNotFound         = errors.New("room not found")
+	errRoomExists           = errors.New("room already exists")
+	errRoomForbidden        = errors.New("access to room denied")
+	errRoomPasswordRequired = errors.New("room password required")
+	errRoomPasswordInvalid  = errors.New("invalid room password")
+	errInviteInvalid        = errors.New("invalid or expired invite")
+	errRoomRateLimited      = errors.New("too many attempts")
+
+	roomPasswordLimiter = NewRateLimiter("room_password", roomPasswordRate, roomPasswordBurst)
+)
+
+// RoomRecord — persisted room settings
+type RoomRecord struct {
+	ID           string        `db:"id"`
+	OwnerID      sql.NullInt64 `db:"owner_id"`
+	Visibility   string        `db:"visibility"`
+	PasswordHash string        `db:"password_hash"`
+	// MaxParticipants — 0 означает лимит сервера по умолчанию
+	MaxParticipants int  `db:"max_participants"`
+	LobbyEnabled    bool `db:"lobby_enabled"`
+	// StageMode — говорят только speaker и выше, остальные по умолчанию слушатели
+	StageMode bool `db:"stage_mode"`
+	// PushToTalk — звук пересылается только между ptt_start и ptt_stop
+	PushToTalk bool `db:"push_to_talk"`
+	// LastN — слушатель получает звук только N самых громких спикеров, 0 — всех
+	LastN int `db:"last_n"`
+	// AudioProfile — voice или music: какие параметры Opus просим у клиентов
+	AudioProfile string `db:"audio_profile"`
+	// MaxAudioBitrate — потолок битрейта Opus в бит/с, 0 — по профилю
+	MaxAudioBitrate int `db:"max_audio_bitrate"`
+	// AdHoc — комнаты нет в БД, создана на лету (GROK_ALLOW_ADHOC_ROOMS)
+	AdHoc bool `db:"-"`
+}
+
+// IsOwner — check if user owns the room
+func (rec RoomRecord) IsOwner(userID int) bool {
+	return rec.OwnerID.Valid && int(rec.OwnerID.Int64) == userID
+}
+
+// RoomDTO — room entry for REST responses
+type RoomDTO struct {
+	ID           string `json:"id"`
+	OwnerID      int    `json:"ownerId,omitempty"`
+	Visibility   string `json:"visibility"`
+	HasPassword  bool   `json:"hasPassword"`
+	IsOwner      bool   `json:"isOwner"`
+	Participants int    `json:"participants"`
+	// MaxParticipants — действующий лимит с учётом лимита сервера
+	MaxParticipants int    `json:"maxParticipants"`
+	LobbyEnabled    bool   `json:"lobbyEnabled"`
+	StageMode       bool   `json:"stageMode"`
+	PushToTalk      bool   `json:"pushToTalk"`
+	LastN           int    `json:"lastN"`
+	AudioProfile    string `json:"audioProfile"`
+	MaxAudioBitrate int    `json:"maxAudioBitrate"`
+	Waiting         int    `json:"waiting"`
+}
+
+// roomDTO — REST representation of persisted room settings
+func roomDTO(rec RoomRecord, userID int) RoomDTO {
+	return RoomDTO{
+		ID:              rec.ID,
+		OwnerID:         int(rec.OwnerID.Int64),
+		Visibility:      rec.Visibility,
+		HasPassword:     rec.PasswordHash != "",
+		IsOwner:         rec.IsOwner(userID),
+		MaxParticipants: rec.Capacity(),
+		LobbyEnabled:    rec.LobbyEnabled,
+		StageMode:       rec.StageMode,
+		PushToTalk:      rec.PushToTalk,
+		LastN:           rec.LastN,
+		AudioProfile:    rec.AudioProfile,
+		MaxAudioBitrate: rec.MaxAudioBitrate,
+	}
+}
+
+// DefaultRole — role of users without a stored one
+func (rec RoomRecord) DefaultRole() string {
+	if rec.StageMode {
+		return RoomRoleListener
+	}
+	return RoomRoleSpeaker
+}
+
+// loadRoomRecord — load room settings from DB
+func loadRoomRecord(roomID string) (RoomRecord, error) {
+	var rec RoomRecord
+	err := db.Get(&rec, "SELECT "+roomColumns+" FROM rooms WHERE id=$1", roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RoomRecord{}, errRoomNotFound
+	}
+	return rec, err
+}
+
+// validateRoomID — check room ID format
+func validateRoomID(roomID string) []FieldError {
+	switch {
+	case roomID == "":
+		return []FieldError{{Field: "id", Code: "required", Message: "Room ID is required"}}
+	case len(roomID) > roomIDMaxLength:
+		return []FieldError{{Field: "id", Code: "too_long", Message: "Room ID must be at most 64 characters"}}
+	}
+	for _, ch := range roomID {
+		isAllowed := ch >= 'a' && ch <= 'z' ||
+			ch >= 'A' && ch <= 'Z' ||
+			ch >= '0' && ch <= '9' ||
+			ch == '.' || ch == '_' || ch == '-'
+		if !isAllowed {
+			return []FieldError{
+				{
+					Field:   "id",
+					Code:    "invalid_characters",
+					Message: "Room ID may contain only latin letters, digits, '.', '_' and '-'",
+				},
+			}
+		}
+	}
+	return nil
+}
+
+// validateVisibility — check room visibility value
+func validateVisibility(visibility string) []FieldError {
+	if visibility != RoomVisibilityPublic && visibility != RoomVisibilityPrivate {
+		return []FieldError{{Field: "visibility", Code: "invalid", Message: "Visibility must be 'public' or 'private'"}}
+	}
+	return nil
+}
+
+// hashRoomPassword — bcrypt room password, empty password means none
+func hashRoomPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// createRoom — persist a new room, password is taken in plain text and its hash is put into rec
+func (s *Server) createRoom(rec *RoomRecord, password string) error {
+	passwordHash, err := hashRoomPassword(password)
+	if err != nil {
+		return err
+	}
+	rec.PasswordHash = passwordHash
+	res, err := db.Exec(
+		`INSERT INTO rooms (`+roomColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (id) DO NOTHING`,
+		rec.ID,
+		rec.OwnerID,
+		rec.Visibility,
+		rec.PasswordHash,
+		rec.MaxParticipants,
+		rec.LobbyEnabled,
+		rec.StageMode,
+		rec.PushToTalk,
+		rec.LastN,
+		rec.AudioProfile,
+		rec.MaxAudioBitrate,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errRoomExists
+	}
+	slog.Info("Permanent room created", "roomID", rec.ID, "ownerID", rec.OwnerID.Int64, "visibility", rec.Visibility)
+	return nil
+}
+
+// getOrCreateRoom — get in-memory room, creating it on first join
+func (s *Server) getOrCreateRoom(roomID string) *Room {
+	s.RoomsMu.Lock()
+	defer s.RoomsMu.Unlock()
+	room, ok := s.Rooms[roomID]
+	if !ok {
+		room = NewRoom(roomID)
+		s.Rooms[roomID] = room
+	}
+	return room
+}
+
+// dropIdleRoom — forget the in-memory room if nobody is in it or waiting to get in
+func (s *Server) dropIdleRoom(room *Room) {
+	s.RoomsMu.Lock()
+	defer s.RoomsMu.Unlock()
+	room.Mu.Lock()
+	idle := room.headcount() == 0 && len(room.Lobby) == 0
+	room.Mu.Unlock()
+	if idle && s.Rooms[room.ID] == room {
+		delete(s.Rooms, room.ID)
+		slog.Info("Idle room dropped", "roomID", room.ID)
+	}
+}
+
+// liveRoom — in-memory room if someone is connected to it
+func (s *Server) liveRoom(roomID string) (*Room, bool) {
+	s.RoomsMu.Lock()
+	defer s.RoomsMu.Unlock()
+	room, ok := s.Rooms[roomID]
+	return room, ok
+}
+
+// isRoomMember — check if user was admitted to the room by invite
+func isRoomMember(roomID string, userID int) (bool, error) {
+	var member bool
+	err := db.Get(
+		&member,
+		"SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id=$1 AND user_id=$2)",
+		roomID,
+		userID,
+	)
+	return member, err
+}
+
+// addRoomMember — remember user as room member, existing role is kept
+func addRoomMember(roomID string, userID int, role string) error {
+	_, err := db.Exec(
+		"INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT (room_id, user_id) DO NOTHING",
+		roomID,
+		userID,
+		role,
+	)
+	return err
+}
+
+// authorizeJoin — check whether user may join the room
+func authorizeJoin(userID int, roomID, password, inviteToken string) (RoomRecord, error) {
+	rec, err := loadRoomRecord(roomID)
+	if errors.Is(err, errRoomNotFound) {
+		// На лету создаём только комнаты с допустимым ID, какой бы путь сюда ни привёл
+		if cfg.AllowAdHocRooms && validateRoomID(roomID) == nil {
+			return RoomRecord{ID: roomID, Visibility: RoomVisibilityPublic, AudioProfile: AudioProfileVoice, AdHoc: true}, nil
+		}
+		return RoomRecord{}, errRoomNotFound
+	}
+	if err != nil {
+		return RoomRecord{}, err
+	}
+
+	if rec.IsOwner(userID) {
+		return rec, nil
+	}
+
+	// Бан сильнее приглашения и членства
+	if err := checkBan(roomID, userID); err != nil {
+		return RoomRecord{}, err
+	}
+
+	if inviteToken != "" {
+		if err := validateInviteToken(inviteToken, roomID); err != nil {
+			slog.Warn("Invalid room invite", "roomID", roomID, "userID", userID, "error", err)
+			return RoomRecord{}, errInviteInvalid
+		}
+		// Приглашённый становится участником и дальше заходит без ссылки
+		if err := addRoomMember(roomID, userID, rec.DefaultRole()); err != nil {
+			return RoomRecord{}, err
+		}
+		return rec, nil
+	}
+
+	member, err := isRoomMember(roomID, userID)
+	if err != nil {
+		return RoomRecord{}, err
+	}
+	if member {
+		return rec, nil
+	}
+
+	if rec.Visibility == RoomVisibilityPrivate {
+		return RoomRecord{}, errRoomForbidden
+	}
+
+	if rec.PasswordHash != "" {
+		if password == "" {
+			return RoomRecord{}, errRoomPasswordRequired
+		}
+		if ok, _ := roomPasswordLimiter.Allow(strconv.Itoa(userID) + "/" + roomID); !ok {
+			return RoomRecord{}, errRoomRateLimited
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(rec.PasswordHash), []byte(password)); err != nil {
+			slog.Warn("Invalid room password", "roomID", roomID, "userID", userID)
+			return RoomRecord{}, errRoomPasswordInvalid
+		}
+	}
+	return rec, nil
+}
+
+// joinError — WebSocket error message for join failure
+func joinError(err error) WebSocketMessageDTO {
+	code := ""
+	switch {
+	case errors.Is(err, errRoomNotFound):
+		code = JoinErrRoomNotFound
+	case errors.Is(err, errRoomForbidden):
+		code = JoinErrForbidden
+	case errors.Is(err, errRoomPasswordRequired):
+		code = JoinErrPasswordRequired
+	case errors.Is(err, errRoomPasswordInvalid):
+		code = JoinErrPasswordInvalid
+	case errors.Is(err, errInviteInvalid):
+		code = JoinErrInviteInvalid
+	case errors.Is(err, errRoomRateLimited):
+		code = JoinErrRateLimited
+	case errors.Is(err, errRoomBanned):
+		code = JoinErrBanned
+	default:
+		slog.Error("authorize join", "error", err)
+		return WebSocketMessageDTO{Type: MsgTypeError, Message: "join room"}
+	}
+	return WebSocketMessageDTO{Type: MsgTypeError, Code: code, Message: err.Error()}
+}
+
+// generateInviteToken — signed invite link token for the room
+func generateInviteToken(roomID string, createdBy int, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, jwt.MapClaims{
+			"purpose": inviteTokenPurpose,
+			"room_id": roomID,
+			"by":      createdBy,
+			"exp":     expiresAt.Unix(),
+		},
+	)
+	signed, err := token.SignedString(jwtSecret)
+	return signed, expiresAt, err
+}
+
+// validateInviteToken — check invite signature, expiry and room
+func validateInviteToken(tokenString, roomID string) error {
+	token, err := jwt.Parse(
+		tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return jwtSecret, nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["purpose"] != inviteTokenPurpose || claims["room_id"] != roomID {
+		return jwt.ErrTokenInvalidClaims
+	}
+	return nil
+}
+
+// RoomsList — rooms visible to the user via REST
+func (s *Server) RoomsList(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "User ID not found", http.StatusUnauthorized)
+		return
+	}
+
+	var records []RoomRecord
+	err := db.Select(
+		&records,
+		`SELECT `+roomColumns+` FROM rooms
+		WHERE visibility=$1 OR owner_id=$2
+			OR id IN (SELECT room_id FROM room_members WHERE user_id=$2)
+		ORDER BY id`,
+		RoomVisibilityPublic,
+		userID,
+	)
+	if err != nil {
+		slog.Error("load rooms", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.RoomsMu.Lock()
+	live := make(map[string]*Room, len(s.Rooms))
+	for id, room := range s.Rooms {
+		live[id] = room
+	}
+	s.RoomsMu.Unlock()
+
+	rooms := make([]RoomDTO, 0, len(records))
+	for _, rec := range records {
+		dto := roomDTO(rec, userID)
+		if room, ok := live[rec.ID]; ok {
+			dto.Participants = len(room.GetClients())
+			dto.Waiting = len(room.lobbySnapshot())
+		}
+		rooms = append(rooms, dto)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+// createRoomREST — create room via REST
+func (s *Server) createRoomREST(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID              string `json:"id"`
+		Visibility      string `json:"visibility"`
+		Password        string `json:"password"`
+		MaxParticipants int    `json:"maxParticipants"`
+		LobbyEnabled    bool   `json:"lobbyEnabled"`
+		StageMode       bool   `json:"stageMode"`
+		PushToTalk      bool   `json:"pushToTalk"`
+		LastN           int    `json:"lastN"`
+		AudioProfile    string `json:"audioProfile"`
+		MaxAudioBitrate int    `json:"maxAudioBitrate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if req.Visibility == "" {
+		req.Visibility = RoomVisibilityPublic
+	}
+	fields := validateRoomID(req.ID)
+	fields = append(fields, validateVisibility(req.Visibility)...)
+	fields = append(fields, validateMaxParticipants(req.MaxParticipants)...)
+	fields = append(fields, validateLastN(req.LastN)...)
+	if req.AudioProfile == "" {
+		req.AudioProfile = AudioProfileVoice
+	}
+	fields = append(fields, validateAudioProfile(req.AudioProfile)...)
+	fields = append(fields, validateMaxAudioBitrate(req.MaxAudioBitrate)...)
+	if len(fields) > 0 {
+		writeValidationErrors(w, fields)
+		return
+	}
+
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "User ID not found", http.StatusUnauthorized)
+		return
+	}
+
+	rec := RoomRecord{
+		ID:              req.ID,
+		OwnerID:         sql.NullInt64{Int64: int64(userID), Valid: true},
+		Visibility:      req.Visibility,
+		MaxParticipants: req.MaxParticipants,
+		LobbyEnabled:    req.LobbyEnabled,
+		StageMode:       req.StageMode,
+		PushToTalk:      req.PushToTalk,
+		LastN:           req.LastN,
+		AudioProfile:    req.AudioProfile,
+		MaxAudioBitrate: req.MaxAudioBitrate,
+	}
+	err := s.createRoom(&rec, req.Password)
+	if errors.Is(err, errRoomExists) {
+		http.Error(w, "Room already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("create room", "roomID", req.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, roomDTO(rec, userID))
+}
+
+// updateRoom — change visibility or password of an owned room via REST
+func (s *Server) updateRoom(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Visibility *string `json:"visibility"`
+		// Password — пустая строка снимает пароль, отсутствие поля ничего не меняет
+		Password        *string `json:"password"`
+		MaxParticipants *int    `json:"maxParticipants"`
+		LobbyEnabled    *bool   `json:"lobbyEnabled"`
+		StageMode       *bool   `json:"stageMode"`
+		PushToTalk      *bool   `json:"pushToTalk"`
+		LastN           *int    `json:"lastN"`
+		AudioProfile    *string `json:"audioProfile"`
+		MaxAudioBitrate *int    `json:"maxAudioBitrate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	rec, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Visibility != nil {
+		if fields := validateVisibility(*req.Visibility); len(fields) > 0 {
+			writeValidationErrors(w, fields)
+			return
+		}
+		rec.Visibility = *req.Visibility
+	}
+	if req.Password != nil {
+		hash, err := hashRoomPassword(*req.Password)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		rec.PasswordHash = hash
+	}
+	if req.MaxParticipants != nil {
+		if fields := validateMaxParticipants(*req.MaxParticipants); len(fields) > 0 {
+			writeValidationErrors(w, fields)
+			return
+		}
+		rec.MaxParticipants = *req.MaxParticipants
+	}
+	if req.LobbyEnabled != nil {
+		rec.LobbyEnabled = *req.LobbyEnabled
+	}
+	if req.StageMode != nil {
+		rec.StageMode = *req.StageMode
+	}
+	if req.PushToTalk != nil {
+		rec.PushToTalk = *req.PushToTalk
+	}
+	if req.LastN != nil {
+		if fields := validateLastN(*req.LastN); len(fields) > 0 {
+			writeValidationErrors(w, fields)
+			return
+		}
+		rec.LastN = *req.LastN
+	}
+	if req.AudioProfile != nil {
+		if fields := validateAudioProfile(*req.AudioProfile); len(fields) > 0 {
+			writeValidationErrors(w, fields)
+			return
+		}
+		rec.AudioProfile = *req.AudioProfile
+	}
+	if req.MaxAudioBitrate != nil {
+		if fields := validateMaxAudioBitrate(*req.MaxAudioBitrate); len(fields) > 0 {
+			writeValidationErrors(w, fields)
+			return
+		}
+		rec.MaxAudioBitrate = *req.MaxAudioBitrate
+	}
+
+	if _, err := db.Exec(
+		`UPDATE rooms SET visibility=$1, password_hash=$2, max_participants=$3, lobby_enabled=$4, stage_mode=$5,
+		push_to_talk=$6, last_n=$7, audio_profile=$8, max_audio_bitrate=$9 WHERE id=$10`,
+		rec.Visibility,
+		rec.PasswordHash,
+		rec.MaxParticipants,
+		rec.LobbyEnabled,
+		rec.StageMode,
+		rec.PushToTalk,
+		rec.LastN,
+		rec.AudioProfile,
+		rec.MaxAudioBitrate,
+		rec.ID,
+	); err != nil {
+		slog.Error("update room", "roomID", rec.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Новый лимит или выключенное лобби может сразу впустить ожидающих
+	if room, ok := s.liveRoom(rec.ID); ok {
+		room.configure(rec)
+		if !s.admitFromLobby(room) {
+			s.notifyLobby(room)
+		}
+		s.refreshRoles(room, rec)
+		for _, r := range room.family() {
+			s.resetAudio(r)
+		}
+	}
+
+	slog.Info(
+		"Room updated", "roomID", rec.ID, "visibility", rec.Visibility, "hasPassword", rec.PasswordHash != "",
+		"maxParticipants", rec.MaxParticipants, "lobbyEnabled", rec.LobbyEnabled,
+	)
+	userID, _ := currentUserID(r)
+	writeJSON(w, http.StatusOK, roomDTO(rec, userID))
+}
+
+// createInvite — issue expiring signed invite link via REST
+func (s *Server) createInvite(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TTLSeconds int `json:"ttlSeconds"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rec, ok := s.ownedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if req.TTLSeconds > 0 {
+		ttl = min(time.Duration(req.TTLSeconds)*time.Second, maxInviteTTL)
+	}
+
+	userID, _ := currentUserID(r)
+	token, expiresAt, err := generateInviteToken(rec.ID, userID, ttl)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Room invite created", "roomID", rec.ID, "by", userID, "expiresAt", expiresAt)
+	writeJSON(
+		w, http.StatusCreated, map[string]interface{}{
+			"token":     token,
+			"url":       "/?room=" + url.QueryEscape(rec.ID) + "&invite=" + url.QueryEscape(token),
+			"expiresAt": expiresAt.UTC(),
+		},
+	)
+}
+
+// ownedRoom — load room from path and check that current user owns it
+func (s *Server) ownedRoom(w http.ResponseWriter, r *http.Request) (RoomRecord, bool) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "User ID not found", http.StatusUnauthorized)
+		return RoomRecord{}, false
+	}
+	rec, err := loadRoomRecord(r.PathValue("id"))
+	if errors.Is(err, errRoomNotFound) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return RoomRecord{}, false
+	}
+	if err != nil {
+		slog.Error("load room", "roomID", r.PathValue("id"), "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return RoomRecord{}, false
+	}
+	if !rec.IsOwner(userID) {
+		http.Error(w, "Only the room owner can do this", http.StatusForbidden)
+		return RoomRecord{}, false
+	}
+	return rec, true
+}
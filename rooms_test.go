@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// seedRooms — users 1..4 and rooms of user 1: open, private and password protected
+func seedRooms(t *testing.T) *Server {
+	t.Helper()
+	openTestDB(t)
+	for _, name := range []string{"owner", "member", "guest", "other"} {
+		if _, err := db.Exec("INSERT INTO users (username, password) VALUES ($1, $2)", name, "hash"); err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+	}
+	s := NewServer()
+	for _, room := range []struct{ id, visibility, password string }{
+		{"open", RoomVisibilityPublic, ""},
+		{"private", RoomVisibilityPrivate, ""},
+		{"locked", RoomVisibilityPublic, "secret"},
+	} {
+		rec := RoomRecord{ID: room.id, OwnerID: sql.NullInt64{Int64: 1, Valid: true}, Visibility: room.visibility}
+		if err := s.createRoom(&rec, room.password); err != nil {
+			t.Fatalf("create room %s: %v", room.id, err)
+		}
+		if roomDTO(rec, 1).HasPassword != (room.password != "") {
+			t.Fatalf("room %s: password not reported", room.id)
+		}
+	}
+	if err := addRoomMember("private", 2, RoomRoleSpeaker); err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+	return s
+}
+
+// inviteToken — invite link token, negative ttl gives an expired one
+func inviteToken(t *testing.T, roomID string, ttl time.Duration) string {
+	t.Helper()
+	token, _, err := generateInviteToken(roomID, 1, ttl)
+	if err != nil {
+		t.Fatalf("generate invite: %v", err)
+	}
+	return token
+}
+
+func TestAuthorizeJoin(t *testing.T) {
+	seedRooms(t)
+	tests := []struct {
+		name     string
+		userID   int
+		roomID   string
+		password string
+		invite   string
+		err      error
+	}{
+		{"owner of private room", 1, "private", "", "", nil},
+		{"owner skips password", 1, "locked", "", "", nil},
+		{"member of private room", 2, "private", "", "", nil},
+		{"stranger in private room", 3, "private", "", "", errRoomForbidden},
+		{"public room", 3, "open", "", "", nil},
+		{"missing password", 3, "locked", "", "", errRoomPasswordRequired},
+		{"wrong password", 3, "locked", "guess", "", errRoomPasswordInvalid},
+		{"correct password", 3, "locked", "secret", "", nil},
+		{"invite for another room", 3, "private", "", inviteToken(t, "open", time.Hour), errInviteInvalid},
+		{"expired invite", 3, "private", "", inviteToken(t, "private", -time.Minute), errInviteInvalid},
+		{"forged invite", 3, "private", "", inviteToken(t, "private", time.Hour) + "x", errInviteInvalid},
+		// Приглашение заменяет и пароль
+		{"invite to locked room", 4, "locked", "", inviteToken(t, "locked", time.Hour), nil},
+		{"unknown room", 3, "missing", "", "", errRoomNotFound},
+	}
+	for _, tt := range tests {
+		rec, err := authorizeJoin(tt.userID, tt.roomID, tt.password, tt.invite)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && rec.ID != tt.roomID {
+			t.Errorf("%s: room %q", tt.name, rec.ID)
+		}
+	}
+}
+
+func TestAuthorizeJoinInviteMakesMember(t *testing.T) {
+	seedRooms(t)
+	if _, err := authorizeJoin(3, "private", "", inviteToken(t, "private", time.Hour)); err != nil {
+		t.Fatalf("join by invite: %v", err)
+	}
+	// Ссылка больше не нужна
+	if _, err := authorizeJoin(3, "private", "", ""); err != nil {
+		t.Errorf("join after invite: %v", err)
+	}
+	if _, err := authorizeJoin(4, "private", "", ""); !errors.Is(err, errRoomForbidden) {
+		t.Errorf("join of another user: error %v, want %v", err, errRoomForbidden)
+	}
+}
+
+func TestAuthorizeJoinPasswordLimit(t *testing.T) {
+	seedRooms(t)
+	prev := roomPasswordLimiter
+	roomPasswordLimiter = NewRateLimiter("room_password_test", roomPasswordRate, roomPasswordBurst)
+	t.Cleanup(func() { roomPasswordLimiter = prev })
+
+	for i := 0; i < roomPasswordBurst; i++ {
+		if _, err := authorizeJoin(3, "locked", "guess", ""); !errors.Is(err, errRoomPasswordInvalid) {
+			t.Fatalf("attempt %d: error %v, want %v", i+1, err, errRoomPasswordInvalid)
+		}
+	}
+	// Подбор остановлен, даже верный пароль ждёт
+	if _, err := authorizeJoin(3, "locked", "secret", ""); !errors.Is(err, errRoomRateLimited) {
+		t.Errorf("after %d attempts: error %v, want %v", roomPasswordBurst, err, errRoomRateLimited)
+	}
+	// Счётчик у каждого пользователя свой
+	if _, err := authorizeJoin(4, "locked", "secret", ""); err != nil {
+		t.Errorf("another user: %v", err)
+	}
+}
+
+func TestAuthorizeJoinAdHoc(t *testing.T) {
+	seedRooms(t)
+	prev := cfg
+	t.Cleanup(func() { cfg = prev })
+
+	cfg.AllowAdHocRooms = false
+	if _, err := authorizeJoin(3, "fresh", "", ""); !errors.Is(err, errRoomNotFound) {
+		t.Errorf("ad-hoc disabled: error %v, want %v", err, errRoomNotFound)
+	}
+
+	cfg.AllowAdHocRooms = true
+	rec, err := authorizeJoin(3, "fresh", "", "")
+	if err != nil || !rec.AdHoc || rec.Visibility != RoomVisibilityPublic {
+		t.Errorf("ad-hoc room: %+v, %v", rec, err)
+	}
+	for _, roomID := range []string{"", "bad room", "../etc", string(make([]byte, roomIDMaxLength+1))} {
+		if _, err := authorizeJoin(3, roomID, "", ""); !errors.Is(err, errRoomNotFound) {
+			t.Errorf("ad-hoc room %q: error %v, want %v", roomID, err, errRoomNotFound)
+		}
+	}
+	// Постоянные комнаты проверяются как раньше
+	if _, err := authorizeJoin(3, "private", "", ""); !errors.Is(err, errRoomForbidden) {
+		t.Errorf("private room with ad-hoc enabled: error %v, want %v", err, errRoomForbidden)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	MsgTypeSetVideoQuality = "set_video_quality"
+
+	VideoQualityAuto   = "auto"
+	VideoQualityLow    = "low"
+	VideoQualityMedium = "medium"
+	VideoQualityHigh   = "high"
+
+	TrackErrInvalidQuality = "invalid_quality"
+
+	// bitrateWindow — за какой период меряем битрейт слоя и пересматриваем выбор слоёв
+	bitrateWindow = time.Second
+	// initialBandwidth — с этой оценки GCC стартует, пока нет обратной связи от подписчика, бит/с
+	initialBandwidth = 1_000_000
+)
+
+// ridRanks — usual RID names from low to high, used until layer bitrates are measured
+var ridRanks = map[string]int{"q": 0, "l": 0, "low": 0, "0": 0, "h": 1, "m": 1, "mid": 1, "1": 1, "f": 2, "high": 2, "2": 2}
+
+// simulcastLayer — one encoding of a publication; without simulcast the only layer has no RID
+type simulcastLayer struct {
+	RID          string
+	Track        *webrtc.TrackRemote
+	bitrate      uint64 // бит/с за последнее окно
+	bytes        uint64
+	windowStart  time.Time
+	lastKeyframe time.Time
+	stats        receptionStats
+	cache        *packetCache // только у видео: аудио по NACK не восстанавливают
+}
+
+// addLayer — start reading one more simulcast layer of the publication
+func (p *Publication) addLayer(layer *simulcastLayer) {
+	p.mu.Lock()
+	p.layers = append(p.layers, layer)
+	p.mu.Unlock()
+	slog.Info("Simulcast layer added", "clientID", p.Publisher.ID, "trackID", p.ID, "rid", layer.RID)
+	go p.run(layer)
+}
+
+// removeLayer — forget an ended layer, returns how many are left
+func (p *Publication) removeLayer(layer *simulcastLayer) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, l := range p.layers {
+		if l == layer {
+			p.layers = append(p.layers[:i], p.layers[i+1:]...)
+			break
+		}
+	}
+	return len(p.layers)
+}
+
+// measure — account a packet in the layer bitrate, reception stats and cache, true when a window has just closed
+func (p *Publication) measure(layer *simulcastLayer, pkt *rtp.Packet, clockRate uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	layer.stats.update(pkt, clockRate, now)
+	if layer.cache != nil {
+		layer.cache.push(pkt)
+	}
+	if layer.windowStart.IsZero() {
+		layer.windowStart = now
+	}
+	layer.bytes += uint64(pkt.MarshalSize())
+	elapsed := now.Sub(layer.windowStart)
+	if elapsed < bitrateWindow {
+		return false
+	}
+	layer.bitrate = layer.bytes * 8 * uint64(time.Second) / uint64(elapsed)
+	layer.bytes = 0
+	layer.windowStart = now
+	return true
+}
+
+// rankedLayers — layers from the lowest quality to the highest, caller holds mu
+func (p *Publication) rankedLayers() []*simulcastLayer {
+	layers := append([]*simulcastLayer(nil), p.layers...)
+	sort.SliceStable(
+		layers, func(i, j int) bool {
+			a, b := layers[i], layers[j]
+			if a.bitrate > 0 && b.bitrate > 0 {
+				return a.bitrate < b.bitrate
+			}
+			return ridRanks[a.RID] < ridRanks[b.RID]
+		},
+	)
+	return layers
+}
+
+// chooseLayer — highest layer allowed by the requested quality that fits into the bandwidth
+func chooseLayer(layers []*simulcastLayer, quality string, bandwidth uint64) string {
+	top := len(layers) - 1
+	switch quality {
+	case VideoQualityLow:
+		top = 0
+	case VideoQualityMedium:
+		top = (len(layers) - 1) / 2
+	}
+	// Оценки канала ещё нет — не рискуем верхним слоем, начинаем со среднего
+	if bandwidth == 0 {
+		top = min(top, (len(layers)-1)/2)
+	}
+	// Самый нижний слой шлём даже при плохом канале: лучше мыло, чем чёрный экран
+	for top > 0 && bandwidth > 0 && layers[top].bitrate > bandwidth {
+		top--
+	}
+	return layers[top].RID
+}
+
+// rebalance — pick a layer for every subscriber and ask for keyframes where a switch is due
+func (p *Publication) rebalance() {
+	p.mu.Lock()
+	layers := p.rankedLayers()
+	p.mu.Unlock()
+	if len(layers) == 0 {
+		return
+	}
+	for _, sub := range p.subscriptions() {
+		target := ""
+		if p.Simulcast {
+			bandwidth := sub.estimate()
+			// Оценка — на всё соединение, делим её между видео подписчика
+			if n := sub.Subscriber.videoSubscriptions(); n > 1 {
+				bandwidth /= uint64(n)
+			}
+			target = chooseLayer(layers, sub.Subscriber.videoQuality(p.Sid()), bandwidth)
+		}
+		if sub.retarget(target) {
+			p.requestKeyframe(target)
+		}
+	}
+}
+
+// retarget — set the layer to switch to, true if the subscriber waits for its keyframe
+func (s *Subscription) retarget(rid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target = rid
+	return !s.rewriter.current(rid)
+}
+
+// estimate — bandwidth estimate of the subscriber: TWCC of its connection, REMB if it has none
+func (s *Subscription) estimate() uint64 {
+	if bandwidth := s.Subscriber.bandwidth(); bandwidth > 0 {
+		return bandwidth
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bandwidth
+}
+
+// setEstimate — remember bandwidth estimate from subscriber REMB
+func (s *Subscription) setEstimate(bitrate uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bandwidth = bitrate
+}
+
+// currentLayer — RID the subscriber is receiving now
+func (s *Subscription) currentLayer() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rewriter.source
+}
+
+// forward — write a packet of the layer if the subscriber receives it, switching layers on keyframes
+func (s *Subscription) forward(rid string, pkt *rtp.Packet, switchPoint bool, clockRate uint32) error {
+	if s.mix != nil {
+		s.mix.push(pkt)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.rewriter.current(rid) {
+		if rid != s.target || !switchPoint {
+			return nil
+		}
+		s.rewriter.switchTo(rid, pkt, clockRate)
+	}
+	out := s.rewriter.rewrite(pkt, clockRate)
+	return s.Local.WriteRTP(&out)
+}
+
+// skip — packet of the layer is not forwarded to the subscriber on purpose
+func (s *Subscription) skip(rid string, pkt *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rewriter.current(rid) {
+		s.rewriter.skip(pkt)
+	}
+}
+
+// isKeyframe — check if the packet starts a keyframe of VP8, VP9 or H264
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		return isVP8Keyframe(payload)
+	case webrtc.MimeTypeVP9:
+		// Флаг P снят — кадр без ссылок на предыдущие; B — начало кадра
+		return len(payload) > 0 && payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+	case webrtc.MimeTypeH264:
+		return isH264Keyframe(payload)
+	}
+	return false
+}
+
+// isVP8Keyframe — parse VP8 payload descriptor (RFC 7741) and check the frame header
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// Ключевой кадр узнаём только по первому пакету первой партиции
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i = 2
+		if ext&0x80 != 0 { // PictureID, 7 или 15 бит
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // TID/KEYIDX
+			i++
+		}
+	}
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// isH264Keyframe — look for IDR or SPS in single, STAP-A and FU-A packets (RFC 6184)
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 5, 7:
+		return true
+	case 24: // STAP-A: несколько NAL с 16-битной длиной
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28: // FU-A: смотрим на первый фрагмент
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+	}
+	return false
+}
+
+// videoQuality — quality the client asked for the publication, auto by default
+func (c *Client) videoQuality(sid string) string {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if quality, ok := c.VideoQuality[sid]; ok {
+		return quality
+	}
+	if quality, ok := c.VideoQuality[""]; ok {
+		return quality
+	}
+	return VideoQualityAuto
+}
+
+// videoSubscriptions — number of video tracks forwarded to the client
+func (c *Client) videoSubscriptions() int {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.videoSubs
+}
+
+// countVideoSubscription — track how many video subscriptions share the client bandwidth
+func (c *Client) countVideoSubscription(delta int) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.videoSubs += delta
+}
+
+// handleSetVideoQuality — cap simulcast layers for some video tracks, or for all without trackSids
+func (s *Server) handleSetVideoQuality(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	switch msg.Quality {
+	case VideoQualityAuto, VideoQualityLow, VideoQualityMedium, VideoQualityHigh:
+	default:
+		return WebSocketMessageDTO{
+			Type:    MsgTypeError,
+			Code:    TrackErrInvalidQuality,
+			Message: "quality must be 'auto', 'low', 'medium' or 'high'",
+		}
+	}
+	client.Mu.Lock()
+	if len(msg.TrackSids) == 0 {
+		// Общая настройка заменяет частные
+		client.VideoQuality = map[string]string{"": msg.Quality}
+	} else {
+		for _, sid := range msg.TrackSids {
+			client.VideoQuality[sid] = msg.Quality
+		}
+	}
+	client.Mu.Unlock()
+
+	if room := client.CurrentRoom(); room != nil {
+		for id, other := range room.GetClients() {
+			if id == client.ID {
+				continue
+			}
+			for _, pub := range other.publications() {
+				if pub.Simulcast {
+					pub.rebalance()
+				}
+			}
+		}
+	}
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", Quality: msg.Quality, TrackSids: msg.TrackSids}
+}
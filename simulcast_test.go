@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestIsVP8Keyframe(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"empty", nil, false},
+		{"keyframe", []byte{0x10, 0x00}, true},
+		{"interframe", []byte{0x10, 0x01}, false},
+		{"not a partition start", []byte{0x00, 0x00}, false},
+		{"second partition", []byte{0x11, 0x00}, false},
+		{"15-bit picture ID", []byte{0x90, 0x80, 0x81, 0x23, 0x00}, true},
+		{"7-bit picture ID, TL0PICIDX and TID", []byte{0x90, 0xe0, 0x05, 0x01, 0x20, 0x00}, true},
+		{"7-bit picture ID, interframe", []byte{0x90, 0x80, 0x05, 0x01}, false},
+		{"truncated extension", []byte{0x90}, false},
+		{"truncated picture ID", []byte{0x90, 0x80}, false},
+		{"no frame header", []byte{0x90, 0x80, 0x81, 0x23}, false},
+	}
+	for _, tt := range tests {
+		if got := isVP8Keyframe(tt.payload); got != tt.want {
+			t.Errorf("%s: isVP8Keyframe(%x) = %v, want %v", tt.name, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestIsH264Keyframe(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"empty", nil, false},
+		{"IDR", []byte{0x65, 0x88}, true},
+		{"SPS", []byte{0x67, 0x42}, true},
+		{"non-IDR slice", []byte{0x41, 0x9a}, false},
+		{"STAP-A with SPS", []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"STAP-A with IDR second", []byte{0x78, 0x00, 0x02, 0x68, 0xce, 0x00, 0x02, 0x65, 0x88}, true},
+		{"STAP-A without keyframe", []byte{0x78, 0x00, 0x02, 0x68, 0xce, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"STAP-A truncated", []byte{0x78, 0x00}, false},
+		{"STAP-A length past the end", []byte{0x78, 0x00, 0x10, 0x68, 0xce}, false},
+		{"FU-A IDR start", []byte{0x7c, 0x85}, true},
+		{"FU-A IDR middle", []byte{0x7c, 0x05}, false},
+		{"FU-A non-IDR start", []byte{0x7c, 0x81}, false},
+		{"FU-A truncated", []byte{0x7c}, false},
+	}
+	for _, tt := range tests {
+		if got := isH264Keyframe(tt.payload); got != tt.want {
+			t.Errorf("%s: isH264Keyframe(%x) = %v, want %v", tt.name, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestChooseLayer(t *testing.T) {
+	three := []*simulcastLayer{{RID: "q", bitrate: 150_000}, {RID: "h", bitrate: 500_000}, {RID: "f", bitrate: 1_500_000}}
+	two := []*simulcastLayer{{RID: "l", bitrate: 300_000}, {RID: "h", bitrate: 1_200_000}}
+	single := []*simulcastLayer{{RID: ""}}
+
+	tests := []struct {
+		name      string
+		layers    []*simulcastLayer
+		quality   string
+		bandwidth uint64
+		want      string
+	}{
+		{"auto, wide channel", three, VideoQualityAuto, 2_000_000, "f"},
+		{"auto, fits middle", three, VideoQualityAuto, 1_000_000, "h"},
+		{"auto, fits lowest", three, VideoQualityAuto, 400_000, "q"},
+		{"auto, below lowest", three, VideoQualityAuto, 100_000, "q"},
+		{"auto, no estimate", three, VideoQualityAuto, 0, "h"},
+		{"high, no estimate", three, VideoQualityHigh, 0, "h"},
+		{"low, wide channel", three, VideoQualityLow, 2_000_000, "q"},
+		{"medium, wide channel", three, VideoQualityMedium, 2_000_000, "h"},
+		{"medium, narrow channel", three, VideoQualityMedium, 200_000, "q"},
+		{"two layers, no estimate", two, VideoQualityAuto, 0, "l"},
+		{"two layers, wide channel", two, VideoQualityAuto, 2_000_000, "h"},
+		{"without simulcast", single, VideoQualityAuto, 0, ""},
+	}
+	for _, tt := range tests {
+		if got := chooseLayer(tt.layers, tt.quality, tt.bandwidth); got != tt.want {
+			t.Errorf("%s: chooseLayer = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
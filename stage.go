@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+const (
+	MsgTypeRaiseHand      = "raise_hand"
+	MsgTypeLowerHand      = "lower_hand"
+	MsgTypeInviteToSpeak  = "invite_to_speak"
+	MsgTypeSpeakInvite    = "speak_invite"
+	MsgTypeAcceptSpeak    = "accept_speak"
+	MsgTypeDeclineSpeak   = "decline_speak"
+	MsgTypeMoveToAudience = "move_to_audience"
+)
+
+// Коды ошибок сцены
+const (
+	StageErrNotStage       = "not_stage"
+	StageErrAlreadySpeaker = "already_speaker"
+	StageErrNotInvited     = "not_invited"
+)
+
+// stageRole — role with temporary stage promotion or demotion applied
+func (r *Room) stageRole(userID int, role string) string {
+	if roleRank[role] >= roleRank[RoomRoleModerator] {
+		return role
+	}
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if !r.StageMode {
+		return role
+	}
+	if stageRole, ok := r.StageRoles[userID]; ok {
+		return stageRole
+	}
+	return role
+}
+
+// setStageRole — move user on or off the stage until the room is gone, empty role resets
+func (r *Room) setStageRole(userID int, role string) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if role == "" {
+		delete(r.StageRoles, userID)
+		return
+	}
+	r.StageRoles[userID] = role
+}
+
+// isStage — check if the room is in stage mode
+func (r *Room) isStage() bool {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.StageMode
+}
+
+// setHandRaised — raise or lower client hand
+func (c *Client) setHandRaised(raised bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.HandRaised = raised
+}
+
+// isHandRaised — check if client raised hand
+func (c *Client) isHandRaised() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.HandRaised
+}
+
+// setSpeakInvited — remember pending invitation to the stage
+func (c *Client) setSpeakInvited(invited bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.SpeakInvited = invited
+}
+
+// isSpeakInvited — check if client has a pending invitation to the stage
+func (c *Client) isSpeakInvited() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.SpeakInvited
+}
+
+// refreshRoles — recompute roles of connected clients after room settings change
+func (s *Server) refreshRoles(room *Room, rec RoomRecord) {
+	stage := room.isStage()
+	var changed []*Client
+	for _, client := range room.GetClients() {
+		role, err := roomRole(rec, client.UserID)
+		if err != nil {
+			slog.Error("load room role", "roomID", room.ID, "userID", client.UserID, "error", err)
+			continue
+		}
+		role = room.stageRole(client.UserID, role)
+		// Без сцены поднятые руки теряют смысл — их тоже сбрасываем
+		staleHand := !stage && client.isHandRaised()
+		if role == client.RoomRole() && !staleHand {
+			continue
+		}
+		client.setRole(role)
+		if !stage {
+			client.setHandRaised(false)
+			client.setSpeakInvited(false)
+		}
+		changed = append(changed, client)
+	}
+	room.broadcastUpdated(changed)
+}
+
+// syncStageRole — recompute client role for the room it enters, stage roles are kept per room
+func (s *Server) syncStageRole(client *Client, room *Room) {
+	rec, err := loadRoomRecord(room.root().ID)
+	if errors.Is(err, errRoomNotFound) {
+		// У ad-hoc комнат нет сцены
+		return
+	}
+	if err != nil {
+		slog.Error("load room", "roomID", room.ID, "error", err)
+		return
+	}
+	role, err := roomRole(rec, client.UserID)
+	if err != nil {
+		slog.Error("load room role", "roomID", room.ID, "userID", client.UserID, "error", err)
+		return
+	}
+	client.setRole(room.stageRole(client.UserID, role))
+}
+
+// moveStage — set stage role for all user connections and notify the room
+func (s *Server) moveStage(room *Room, userID int, role string) {
+	room.setStageRole(userID, role)
+	clients := room.clientsOfUser(userID)
+	for _, client := range clients {
+		if roleRank[client.RoomRole()] >= roleRank[RoomRoleModerator] {
+			continue
+		}
+		client.setRole(role)
+		client.setHandRaised(false)
+		client.setSpeakInvited(false)
+	}
+	room.broadcastUpdated(clients)
+	slog.Info("Stage role changed", "roomID", room.ID, "userID", userID, "role", role)
+}
+
+// handleStage — raise hand and invite-to-speak workflow
+func (s *Server) handleStage(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	room := client.CurrentRoom()
+	if !room.isStage() {
+		return WebSocketMessageDTO{Type: MsgTypeError, Code: StageErrNotStage, Message: "Room is not in stage mode"}
+	}
+
+	switch msg.Type {
+	case MsgTypeRaiseHand:
+		if client.RoomRole() != RoomRoleListener {
+			return WebSocketMessageDTO{Type: MsgTypeError, Code: StageErrAlreadySpeaker, Message: "Already on stage"}
+		}
+		client.setHandRaised(true)
+		room.broadcastUpdated([]*Client{client})
+
+	case MsgTypeDeclineSpeak:
+		if !client.isSpeakInvited() {
+			return WebSocketMessageDTO{Type: MsgTypeError, Code: StageErrNotInvited, Message: "No pending invitation"}
+		}
+		client.setSpeakInvited(false)
+
+	case MsgTypeAcceptSpeak:
+		if !client.isSpeakInvited() {
+			return WebSocketMessageDTO{Type: MsgTypeError, Code: StageErrNotInvited, Message: "No pending invitation"}
+		}
+		s.moveStage(room, client.UserID, RoomRoleSpeaker)
+
+	case MsgTypeLowerHand, MsgTypeMoveToAudience:
+		// Свою руку опустить и со сцены уйти можно самому, чужие — только модератору
+		target := client
+		if msg.TargetClientID != "" && msg.TargetClientID != client.ID {
+			_, actorRole, errMsg := requireModerator(client, room)
+			if errMsg != nil {
+				return *errMsg
+			}
+			var ok bool
+			if target, ok = room.GetClients()[msg.TargetClientID]; !ok {
+				return moderationError(ModErrTargetNotFound, "Participant not found")
+			}
+			if roleRank[target.RoomRole()] >= roleRank[actorRole] {
+				return moderationError(ModErrForbidden, "Cannot moderate a participant with the same or higher role")
+			}
+		}
+		if msg.Type == MsgTypeLowerHand {
+			target.setHandRaised(false)
+			room.broadcastUpdated([]*Client{target})
+			break
+		}
+		if target.RoomRole() != RoomRoleSpeaker {
+			return moderationError(ModErrForbidden, "Only speakers can be moved to the audience")
+		}
+		s.moveStage(room, target.UserID, RoomRoleListener)
+
+	case MsgTypeInviteToSpeak:
+		if _, _, errMsg := requireModerator(client, room); errMsg != nil {
+			return *errMsg
+		}
+		target, ok := room.GetClients()[msg.TargetClientID]
+		if !ok {
+			return moderationError(ModErrTargetNotFound, "Participant not found")
+		}
+		if target.RoomRole() != RoomRoleListener {
+			return WebSocketMessageDTO{Type: MsgTypeError, Code: StageErrAlreadySpeaker, Message: "Already on stage"}
+		}
+		// Поднявший руку уже согласился — переводим сразу, остальных спрашиваем
+		if target.isHandRaised() {
+			s.moveStage(room, target.UserID, RoomRoleSpeaker)
+			break
+		}
+		target.setSpeakInvited(true)
+		if err := target.Send(
+			WebSocketMessageDTO{Type: MsgTypeSpeakInvite, RoomID: room.ID, ClientID: client.ID},
+		); err != nil {
+			slog.Error("send speak invite", "clientID", target.ID, "error", err)
+		}
+	}
+
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", TargetClientID: msg.TargetClientID}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+// stageRoom — moderatedRoom switched to stage mode, users 3 and 4 start in the audience
+func stageRoom(t *testing.T) (*Server, *Room, map[int]*Client) {
+	t.Helper()
+	s, room, clients := moderatedRoom(t)
+	if _, err := db.Exec("UPDATE rooms SET stage_mode=$1 WHERE id=$2", true, room.ID); err != nil {
+		t.Fatalf("enable stage: %v", err)
+	}
+	rec, err := loadRoomRecord(room.ID)
+	if err != nil {
+		t.Fatalf("load room: %v", err)
+	}
+	room.configure(rec)
+	s.refreshRoles(room, rec)
+	return s, room, clients
+}
+
+func TestStageTransitions(t *testing.T) {
+	s, room, clients := stageRoom(t)
+	if clients[3].RoomRole() != RoomRoleListener || clients[2].RoomRole() != RoomRoleModerator {
+		t.Fatalf("roles on stage: %q, %q", clients[3].RoomRole(), clients[2].RoomRole())
+	}
+	tests := []struct {
+		name  string
+		actor int
+		msg   WebSocketMessageDTO
+		code  string // пусто — действие выполнено
+		user  int    // чью роль проверяем после шага
+		role  string
+	}{
+		{"accept without invite", 3, WebSocketMessageDTO{Type: MsgTypeAcceptSpeak}, StageErrNotInvited, 3, RoomRoleListener},
+		{"listener invites", 4, WebSocketMessageDTO{Type: MsgTypeInviteToSpeak, TargetClientID: "speaker"}, ModErrForbidden, 3, RoomRoleListener},
+		{"moderator invites", 2, WebSocketMessageDTO{Type: MsgTypeInviteToSpeak, TargetClientID: "speaker"}, "", 3, RoomRoleListener},
+		{"accept invite", 3, WebSocketMessageDTO{Type: MsgTypeAcceptSpeak}, "", 3, RoomRoleSpeaker},
+		{"accept twice", 3, WebSocketMessageDTO{Type: MsgTypeAcceptSpeak}, StageErrNotInvited, 3, RoomRoleSpeaker},
+		{"speaker raises hand", 3, WebSocketMessageDTO{Type: MsgTypeRaiseHand}, StageErrAlreadySpeaker, 3, RoomRoleSpeaker},
+		{
+			"listener moves speaker", 4, WebSocketMessageDTO{Type: MsgTypeMoveToAudience, TargetClientID: "speaker"},
+			ModErrForbidden, 3, RoomRoleSpeaker,
+		},
+		{
+			"moderator moves speaker", 2, WebSocketMessageDTO{Type: MsgTypeMoveToAudience, TargetClientID: "speaker"},
+			"", 3, RoomRoleListener,
+		},
+		{"listener leaves stage", 4, WebSocketMessageDTO{Type: MsgTypeMoveToAudience}, ModErrForbidden, 4, RoomRoleListener},
+		// Поднявшего руку приглашение переводит на сцену сразу
+		{"raise hand", 4, WebSocketMessageDTO{Type: MsgTypeRaiseHand}, "", 4, RoomRoleListener},
+		{"invite raised hand", 2, WebSocketMessageDTO{Type: MsgTypeInviteToSpeak, TargetClientID: "listener"}, "", 4, RoomRoleSpeaker},
+		{"speaker leaves stage", 4, WebSocketMessageDTO{Type: MsgTypeMoveToAudience}, "", 4, RoomRoleListener},
+		{"invite decline", 2, WebSocketMessageDTO{Type: MsgTypeInviteToSpeak, TargetClientID: "speaker"}, "", 3, RoomRoleListener},
+		{"decline invite", 3, WebSocketMessageDTO{Type: MsgTypeDeclineSpeak}, "", 3, RoomRoleListener},
+		{"accept declined invite", 3, WebSocketMessageDTO{Type: MsgTypeAcceptSpeak}, StageErrNotInvited, 3, RoomRoleListener},
+		{"invite owner", 2, WebSocketMessageDTO{Type: MsgTypeInviteToSpeak, TargetClientID: "owner"}, StageErrAlreadySpeaker, 1, RoomRoleOwner},
+		{
+			"moderator moves owner", 2, WebSocketMessageDTO{Type: MsgTypeMoveToAudience, TargetClientID: "owner"},
+			ModErrForbidden, 1, RoomRoleOwner,
+		},
+	}
+	for _, tt := range tests {
+		resp := s.handleStage(clients[tt.actor], tt.msg)
+		if tt.code == "" && resp.Type != tt.msg.Type+"_ack" {
+			t.Errorf("%s: %s %q %q", tt.name, resp.Type, resp.Code, resp.Message)
+		}
+		if tt.code != "" && (resp.Type != MsgTypeError || resp.Code != tt.code) {
+			t.Errorf("%s: %s %q, want error %q", tt.name, resp.Type, resp.Code, tt.code)
+		}
+		if role := clients[tt.user].RoomRole(); role != tt.role {
+			t.Errorf("%s: user %d role %q, want %q", tt.name, tt.user, role, tt.role)
+		}
+	}
+	if clients[4].isHandRaised() {
+		t.Error("hand still raised after moving to stage")
+	}
+
+	// Роль на сцене переживает переподключение, пока комната жива
+	s.moveStage(room, 3, RoomRoleSpeaker)
+	if role := room.stageRole(3, RoomRoleListener); role != RoomRoleSpeaker {
+		t.Errorf("stage role after reconnect %q, want %q", role, RoomRoleSpeaker)
+	}
+	if role := room.stageRole(2, RoomRoleModerator); role != RoomRoleModerator {
+		t.Errorf("moderator stage role %q", role)
+	}
+}
+
+func TestStageModeOff(t *testing.T) {
+	s, room, clients := stageRoom(t)
+	s.moveStage(room, 3, RoomRoleSpeaker)
+	clients[4].setHandRaised(true)
+
+	rec, err := loadRoomRecord(room.ID)
+	if err != nil {
+		t.Fatalf("load room: %v", err)
+	}
+	rec.StageMode = false
+	room.configure(rec)
+	s.refreshRoles(room, rec)
+
+	// Без сцены действуют постоянные роли, а временные забыты
+	for userID, role := range map[int]string{1: RoomRoleOwner, 2: RoomRoleModerator, 3: RoomRoleSpeaker, 4: RoomRoleListener} {
+		if got := clients[userID].RoomRole(); got != role {
+			t.Errorf("user %d: role %q, want %q", userID, got, role)
+		}
+	}
+	if clients[4].isHandRaised() {
+		t.Error("hand still raised without stage")
+	}
+	if role := room.stageRole(3, RoomRoleListener); role != RoomRoleListener {
+		t.Errorf("stage role kept after stage mode off: %q", role)
+	}
+	if resp := s.handleStage(clients[4], WebSocketMessageDTO{Type: MsgTypeRaiseHand}); resp.Code != StageErrNotStage {
+		t.Errorf("raise hand without stage: %s %q", resp.Type, resp.Code)
+	}
+}
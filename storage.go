@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+// migration — single schema migration shared by all drivers
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrations — schema migrations in apply order. Пишем на общем подмножестве
+// SQL, отличия диалектов закрывает rewriteForDriver.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "users and rooms",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS users (
+			id SERIAL PRIMARY KEY,
+			username VARCHAR(255) UNIQUE NOT NULL,
+			password VARCHAR(255) NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS rooms (
+			id VARCHAR(255) PRIMARY KEY,
+			owner_id INT REFERENCES users(id)
+		);
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "sessions",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id VARCHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			refresh_hash VARCHAR(64) NOT NULL,
+			previous_hash VARCHAR(64),
+			expires_at TIMESTAMPTZ NOT NULL,
+			revoked_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "oidc identities",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS user_identities (
+			id SERIAL PRIMARY KEY,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			issuer VARCHAR(255) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			email VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (issuer, subject)
+		);
+		CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "totp",
+		SQL: `
+		ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+		CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+			id SERIAL PRIMARY KEY,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash VARCHAR(64) NOT NULL,
+			used_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS totp_recovery_codes_user_id_idx ON totp_recovery_codes (user_id);
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "audit events",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id SERIAL PRIMARY KEY,
+			event VARCHAR(64) NOT NULL,
+			username VARCHAR(255) NOT NULL DEFAULT '',
+			ip VARCHAR(64) NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at);
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "user profiles",
+		SQL: `
+		ALTER TABLE users ADD COLUMN display_name VARCHAR(64) NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN avatar VARCHAR(255) NOT NULL DEFAULT '';
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "room access control",
+		SQL: `
+		ALTER TABLE rooms ADD COLUMN visibility VARCHAR(16) NOT NULL DEFAULT 'public';
+		ALTER TABLE rooms ADD COLUMN password_hash VARCHAR(255) NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS room_members (
+			room_id VARCHAR(255) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_id, user_id)
+		);
+		CREATE INDEX IF NOT EXISTS room_members_user_id_idx ON room_members (user_id);
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "room roles and bans",
+		SQL: `
+		ALTER TABLE room_members ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'speaker';
+		CREATE TABLE IF NOT EXISTS room_bans (
+			room_id VARCHAR(255) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			banned_by INT REFERENCES users(id) ON DELETE SET NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_id, user_id)
+		);
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "room capacity and lobby",
+		SQL: `
+		ALTER TABLE rooms ADD COLUMN max_participants INT NOT NULL DEFAULT 0;
+		ALTER TABLE rooms ADD COLUMN lobby_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "stage mode",
+		SQL: `
+		ALTER TABLE rooms ADD COLUMN stage_mode BOOLEAN NOT NULL DEFAULT FALSE;
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "push-to-talk",
+		SQL: `
+		ALTER TABLE rooms ADD COLUMN push_to_talk BOOLEAN NOT NULL DEFAULT FALSE;
+		`,
+	},
+	{
+		Version: 12,
+		Name:    "chat messages",
+		SQL: `
+		CREATE TABLE IF NOT EXISTS messages (
+			id SERIAL PRIMARY KEY,
+			room_id VARCHAR(255) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+			user_id INT REFERENCES users(id) ON DELETE SET NULL,
+			body TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS messages_room_id_idx ON messages (room_id, id);
+		`,
+	},
+	{
+		Version: 13,
+		Name:    "last-n audio",
+		SQL: `
+		ALTER TABLE rooms ADD COLUMN last_n INT NOT NULL DEFAULT 0;
+		`,
+	},
+	{
+		Version: 14,
+		Name:    "room audio profile",
+		SQL: `
+		ALTER TABLE rooms ADD COLUMN audio_profile TEXT NOT NULL DEFAULT 'voice';
+		ALTER TABLE rooms ADD COLUMN max_audio_bitrate INT NOT NULL DEFAULT 0;
+		`,
+	},
+}
+
+// parseDSN — detect database driver from DSN
+func parseDSN(dsn string) (driver, source string) {
+	switch {
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return driverSQLite, sqliteSource(strings.TrimPrefix(dsn, "sqlite://"))
+	case strings.HasPrefix(dsn, "sqlite:"):
+		return driverSQLite, sqliteSource(strings.TrimPrefix(dsn, "sqlite:"))
+	default:
+		return driverPostgres, dsn
+	}
+}
+
+// sqliteSource — build modernc.org/sqlite data source with required pragmas
+func sqliteSource(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return "file:" + path + sep +
+		"_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
+// rewriteForDriver — adapt shared migration SQL to the driver dialect
+func rewriteForDriver(driver, query string) string {
+	if driver != driverSQLite {
+		return query
+	}
+	return strings.NewReplacer(
+		"SERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT",
+		"TIMESTAMPTZ", "TIMESTAMP",
+		"BYTEA", "BLOB",
+	).Replace(query)
+}
+
+// initDB — initialize database connection
+func initDB(dsn string) {
+	driver, source := parseDSN(dsn)
+
+	var err error
+	db, err = sqlx.Connect(driver, source)
+	if err != nil {
+		slog.Error("connect to database", "driver", driver, "error", err)
+		os.Exit(1)
+	}
+
+	if driver == driverSQLite {
+		// SQLite допускает только одного писателя, иначе ловим SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := migrate(db, driver); err != nil {
+		slog.Error("migrate database", "driver", driver, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Database initialized", "driver", driver)
+}
+
+// migrate — apply pending migrations
+func migrate(db *sqlx.DB, driver string) error {
+	if _, err := db.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL
+		)`,
+	); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var applied []int
+	if err := db.Select(&applied, "SELECT version FROM schema_migrations"); err != nil {
+		return fmt.Errorf("load applied migrations: %w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, v := range applied {
+		done[v] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return fmt.Errorf("begin migration %d: %w", m.Version, err)
+		}
+		if _, err := tx.Exec(rewriteForDriver(driver, m.SQL)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("apply migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+			m.Version,
+			m.Name,
+		); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("record migration %d: %w", m.Version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("commit migration %d: %w", m.Version, err)
+		}
+		slog.Info("Migration applied", "version", m.Version, "name", m.Name)
+	}
+	return nil
+}
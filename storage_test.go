@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// openTestDB — migrated in-memory SQLite put into the db global for the test
+func openTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	driver, source := parseDSN("sqlite::memory:")
+	conn, err := sqlx.Connect(driver, source)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	// Каждое соединение к :memory: — своя пустая база
+	conn.SetMaxOpenConns(1)
+	if err := migrate(conn, driver); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	prev := db
+	db = conn
+	t.Cleanup(
+		func() {
+			db = prev
+			conn.Close()
+		},
+	)
+	return conn
+}
+
+func TestParseDSN(t *testing.T) {
+	pragmas := "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	tests := []struct {
+		dsn    string
+		driver string
+		source string
+	}{
+		{"postgres://u:p@localhost:5432/grok?sslmode=disable", driverPostgres, "postgres://u:p@localhost:5432/grok?sslmode=disable"},
+		{"host=localhost user=u dbname=grok", driverPostgres, "host=localhost user=u dbname=grok"},
+		{"sqlite:///var/lib/grok.db", driverSQLite, "file:/var/lib/grok.db?" + pragmas},
+		{"sqlite://grok.db", driverSQLite, "file:grok.db?" + pragmas},
+		{"sqlite:grok.db", driverSQLite, "file:grok.db?" + pragmas},
+		{"sqlite::memory:", driverSQLite, "file::memory:?" + pragmas},
+		{"sqlite://grok.db?cache=shared", driverSQLite, "file:grok.db?cache=shared&" + pragmas},
+	}
+	for _, tt := range tests {
+		driver, source := parseDSN(tt.dsn)
+		if driver != tt.driver || source != tt.source {
+			t.Errorf("parseDSN(%q) = %q, %q; want %q, %q", tt.dsn, driver, source, tt.driver, tt.source)
+		}
+	}
+}
+
+func TestRewriteForDriver(t *testing.T) {
+	query := "CREATE TABLE t (id SERIAL PRIMARY KEY, at TIMESTAMPTZ NOT NULL, data BYTEA)"
+	tests := []struct {
+		driver string
+		want   string
+	}{
+		{driverPostgres, query},
+		{driverSQLite, "CREATE TABLE t (id INTEGER PRIMARY KEY AUTOINCREMENT, at TIMESTAMP NOT NULL, data BLOB)"},
+	}
+	for _, tt := range tests {
+		if got := rewriteForDriver(tt.driver, query); got != tt.want {
+			t.Errorf("rewriteForDriver(%q) = %q, want %q", tt.driver, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	conn := openTestDB(t)
+	var versions []int
+	if err := conn.Select(&versions, "SELECT version FROM schema_migrations ORDER BY version"); err != nil {
+		t.Fatalf("load versions: %v", err)
+	}
+	if len(versions) != len(migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(versions), len(migrations))
+	}
+	for i, m := range migrations {
+		if versions[i] != m.Version {
+			t.Errorf("migration %d applied as version %d, want %d", i, versions[i], m.Version)
+		}
+	}
+	// Повторный запуск на готовой схеме ничего не делает
+	if err := migrate(conn, driverSQLite); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	if _, err := conn.Exec("INSERT INTO users (username, password) VALUES ($1, $2)", "alice", "hash"); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer        = "grok_voice"
+	totpPeriod        = 30
+	totpSkew          = 1 // допускаем соседние 30-секундные окна (расхождение часов)
+	mfaTokenTTL       = 5 * time.Minute
+	mfaTokenPurpose   = "mfa"
+	recoveryCodeCount = 10
+)
+
+// generateMFAToken — short-lived token proving the password step passed
+func generateMFAToken(userID int) (string, error) {
+	token := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, jwt.MapClaims{
+			"user_id": userID,
+			"purpose": mfaTokenPurpose,
+			"exp":     time.Now().Add(mfaTokenTTL).Unix(),
+		},
+	)
+	return token.SignedString(jwtSecret)
+}
+
+// validateMFAToken — validate MFA token, returns user ID
+func validateMFAToken(tokenString string) (int, error) {
+	token, err := jwt.Parse(
+		tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return jwtSecret, nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["purpose"] != mfaTokenPurpose {
+		return 0, jwt.ErrTokenInvalidClaims
+	}
+	userIDFloat, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, jwt.ErrTokenInvalidClaims
+	}
+	return int(userIDFloat), nil
+}
+
+// matchTOTP — check code against secret, returns matched time step
+func matchTOTP(secret, code string, lastStep int64) (int64, bool) {
+	opts := totp.ValidateOpts{
+		Period:    totpPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		// Код из уже использованного окна не принимаем повторно
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// consumeTOTP — validate code and remember its step to prevent replay
+func consumeTOTP(user User, code string) (bool, error) {
+	step, ok := matchTOTP(user.TOTPSecret, strings.TrimSpace(code), user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	res, err := db.Exec(
+		"UPDATE users SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1",
+		step,
+		user.ID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// normalizeRecoveryCode — strip separators and case from recovery code
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// consumeRecoveryCode — mark unused recovery code as used
+func consumeRecoveryCode(userID int, code string) (bool, error) {
+	res, err := db.Exec(
+		"UPDATE totp_recovery_codes SET used_at=$1 WHERE user_id=$2 AND code_hash=$3 AND used_at IS NULL",
+		time.Now().UTC(),
+		userID,
+		hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// generateRecoveryCodes — create recovery codes, store only their hashes
+func generateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id=$1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+		code := raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		if _, err := tx.Exec(
+			"INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID,
+			hashToken(normalizeRecoveryCode(code)),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// loadCurrentUser — load authenticated user from request context
+func loadCurrentUser(r *http.Request) (User, bool) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		return User{}, false
+	}
+	var user User
+	if err := db.Get(&user, "SELECT * FROM users WHERE id=$1", userID); err != nil {
+		slog.Error("load user", "userID", userID, "error", err)
+		return User{}, false
+	}
+	return user, true
+}
+
+// enrollTOTP — generate TOTP secret and provisioning URI via REST
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+
+	key, err := totp.Generate(
+		totp.GenerateOpts{
+			Issuer:      totpIssuer,
+			AccountName: user.Username,
+			Period:      totpPeriod,
+			Digits:      otp.DigitsSix,
+			Algorithm:   otp.AlgorithmSHA1,
+		},
+	)
+	if err != nil {
+		slog.Error("generate TOTP key", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Секрет сохраняется неактивным до подтверждения кодом
+	if _, err := db.Exec("UPDATE users SET totp_secret=$1, totp_last_step=0 WHERE id=$2", key.Secret(), user.ID); err != nil {
+		slog.Error("store TOTP secret", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var qr string
+	if img, err := key.Image(256, 256); err == nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err == nil {
+			qr = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+
+	slog.Info("TOTP enrolment started", "userID", user.ID)
+	writeJSON(
+		w, http.StatusOK, map[string]string{
+			"secret":          key.Secret(),
+			"provisioningUri": key.URL(),
+			"qrCode":          qr,
+		},
+	)
+}
+
+// confirmTOTP — verify first code, enable TOTP and issue recovery codes via REST
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Enrolment not started", http.StatusBadRequest)
+		return
+	}
+
+	valid, err := consumeTOTP(user, req.Code)
+	if err != nil {
+		slog.Error("consume TOTP", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		slog.Error("generate recovery codes", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET totp_enabled=$1 WHERE id=$2", true, user.ID); err != nil {
+		slog.Error("enable TOTP", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("TOTP enabled", "userID", user.ID)
+	writeJSON(w, http.StatusOK, map[string][]string{"recoveryCodes": codes})
+}
+
+// disableTOTP — turn off TOTP after code or recovery code check via REST
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := loadCurrentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication not enabled", http.StatusBadRequest)
+		return
+	}
+
+	valid, err := checkSecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		slog.Error("check second factor", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := db.Exec(
+		"UPDATE users SET totp_enabled=$1, totp_secret='', totp_last_step=0 WHERE id=$2",
+		false,
+		user.ID,
+	); err != nil {
+		slog.Error("disable TOTP", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM totp_recovery_codes WHERE user_id=$1", user.ID); err != nil {
+		slog.Error("delete recovery codes", "userID", user.ID, "error", err)
+	}
+
+	slog.Info("TOTP disabled", "userID", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkSecondFactor — accept either TOTP code or recovery code
+func checkSecondFactor(user User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		ok, err := consumeRecoveryCode(user.ID, recoveryCode)
+		if ok {
+			slog.Info("Recovery code used", "userID", user.ID)
+		}
+		return ok, err
+	}
+	return consumeTOTP(user, code)
+}
+
+// loginTOTP — second login step, issues session cookies after code check
+func loginTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := validateMFAToken(req.MFAToken)
+	if err != nil {
+		slog.Warn("Invalid MFA token", "error", err)
+		http.Error(w, "Login expired, start again", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	if err := db.Get(&user, "SELECT * FROM users WHERE id=$1", userID); err != nil {
+		slog.Error("load user", "userID", userID, "error", err)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if !checkLoginAllowed(w, r, user.Username) {
+		return
+	}
+
+	valid, err := checkSecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		slog.Error("check second factor", "userID", user.ID, "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		slog.Warn("Invalid TOTP code", "userID", user.ID)
+		registerLoginFailure(r, user.Username)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := startSession(w, user.ID); err != nil {
+		slog.Error("start session", "userID", user.ID, "error", err)
+		http.Error(w, "generate token", http.StatusInternalServerError)
+		return
+	}
+	loginGuard.Succeed(user.Username)
+	slog.Info("User logged in", "username", user.Username, "mfa", true)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// testTOTPUser — user with TOTP enabled in the test database
+func testTOTPUser(t *testing.T) User {
+	t.Helper()
+	openTestDB(t)
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "alice"})
+	if err != nil {
+		t.Fatalf("generate secret: %v", err)
+	}
+	if _, err := db.Exec(
+		"INSERT INTO users (username, password, totp_secret, totp_enabled) VALUES ($1, $2, $3, $4)",
+		"alice", "hash", key.Secret(), true,
+	); err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	return loadTestUser(t, 1)
+}
+
+func loadTestUser(t *testing.T, userID int) User {
+	t.Helper()
+	var user User
+	if err := db.Get(&user, "SELECT * FROM users WHERE id=$1", userID); err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	return user
+}
+
+func TestConsumeTOTPReplay(t *testing.T) {
+	user := testTOTPUser(t)
+	code, err := totp.GenerateCode(user.TOTPSecret, time.Now())
+	if err != nil {
+		t.Fatalf("generate code: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		user func() User
+		code string
+		want bool
+	}{
+		{"wrong code", func() User { return user }, "000000", false},
+		{"fresh code", func() User { return user }, code, true},
+		{"same code again", func() User { return loadTestUser(t, user.ID) }, code, false},
+		// Параллельный вход прочитал пользователя до первого — спасает условие в UPDATE
+		{"same code with stale user", func() User { return user }, code, false},
+	}
+	for _, tt := range tests {
+		ok, err := consumeTOTP(tt.user(), tt.code)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: consumeTOTP = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+	if loadTestUser(t, user.ID).TOTPLastStep == 0 {
+		t.Error("used step was not stored")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"ABCD-EFGH-IJKL-MNOP", "ABCDEFGHIJKLMNOP"},
+		{"abcd-efgh-ijkl-mnop", "ABCDEFGHIJKLMNOP"},
+		{" abcd efgh ijkl mnop ", "ABCDEFGHIJKLMNOP"},
+		{"ABCDEFGHIJKLMNOP", "ABCDEFGHIJKLMNOP"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecoveryCode(tt.code); got != tt.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	user := testTOTPUser(t)
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// В базе только хэши нормализованных кодов
+	var hashes []string
+	if err := db.Select(&hashes, "SELECT code_hash FROM totp_recovery_codes WHERE user_id=$1", user.ID); err != nil {
+		t.Fatalf("load hashes: %v", err)
+	}
+	stored := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		stored[hash] = true
+	}
+	for _, code := range codes {
+		if stored[code] || !stored[hashToken(normalizeRecoveryCode(code))] {
+			t.Errorf("code %q is not stored as its hash", code)
+		}
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"unknown code", "AAAA-BBBB-CCCC-DDDD", false},
+		{"lower case without dashes", strings.ToLower(strings.ReplaceAll(codes[0], "-", "")), true},
+		{"same code again", codes[0], false},
+		{"another code", codes[1], true},
+	}
+	for _, tt := range tests {
+		ok, err := consumeRecoveryCode(user.ID, tt.code)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: consumeRecoveryCode = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+
+	// Перевыпуск гасит старые коды
+	if _, err := generateRecoveryCodes(user.ID); err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	if ok, _ := consumeRecoveryCode(user.ID, codes[2]); ok {
+		t.Error("old code accepted after regeneration")
+	}
+}
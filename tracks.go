@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	MsgTypeTrackInfo        = "track_info"
+	MsgTypeTracks           = "tracks"
+	MsgTypeTrackPublished   = "track_published"
+	MsgTypeTrackUnpublished = "track_unpublished"
+	MsgTypeSelectVideo      = "select_video"
+
+	TrackSourceMicrophone  = "microphone"
+	TrackSourceCamera      = "camera"
+	TrackSourceScreen      = "screen"
+	TrackSourceScreenAudio = "screen_audio"
+
+	TrackErrInvalidSource = "invalid_source"
+
+	// keyframeMinInterval — чаще keyframe у издателя не просим, сколько бы подписчиков его ни ждали
+	keyframeMinInterval = 500 * time.Millisecond
+)
+
+// trackSourceKinds — media kind each track source must have
+var trackSourceKinds = map[string]webrtc.RTPCodecType{
+	TrackSourceMicrophone:  webrtc.RTPCodecTypeAudio,
+	TrackSourceCamera:      webrtc.RTPCodecTypeVideo,
+	TrackSourceScreen:      webrtc.RTPCodecTypeVideo,
+	TrackSourceScreenAudio: webrtc.RTPCodecTypeAudio,
+}
+
+// TrackDTO — published track as announced to the room, or source hint from the publisher
+type TrackDTO struct {
+	Sid       string `json:"sid,omitempty"` // clientId/trackId — ключ для select_video
+	ClientID  string `json:"clientId,omitempty"`
+	TrackID   string `json:"trackId"`
+	StreamID  string `json:"streamId,omitempty"` // id MediaStream, в котором дорожка придёт подписчику
+	Kind      string `json:"kind,omitempty"`
+	Source    string `json:"source"`
+	Simulcast bool   `json:"simulcast,omitempty"` // можно выбирать качество через set_video_quality
+}
+
+// Sid — room-wide publication key
+func (p *Publication) Sid() string {
+	return p.Publisher.ID + "/" + p.ID
+}
+
+// StreamID — MediaStream ID the subscribers see, one stream per publisher source
+func (p *Publication) StreamID() string {
+	return p.Source + "_" + p.Publisher.ID
+}
+
+// DTO — publication as announced to the room
+func (p *Publication) DTO() TrackDTO {
+	return TrackDTO{
+		Sid:       p.Sid(),
+		ClientID:  p.Publisher.ID,
+		TrackID:   p.ID,
+		StreamID:  p.StreamID(),
+		Kind:      p.Track.Kind().String(),
+		Source:    p.Source,
+		Simulcast: p.Simulcast,
+	}
+}
+
+// trackSource — source announced in track_info, or the default for the kind
+func (c *Client) trackSource(trackID string, kind webrtc.RTPCodecType) string {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if source, ok := c.TrackSources[trackID]; ok && trackSourceKinds[source] == kind {
+		return source
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		return TrackSourceCamera
+	}
+	return TrackSourceMicrophone
+}
+
+// wantsTrack — check if the subscriber selected the publication; audio is always received
+func (c *Client) wantsTrack(p *Publication) bool {
+	// WHIP не пересогласует соединение, так что издателю ничего не добавить
+	if c.Ingest {
+		return false
+	}
+	if p.Track.Kind() != webrtc.RTPCodecTypeVideo {
+		return true
+	}
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.VideoSelection == nil || c.VideoSelection[p.Sid()]
+}
+
+// roomTracks — publications of everyone in the room except one client
+func roomTracks(room *Room, exceptClientID string) []TrackDTO {
+	tracks := []TrackDTO{}
+	for id, client := range room.GetClients() {
+		if id == exceptClientID {
+			continue
+		}
+		for _, pub := range client.publications() {
+			tracks = append(tracks, pub.DTO())
+		}
+	}
+	return tracks
+}
+
+// announceTrack — tell the room that a publication appeared or went away
+func announceTrack(room *Room, pub *Publication, msgType string) {
+	room.Broadcast(
+		WebSocketMessageDTO{Type: msgType, RoomID: room.ID, ClientID: pub.Publisher.ID, Tracks: []TrackDTO{pub.DTO()}},
+		pub.Publisher.ID,
+	)
+}
+
+// announceMedia — send room tracks to the client entering it and its tracks to the room
+func announceMedia(client *Client, room *Room) {
+	if err := client.Send(
+		WebSocketMessageDTO{Type: MsgTypeTracks, RoomID: room.ID, Tracks: roomTracks(room, client.ID)},
+	); err != nil {
+		slog.Error("send room tracks", "clientID", client.ID, "error", err)
+	}
+	for _, pub := range client.publications() {
+		announceTrack(room, pub, MsgTypeTrackPublished)
+	}
+}
+
+// requestKeyframe — ask the publisher for a keyframe of the layer on behalf of subscribers
+func (p *Publication) requestKeyframe(rid string) {
+	if p.Track.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	p.mu.Lock()
+	var layer *simulcastLayer
+	for _, l := range p.layers {
+		if l.RID == rid {
+			layer = l
+		}
+	}
+	if layer == nil || time.Since(layer.lastKeyframe) < keyframeMinInterval {
+		p.mu.Unlock()
+		return
+	}
+	layer.lastKeyframe = time.Now()
+	p.mu.Unlock()
+
+	pc := p.Publisher.peer()
+	if pc == nil {
+		return
+	}
+	if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(layer.Track.SSRC())}}); err != nil {
+		slog.Error("request keyframe", "clientID", p.Publisher.ID, "trackID", p.ID, "rid", rid, "error", err)
+	}
+}
+
+// readRTCP — handle subscriber feedback until the subscription is removed
+func (s *Subscription) readRTCP(p *Publication) {
+	for {
+		pkts, _, err := s.Sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				p.requestKeyframe(s.currentLayer())
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				s.setEstimate(uint64(pkt.Bitrate))
+			case *rtcp.TransportLayerNack:
+				s.retransmit(p, pkt)
+			case *rtcp.ReceiverReport:
+				s.setReport(pkt)
+			}
+		}
+	}
+}
+
+// handleTrackInfo — remember sources of the tracks the client is about to publish
+func (s *Server) handleTrackInfo(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	for _, track := range msg.Tracks {
+		if _, ok := trackSourceKinds[track.Source]; !ok || track.TrackID == "" {
+			return WebSocketMessageDTO{
+				Type:    MsgTypeError,
+				Code:    TrackErrInvalidSource,
+				Message: "source must be 'microphone', 'camera', 'screen' or 'screen_audio'",
+			}
+		}
+	}
+	client.Mu.Lock()
+	for _, track := range msg.Tracks {
+		client.TrackSources[track.TrackID] = track.Source
+	}
+	client.Mu.Unlock()
+	return WebSocketMessageDTO{Type: msg.Type + "_ack"}
+}
+
+// handleSelectVideo — choose which video tracks to receive; no trackSids means all of them
+func (s *Server) handleSelectVideo(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	var selection map[string]bool
+	// Пустой массив — не получать видео вовсе, отсутствие поля — получать всё
+	if msg.TrackSids != nil {
+		selection = make(map[string]bool, len(msg.TrackSids))
+		for _, sid := range msg.TrackSids {
+			selection[sid] = true
+		}
+	}
+	client.Mu.Lock()
+	client.VideoSelection = selection
+	client.Mu.Unlock()
+
+	room := client.CurrentRoom()
+	for id, other := range room.GetClients() {
+		if id == client.ID {
+			continue
+		}
+		for _, pub := range other.publications() {
+			if pub.Track.Kind() != webrtc.RTPCodecTypeVideo {
+				continue
+			}
+			if client.wantsTrack(pub) {
+				pub.subscribe(client)
+			} else {
+				pub.unsubscribe(client.ID)
+			}
+		}
+	}
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", TrackSids: msg.TrackSids}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestTrackSource(t *testing.T) {
+	s := NewServer()
+	client := NewClient("client", nil, nil, 1)
+	resp := s.handleTrackInfo(
+		client, WebSocketMessageDTO{
+			Type: MsgTypeTrackInfo,
+			Tracks: []TrackDTO{
+				{TrackID: "screen", Source: TrackSourceScreen},
+				{TrackID: "screen-audio", Source: TrackSourceScreenAudio},
+			},
+		},
+	)
+	if resp.Type != MsgTypeTrackInfo+"_ack" {
+		t.Fatalf("track_info: %s %q", resp.Type, resp.Message)
+	}
+
+	tests := []struct {
+		name    string
+		trackID string
+		kind    webrtc.RTPCodecType
+		source  string
+	}{
+		{"announced video", "screen", webrtc.RTPCodecTypeVideo, TrackSourceScreen},
+		{"announced audio", "screen-audio", webrtc.RTPCodecTypeAudio, TrackSourceScreenAudio},
+		// Источник не подходит к типу дорожки — берём умолчание
+		{"video announced as audio", "screen-audio", webrtc.RTPCodecTypeVideo, TrackSourceCamera},
+		{"audio announced as video", "screen", webrtc.RTPCodecTypeAudio, TrackSourceMicrophone},
+		{"unannounced video", "other", webrtc.RTPCodecTypeVideo, TrackSourceCamera},
+		{"unannounced audio", "other", webrtc.RTPCodecTypeAudio, TrackSourceMicrophone},
+	}
+	for _, tt := range tests {
+		if got := client.trackSource(tt.trackID, tt.kind); got != tt.source {
+			t.Errorf("%s: source %q, want %q", tt.name, got, tt.source)
+		}
+	}
+
+	for _, track := range []TrackDTO{{TrackID: "t", Source: "webcam"}, {Source: TrackSourceCamera}} {
+		resp := s.handleTrackInfo(client, WebSocketMessageDTO{Type: MsgTypeTrackInfo, Tracks: []TrackDTO{track}})
+		if resp.Code != TrackErrInvalidSource {
+			t.Errorf("track %+v: %s %q, want error %q", track, resp.Type, resp.Code, TrackErrInvalidSource)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// whipMaxOffer — SDP offer OBS или ffmpeg с запасом укладывается в это
+	whipMaxOffer = 64 << 10
+	// whipGatherTimeout — дольше кандидатов не ждём: отдаём answer с тем, что собрали
+	whipGatherTimeout = 3 * time.Second
+	whipClientPrefix  = "whip-"
+)
+
+var (
+	whipClients   = make(map[string]*Client) // WHIP-сессии по ID клиента
+	whipClientsMu sync.Mutex
+)
+
+// joinStatus — HTTP status for an error of authorizeJoin
+func joinStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errRoomNotFound):
+		return http.StatusNotFound, "Room not found"
+	case errors.Is(err, errRoomForbidden), errors.Is(err, errRoomPasswordRequired),
+		errors.Is(err, errRoomPasswordInvalid), errors.Is(err, errInviteInvalid), errors.Is(err, errRoomBanned):
+		return http.StatusForbidden, err.Error()
+	case errors.Is(err, errRoomRateLimited):
+		return http.StatusTooManyRequests, err.Error()
+	}
+	slog.Error("authorize join", "error", err)
+	return http.StatusInternalServerError, "Server error"
+}
+
+// hasContentType — check the media type of the request body, parameters like charset are allowed
+func hasContentType(r *http.Request, want string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == want
+}
+
+// whipPublish — WHIP: take an SDP offer of a broadcaster and put it into the room as a publishing client
+func (s *Server) whipPublish(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "User ID not found", http.StatusUnauthorized)
+		return
+	}
+	if !hasContentType(r, "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, whipMaxOffer))
+	if err != nil {
+		http.Error(w, "Invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	// Пароль и приглашение — в query: OBS умеет только URL и bearer token
+	roomID := r.PathValue("room")
+	query := r.URL.Query()
+	rec, err := authorizeJoin(userID, roomID, query.Get("password"), query.Get("invite"))
+	if err != nil {
+		status, message := joinStatus(err)
+		http.Error(w, message, status)
+		return
+	}
+	role, err := roomRole(rec, userID)
+	if err != nil {
+		status, message := joinStatus(err)
+		http.Error(w, message, status)
+		return
+	}
+	// Комнату заводим и настраиваем только перед допуском: отказ не должен оставлять пустую
+	if live, ok := s.liveRoom(roomID); ok {
+		role = live.stageRole(userID, role)
+	}
+	if role == RoomRoleListener {
+		http.Error(w, "Listeners can't publish", http.StatusForbidden)
+		return
+	}
+
+	id, err := randomToken(12)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	client := NewClient(whipClientPrefix+id, nil, nil, userID)
+	client.Ingest = true
+	loadParticipantProfile(client)
+	client.setRole(role)
+
+	pc, estimator, err := createPeerConnection()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	client.setPeer(pc, estimator)
+	pc.OnTrack(
+		func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			slog.Info("Track received", "clientID", client.ID)
+			forwardTrack(client, track, receiver)
+		},
+	)
+	pc.OnConnectionStateChange(
+		func(state webrtc.PeerConnectionState) {
+			// Издатель пропал, не прислав DELETE, или его выгнали модератором
+			if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+				go s.endIngest(client.ID)
+			}
+		},
+	)
+
+	// Сервер не может досылать кандидаты, так что answer ждёт сбора своих
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if _, err := handleOffer(pc, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}, ""); err != nil {
+		pc.Close()
+		http.Error(w, "Invalid offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-time.After(whipGatherTimeout):
+		slog.Warn("ICE gathering timed out", "clientID", client.ID)
+	}
+	answer := withAudioParams(*pc.LocalDescription(), opusFmtp(rec.AudioProfile, rec.MaxAudioBitrate))
+
+	// WHIP не может ждать в лобби: ответ нужен сейчас
+	_, live := s.liveRoom(roomID)
+	room := s.getOrCreateRoom(roomID)
+	room.configure(rec)
+	client.setServerMuted(room.IsServerMuted(userID))
+	isModerator := roleRank[role] >= roleRank[RoomRoleModerator]
+	if position := room.admitOrQueue(client, isModerator); position > 0 {
+		room.removeWaiting(client.ID)
+		pc.Close()
+		if !live {
+			s.dropIdleRoom(room)
+		}
+		http.Error(w, "Room is full or has a lobby", http.StatusServiceUnavailable)
+		return
+	}
+	s.enterRoom(client, room)
+	whipClientsMu.Lock()
+	whipClients[client.ID] = client
+	whipClientsMu.Unlock()
+	// Соединение могло закрыться раньше, чем сессия попала в whipClients: тогда
+	// OnConnectionStateChange её не нашёл, и убираем клиента из комнаты сами
+	if state := pc.ConnectionState(); state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+		s.endIngest(client.ID)
+		http.Error(w, "Connection closed", http.StatusServiceUnavailable)
+		return
+	}
+	go client.monitorQuality()
+	slog.Info("WHIP session started", "clientID", client.ID, "roomID", room.ID, "userID", userID)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+url.PathEscape(room.ID)+"/"+url.PathEscape(client.ID))
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
+
+// ingest — WHIP session from the path, only for the user who started it
+func (s *Server) ingest(w http.ResponseWriter, r *http.Request) (*Client, bool) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		http.Error(w, "User ID not found", http.StatusUnauthorized)
+		return nil, false
+	}
+	whipClientsMu.Lock()
+	client, ok := whipClients[r.PathValue("session")]
+	whipClientsMu.Unlock()
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, false
+	}
+	// Чужую сессию не выдаём даже фактом существования; из breakout издатель остаётся в той же комнате
+	room := client.CurrentRoom()
+	if client.UserID != userID || room == nil || room.root().ID != r.PathValue("room") {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return client, true
+}
+
+// whipTrickle — WHIP: add ICE candidates from an SDP fragment of the broadcaster
+func (s *Server) whipTrickle(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.ingest(w, r)
+	if !ok {
+		return
+	}
+	if !hasContentType(r, "application/trickle-ice-sdpfrag") {
+		http.Error(w, "Content-Type must be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+	pc := client.peer()
+	if pc == nil || pc.RemoteDescription() == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	remote, err := pc.RemoteDescription().Unmarshal()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// ice-ufrag бывает на уровне сессии или у m-секций; с BUNDLE он у всех один
+	ufrag, _ := remote.Attribute("ice-ufrag")
+	for _, m := range remote.MediaDescriptions {
+		if value, ok := m.Attribute("ice-ufrag"); ok {
+			ufrag = value
+			break
+		}
+	}
+
+	var candidates []webrtc.ICECandidateInit
+	var mid *string
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, whipMaxOffer))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if strings.TrimPrefix(line, "a=ice-ufrag:") != ufrag {
+				http.Error(w, "ICE restart is not supported", http.StatusUnprocessableEntity)
+				return
+			}
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, "Invalid SDP fragment", http.StatusBadRequest)
+		return
+	}
+	for _, candidate := range candidates {
+		if err := addICECandidate(pc, candidate); err != nil {
+			http.Error(w, "Invalid candidate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// whipDelete — WHIP: the broadcaster stopped, take it out of the room
+func (s *Server) whipDelete(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.ingest(w, r)
+	if !ok {
+		return
+	}
+	s.endIngest(client.ID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// endIngest — close the WHIP session and take its client out of the room, once
+func (s *Server) endIngest(clientID string) {
+	whipClientsMu.Lock()
+	client, ok := whipClients[clientID]
+	delete(whipClients, clientID)
+	whipClientsMu.Unlock()
+	if !ok {
+		return
+	}
+	s.cleanupClient(client)
+	slog.Info("WHIP session ended", "clientID", clientID)
+}
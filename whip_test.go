@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestWHIPTrickle(t *testing.T) {
+	api, err := newWebRTCAPI(nil)
+	if err != nil {
+		t.Fatalf("create API: %v", err)
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("create PeerConnection: %v", err)
+	}
+	defer pc.Close()
+	// ice-ufrag издателя в offer — Jx4v
+	if _, err := handleOffer(pc, chromeOfferVersion("2"), ""); err != nil {
+		t.Fatalf("offer: %v", err)
+	}
+
+	s := NewServer()
+	room := NewRoom("studio")
+	client := NewClient(whipClientPrefix+"test", nil, nil, 7)
+	client.setPeer(pc, nil)
+	client.setRoom(room)
+	whipClientsMu.Lock()
+	whipClients[client.ID] = client
+	whipClientsMu.Unlock()
+	t.Cleanup(
+		func() {
+			whipClientsMu.Lock()
+			delete(whipClients, client.ID)
+			whipClientsMu.Unlock()
+		},
+	)
+
+	const candidate = "a=candidate:1 1 udp 2122260223 127.0.0.1 9 typ host\r\n"
+	tests := []struct {
+		name        string
+		userID      int
+		roomID      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"same ufrag", 7, "studio", "application/trickle-ice-sdpfrag", "a=ice-ufrag:Jx4v\r\na=mid:0\r\n" + candidate, http.StatusNoContent},
+		{"content type with charset", 7, "studio", "application/trickle-ice-sdpfrag; charset=utf-8", "a=mid:0\r\n" + candidate, http.StatusNoContent},
+		{"without ufrag", 7, "studio", "application/trickle-ice-sdpfrag", "a=mid:0\r\n" + candidate, http.StatusNoContent},
+		{"ICE restart", 7, "studio", "application/trickle-ice-sdpfrag", "a=ice-ufrag:N3wU\r\na=mid:0\r\n" + candidate, http.StatusUnprocessableEntity},
+		{"invalid candidate", 7, "studio", "application/trickle-ice-sdpfrag", "a=ice-ufrag:Jx4v\r\na=candidate:garbage\r\n", http.StatusBadRequest},
+		{"wrong content type", 7, "studio", "application/sdp", candidate, http.StatusUnsupportedMediaType},
+		// Чужая сессия и сессия из другой комнаты неотличимы от несуществующей
+		{"another user", 8, "studio", "application/trickle-ice-sdpfrag", candidate, http.StatusNotFound},
+		{"another room", 7, "lobby", "application/trickle-ice-sdpfrag", candidate, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPatch, "/whip/"+tt.roomID+"/"+client.ID, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		r.SetPathValue("room", tt.roomID)
+		r.SetPathValue("session", client.ID)
+		r = r.WithContext(context.WithValue(r.Context(), userIdContextKey, tt.userID))
+		w := httptest.NewRecorder()
+		s.whipTrickle(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d (%s)", tt.name, w.Code, tt.status, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
+
+func TestWHIPPublishRejectedLeavesNoRoom(t *testing.T) {
+	openTestDB(t)
+	prev := cfg
+	cfg.MaxRoomParticipants = 10
+	t.Cleanup(func() { cfg = prev })
+	for _, name := range []string{"owner", "streamer"} {
+		if _, err := db.Exec("INSERT INTO users (username, password) VALUES ($1, $2)", name, "hash"); err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+	}
+	s := NewServer()
+	rec := RoomRecord{
+		ID:           "studio",
+		OwnerID:      sql.NullInt64{Int64: 1, Valid: true},
+		Visibility:   RoomVisibilityPublic,
+		LobbyEnabled: true,
+		AudioProfile: AudioProfileVoice,
+	}
+	if err := s.createRoom(&rec, ""); err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+
+	// Комната с лобби: WHIP ждать не может и получает отказ; charset в Content-Type не мешает
+	r := httptest.NewRequest(http.MethodPost, "/whip/studio", strings.NewReader(chromeOfferVersion("2").SDP))
+	r.Header.Set("Content-Type", "application/sdp; charset=utf-8")
+	r.SetPathValue("room", "studio")
+	r = r.WithContext(context.WithValue(r.Context(), userIdContextKey, 2))
+	w := httptest.NewRecorder()
+	s.whipPublish(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want %d (%s)", w.Code, http.StatusServiceUnavailable, strings.TrimSpace(w.Body.String()))
+	}
+	if _, ok := s.liveRoom("studio"); ok {
+		t.Error("rejected publisher left an empty room behind")
+	}
+}
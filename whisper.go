@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+)
+
+const (
+	MsgTypeWhisper        = "whisper"
+	MsgTypeWhisperStop    = "whisper_stop"
+	MsgTypeWhisperStarted = "whisper_started"
+	MsgTypeWhisperEnded   = "whisper_ended"
+
+	WhisperErrNoTargets = "no_targets"
+)
+
+// whispersTo — check if the client's audio may reach the subscriber
+func (c *Client) whispersTo(clientID string) bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Whisper == nil || c.Whisper[clientID]
+}
+
+// setWhisper — replace whisper targets, nil speaks to the whole room; returns previous targets
+func (c *Client) setWhisper(targets map[string]bool) map[string]bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	prev := c.Whisper
+	c.Whisper = targets
+	return prev
+}
+
+// notifyWhisper — tell recipients that a whisper to them started or ended
+func notifyWhisper(room *Room, whisperer *Client, clientIDs map[string]bool, msgType string) {
+	clients := room.GetClients()
+	for id := range clientIDs {
+		target, ok := clients[id]
+		if !ok {
+			continue
+		}
+		if err := target.Send(WebSocketMessageDTO{Type: msgType, RoomID: room.ID, ClientID: whisperer.ID}); err != nil {
+			slog.Error("notify whisper", "type", msgType, "clientID", id, "error", err)
+		}
+	}
+}
+
+// stopWhisper — return the client's audio to the whole room
+func (s *Server) stopWhisper(client *Client, room *Room) {
+	prev := client.setWhisper(nil)
+	if prev != nil {
+		notifyWhisper(room, client, prev, MsgTypeWhisperEnded)
+	}
+}
+
+// handleWhisper — start, retarget or stop a whisper to selected participants
+func (s *Server) handleWhisper(client *Client, msg WebSocketMessageDTO) WebSocketMessageDTO {
+	room := client.CurrentRoom()
+	if msg.Type == MsgTypeWhisperStop {
+		s.stopWhisper(client, room)
+		return WebSocketMessageDTO{Type: msg.Type + "_ack"}
+	}
+
+	if _, _, errMsg := requireModerator(client, room); errMsg != nil {
+		return *errMsg
+	}
+	if len(msg.TargetClientIDs) == 0 {
+		return WebSocketMessageDTO{Type: MsgTypeError, Code: WhisperErrNoTargets, Message: "Whisper needs at least one target"}
+	}
+	clients := room.GetClients()
+	targets := make(map[string]bool, len(msg.TargetClientIDs))
+	for _, id := range msg.TargetClientIDs {
+		if _, ok := clients[id]; !ok || id == client.ID {
+			return moderationError(ModErrTargetNotFound, "Participant not found: "+id)
+		}
+		targets[id] = true
+	}
+
+	prev := client.setWhisper(targets)
+	// Уведомляем только тех, для кого что-то изменилось
+	started := make(map[string]bool)
+	for id := range targets {
+		if !prev[id] {
+			started[id] = true
+		}
+	}
+	ended := make(map[string]bool)
+	for id := range prev {
+		if !targets[id] {
+			ended[id] = true
+		}
+	}
+	notifyWhisper(room, client, started, MsgTypeWhisperStarted)
+	notifyWhisper(room, client, ended, MsgTypeWhisperEnded)
+
+	slog.Info("Whisper started", "clientID", client.ID, "roomID", room.ID, "targets", msg.TargetClientIDs)
+	return WebSocketMessageDTO{Type: msg.Type + "_ack", TargetClientIDs: msg.TargetClientIDs}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWhisperTargets(t *testing.T) {
+	s, room, clients := moderatedRoom(t)
+	moderator := clients[2]
+
+	tests := []struct {
+		name    string
+		actor   int
+		msg     WebSocketMessageDTO
+		code    string          // пусто — действие выполнено
+		hearing map[string]bool // кто слышит модератора после шага
+	}{
+		{
+			"speaker whispers", 3, WebSocketMessageDTO{Type: MsgTypeWhisper, TargetClientIDs: []string{"owner"}},
+			ModErrForbidden, map[string]bool{"owner": true, "speaker": true, "listener": true},
+		},
+		{
+			"no targets", 2, WebSocketMessageDTO{Type: MsgTypeWhisper},
+			WhisperErrNoTargets, map[string]bool{"owner": true, "speaker": true, "listener": true},
+		},
+		{
+			"unknown target", 2, WebSocketMessageDTO{Type: MsgTypeWhisper, TargetClientIDs: []string{"speaker", "nobody"}},
+			ModErrTargetNotFound, map[string]bool{"owner": true, "speaker": true, "listener": true},
+		},
+		{
+			"whisper to self", 2, WebSocketMessageDTO{Type: MsgTypeWhisper, TargetClientIDs: []string{"moderator"}},
+			ModErrTargetNotFound, map[string]bool{"owner": true, "speaker": true, "listener": true},
+		},
+		{
+			"whisper", 2, WebSocketMessageDTO{Type: MsgTypeWhisper, TargetClientIDs: []string{"speaker"}},
+			"", map[string]bool{"speaker": true},
+		},
+		{
+			"retarget", 2, WebSocketMessageDTO{Type: MsgTypeWhisper, TargetClientIDs: []string{"owner", "listener"}},
+			"", map[string]bool{"owner": true, "listener": true},
+		},
+		{
+			"stop", 2, WebSocketMessageDTO{Type: MsgTypeWhisperStop},
+			"", map[string]bool{"owner": true, "speaker": true, "listener": true},
+		},
+	}
+	for _, tt := range tests {
+		resp := s.handleWhisper(clients[tt.actor], tt.msg)
+		if tt.code == "" && resp.Type != tt.msg.Type+"_ack" {
+			t.Errorf("%s: %s %q %q", tt.name, resp.Type, resp.Code, resp.Message)
+		}
+		if tt.code != "" && (resp.Type != MsgTypeError || resp.Code != tt.code) {
+			t.Errorf("%s: %s %q, want error %q", tt.name, resp.Type, resp.Code, tt.code)
+		}
+		for _, subscriber := range clients {
+			if subscriber == moderator {
+				continue
+			}
+			if got := moderator.whispersTo(subscriber.ID); got != tt.hearing[subscriber.ID] {
+				t.Errorf("%s: %s hears %v, want %v", tt.name, subscriber.ID, got, tt.hearing[subscriber.ID])
+			}
+		}
+	}
+
+	// Шёпот не переживает выход из комнаты
+	s.handleWhisper(moderator, WebSocketMessageDTO{Type: MsgTypeWhisper, TargetClientIDs: []string{"speaker"}})
+	s.exitRoom(moderator, room)
+	if !moderator.whispersTo("listener") {
+		t.Error("whisper kept after leaving the room")
+	}
+}